@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/rockset/rockbench/generator"
+)
+
+// command is a subcommand of rockbench
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"run", "generate documents and send them to the destination (default)", runCommand},
+	{"generate", "write generated documents to stdout or a file, without a destination", generateCommand},
+	{"capacity", "search for the highest rate the destination sustains within a latency SLO", capacityCommand},
+	{"latency", "only poll the e2e latency of an existing generator identifier", latencyCommand},
+	{"setup", "configure the destination for a generator identifier without sending documents", setupCommand},
+	{"teardown", "remove what setup created for a generator identifier", teardownCommand},
+	{"validate-config", "check the configuration and report every problem found", validateConfigCommand},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: rockbench [command] [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun `rockbench <command> --help` for the flags of a command. "+
+		"Settings not covered by flags come from the --config file and env variables, see README.md.\n")
+}
+
+func isHelpFlag(arg string) bool {
+	return arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+// newFlagSet creates the flags of a subcommand, which all take a config file
+func newFlagSet(name string, description string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file, env vars override its values")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: rockbench %s [flags]\n\n%s\n\nFlags:\n", name, description)
+		flags.PrintDefaults()
+	}
+	return flags, configPath
+}
+
+func generateCommand(args []string) error {
+	flags, configPath := newFlagSet("generate", "Writes generated documents as JSON lines, using the document settings "+
+		"of the configuration (ID_MODE, NUM_CLUSTERS, ...). No destination is needed.")
+	count := flags.Int("count", 10, "number of documents to generate")
+	output := flags.String("output", "-", "file to write the documents to, - for stdout")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(cfg.checkDocuments); err != nil {
+		return err
+	}
+	if *count < 0 {
+		return fmt.Errorf("--count must not be negative")
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		w, err = os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer w.Close()
+	}
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+
+	generatorIdentifier := cfg.GeneratorIdentifier
+	if generatorIdentifier == "" {
+		generatorIdentifier = generator.RandomString(10)
+	}
+	spec, err := cfg.documentSpec(generatorIdentifier)
+	if err != nil {
+		return err
+	}
+	g := generator.NewGenerator(spec)
+	if cfg.MaxDocs > 0 {
+		g.SetMaxDoc(cfg.MaxDocs)
+	}
+	for i := 0; i < *count; i++ {
+		doc, err := g.GenerateDoc()
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("failed to write document: %w", err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write documents: %w", err)
+	}
+	return nil
+}
+
+func capacityCommand(args []string) error {
+	flags, configPath := newFlagSet("capacity", "Sends the configured workload while searching for the highest rate, in "+
+		"batches per second, at which the p95 e2e latency stays under CAPACITY_P95_LATENCY_SLO and the error rate under "+
+		"CAPACITY_MAX_ERROR_RATE. The result is logged and written to the report.")
+	skipSetup := flags.Bool("skip-setup", false, "don't configure the destination, reuse what `rockbench setup` created for GENERATOR_IDENTIFIER")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	cfg.resolveCapacity()
+	if err := cfg.validate(cfg.checkDocuments, cfg.checkRate, cfg.checkLatency, cfg.checkTrace, cfg.checkQuery, cfg.checkDestination, cfg.checkCapacity); err != nil {
+		return err
+	}
+	if *skipSetup && cfg.GeneratorIdentifier == "" {
+		return fmt.Errorf("--skip-setup requires GENERATOR_IDENTIFIER to be set to the identifier used with setup")
+	}
+
+	search := cfg.Capacity.search(cfg.BatchSize)
+	return run(cfg, runOptions{
+		skipSetup: *skipSetup,
+		control: func(rc *generator.RateController, done <-chan struct{}) {
+			r := search.Run(rc, done)
+			log.Printf("max sustainable rate: %.1f batches per second, %.1f docs per second",
+				r.MaxSustainableRate, r.MaxSustainableDocsPerSecond)
+		},
+	})
+}
+
+func latencyCommand(args []string) error {
+	flags, configPath := newFlagSet("latency", "Polls the e2e latency of documents sent by another rockbench run, "+
+		"without sending any documents. Stops when interrupted or after --duration.")
+	identifier := flags.String("identifier", "", "generator identifier of the run to measure, defaults to GENERATOR_IDENTIFIER")
+	interval := flags.Duration("interval", 0, "time between latency queries, LATENCY_POLL_INTERVAL if not set")
+	duration := flags.Duration("duration", 0, "stop polling after this long, 0 to poll until interrupted")
+	patches := flags.Bool("patches", false, "also poll the latency of the patches of the run")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *interval > 0 {
+		cfg.Latency.PollInterval = *interval
+	}
+	if err := cfg.validate(cfg.checkLatency, cfg.checkDestination); err != nil {
+		return err
+	}
+	if *identifier == "" {
+		*identifier = cfg.GeneratorIdentifier
+	}
+	if *identifier == "" {
+		return fmt.Errorf("--identifier or GENERATOR_IDENTIFIER must be set")
+	}
+	if r, _ := generator.Lookup(cfg.Destination); !r.Capabilities.LatencyQuery {
+		return fmt.Errorf("destination %s does not support tracking latency", cfg.Destination)
+	}
+	if r, _ := generator.Lookup(cfg.Destination); *patches && !r.Capabilities.PatchLatencyQuery {
+		return fmt.Errorf("destination %s does not support tracking patch latency", cfg.Destination)
+	}
+	reportPath = cfg.ReportPath
+
+	d, err := newDestination(cfg, newHTTPClient(), *identifier)
+	if err != nil {
+		return err
+	}
+	generator.ConfigureLatencySummaries(cfg.Latency.Objectives, cfg.Latency.MaxAge)
+	if cfg.ExportMetrics {
+		go metricListener(cfg.PromPort)
+	}
+	generator.StartRun(generator.RunInfo{
+		GeneratorIdentifier: *identifier,
+		Destination:         cfg.Destination,
+		Mode:                "latency",
+	})
+
+	doneChan, _ := handleSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *duration)
+		defer cancelTimeout()
+	}
+	go func() {
+		<-doneChan
+		cancel()
+	}()
+
+	queries := &latencyQueries{maxPlausible: cfg.Latency.MaxPlausible}
+	queries.writes.Store(true)
+	queries.patches.Store(*patches)
+	// Start polling right away, there is no run to space the queries out with
+	schedule := newPollSchedule(cfg.Latency, 1, 0)
+	schedule.initialDelay = 0
+	pollLatency(ctx, d, schedule, queries)
+	log.Printf("done")
+	exit(0)
+	return nil
+}
+
+func setupCommand(args []string) error {
+	flags, configPath := newFlagSet("setup", "Configures the destination for a generator identifier without sending "+
+		"documents. Pass the identifier to `rockbench run --skip-setup` through GENERATOR_IDENTIFIER to use it.")
+	identifier := flags.String("identifier", "", "generator identifier to set up, defaults to GENERATOR_IDENTIFIER or a random one")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(cfg.checkDestination); err != nil {
+		return err
+	}
+	if *identifier == "" {
+		*identifier = cfg.GeneratorIdentifier
+	}
+	if *identifier == "" {
+		*identifier = generator.RandomString(10)
+	}
+
+	d, err := newDestination(cfg, newHTTPClient(), *identifier)
+	if err != nil {
+		return err
+	}
+	if err := d.ConfigureDestination(context.Background()); err != nil {
+		return fmt.Errorf("unable to configure %s: %w", cfg.Destination, err)
+	}
+	fmt.Println("Generator identifier: ", *identifier)
+	return nil
+}
+
+func teardownCommand(args []string) error {
+	flags, configPath := newFlagSet("teardown", "Removes what setup, or a run, created in the destination for a generator identifier.")
+	identifier := flags.String("identifier", "", "generator identifier to tear down, defaults to GENERATOR_IDENTIFIER")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(cfg.checkDestination); err != nil {
+		return err
+	}
+	if *identifier == "" {
+		*identifier = cfg.GeneratorIdentifier
+	}
+	if *identifier == "" {
+		return fmt.Errorf("--identifier or GENERATOR_IDENTIFIER must be set")
+	}
+
+	d, err := newDestination(cfg, newHTTPClient(), *identifier)
+	if err != nil {
+		return err
+	}
+	t, ok := d.(generator.TeardownDestination)
+	if !ok {
+		fmt.Printf("Nothing to tear down for %s\n", cfg.Destination)
+		return nil
+	}
+	if err := t.TeardownDestination(context.Background()); err != nil {
+		return fmt.Errorf("unable to tear down %s: %w", cfg.Destination, err)
+	}
+	return nil
+}
+
+func validateConfigCommand(args []string) error {
+	flags, configPath := newFlagSet("validate-config", "Checks the configuration for a run and reports every problem found at once.")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration with secrets redacted")
+	_ = flags.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if *printConfig {
+		out, err := cfg.YAML()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
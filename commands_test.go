@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateCommand(t *testing.T) {
+	t.Setenv("GENERATOR_IDENTIFIER", "test")
+	t.Setenv("NUM_CLUSTERS", "3")
+	path := filepath.Join(t.TempDir(), "docs.json")
+
+	assert.Nil(t, generateCommand([]string{"--count", "1005", "--output", path}))
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var doc map[string]interface{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &doc))
+		assert.Equal(t, "test", doc["generator_identifier"])
+		assert.NotEmpty(t, doc["cluster1"])
+		lines++
+	}
+	assert.Nil(t, scanner.Err())
+	assert.Equal(t, 1005, lines)
+}
+
+func TestGenerateCommand_InvalidConfig(t *testing.T) {
+	t.Setenv("ID_MODE", "random")
+
+	assert.EqualError(t, generateCommand(nil), "invalid configuration:\n  Invalid idMode specified, expecting 'sequential' or 'uuid'")
+}
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rockset/rockbench/generator"
+)
+
+// Config is the configuration of a run.
+//
+// It is loaded from an optional YAML or JSON file, and then every field tagged with `env` is overridden by that
+// environment variable if it is set, so existing env var based setups keep working. Destination options are overridden
+// the same way by the env variables they are registered with.
+type Config struct {
+	Destination string `yaml:"destination" env:"DESTINATION"`
+	WPS         int    `yaml:"wps" env:"WPS"`
+	// PPS is the number of patch batches per second, same as WPS if not set
+	PPS       int `yaml:"pps" env:"PPS"`
+	BatchSize int `yaml:"batch_size" env:"BATCH_SIZE"`
+	NumDocs   int `yaml:"num_docs" env:"NUM_DOCS"`
+	// MaxDocs is the known max doc id, used for upserts to update existing collections
+	MaxDocs   int    `yaml:"max_docs" env:"MAX_DOCS"`
+	Mode      string `yaml:"mode" env:"MODE"`
+	IDMode    string `yaml:"id_mode" env:"ID_MODE"`
+	PatchMode string `yaml:"patch_mode" env:"PATCH_MODE"`
+
+	// UpdatePercentage is the percentage of documents that update existing documents in mixed mode
+	UpdatePercentage int `yaml:"update_percentage" env:"UPDATE_PERCENTAGE"`
+	// DeletePercentage is the percentage of documents that delete existing documents in mixed mode
+	DeletePercentage int `yaml:"delete_percentage" env:"DELETE_PERCENTAGE"`
+	// NumClusters is the number of distinct values for the cluster key
+	NumClusters int `yaml:"num_clusters" env:"NUM_CLUSTERS"`
+	// SchemaFile is a YAML file describing the documents to generate, see generator.FieldSpec. The built-in schema is
+	// used if not set.
+	SchemaFile string `yaml:"schema_file" env:"SCHEMA_FILE"`
+	// DocSize is the serialized size in bytes documents are padded or trimmed to, either fixed like `2KB`, uniform
+	// like `200-50KB` or normal like `normal:4KB:1KB`, see generator.ParseDocSize. Documents keep their size if not set.
+	DocSize string `yaml:"doc_size" env:"DOC_SIZE"`
+	// HotClusterPercentage is the percentage of inserts/updates that go to single cluster key, the rest are uniformly distributed
+	HotClusterPercentage int `yaml:"hot_cluster_percentage" env:"HOT_CLUSTER_PERCENTAGE"`
+	// Workload is a custom mix of operations, sent instead of the one of MODE when set
+	Workload Workload `yaml:"workload,omitempty" env:"WORKLOAD"`
+	// Phases is a schedule of rates the run follows instead of WPS and PPS, ending with the last phase
+	Phases Phases `yaml:"phases,omitempty" env:"PHASES"`
+
+	ExportMetrics bool `yaml:"export_metrics" env:"EXPORT_METRICS"`
+	PromPort      int  `yaml:"prom_port" env:"PROM_PORT"`
+	TrackLatency  bool `yaml:"track_latency" env:"TRACK_LATENCY"`
+	// Replicas is used to dynamically adjust the period between latency calculations to reduce the total rate of queries
+	// Ex. If we want 1 query per 25s and we have 2 replicas, the polling period should be 2 * 25s=50s for each replica.
+	// See LatencyConfig for how replicas share the queries.
+	Replicas int `yaml:"replicas" env:"REPLICAS"`
+	// Seed makes the documents, ids and patches generated reproducible, combined with ReplicaIndex so every replica
+	// generates different data. Seeded runs generate with a single worker, so batches come out in a fixed order.
+	// Random if not set.
+	Seed int `yaml:"seed" env:"SEED"`
+	// ReplicaIndex is the index of this replica among Replicas, e.g. the ordinal of a StatefulSet pod
+	ReplicaIndex int `yaml:"replica_index" env:"REPLICA_INDEX"`
+	// GeneratorIdentifier tags the documents of a run, so latency is only measured on them. Random if not set.
+	GeneratorIdentifier string `yaml:"generator_identifier" env:"GENERATOR_IDENTIFIER"`
+
+	// MaxInFlight is the maximum number of batches waiting on the destination at once
+	MaxInFlight int `yaml:"max_in_flight" env:"MAX_IN_FLIGHT"`
+	// GeneratorWorkers generate documents ahead of time, so faker is not on the send path. One per CPU if not set, or
+	// one if SEED is set.
+	GeneratorWorkers int `yaml:"generator_workers" env:"GENERATOR_WORKERS"`
+	// GeneratorQueueSize is the number of batches generated ahead of time, about a second worth if not set
+	GeneratorQueueSize int `yaml:"generator_queue_size" env:"GENERATOR_QUEUE_SIZE"`
+	// DrainTimeout is how long to wait for in-flight batches to finish when stopping before cancelling them
+	DrainTimeout time.Duration `yaml:"drain_timeout" env:"DRAIN_TIMEOUT"`
+	ReportPath   string        `yaml:"report_path" env:"REPORT_PATH"`
+
+	Retry RetryConfig `yaml:"retry"`
+	// Latency configures how the latency is polled and summarized
+	Latency LatencyConfig `yaml:"latency"`
+	// Trace configures the tracing of a sample of documents to measure how long each takes to become visible
+	Trace TraceConfig `yaml:"trace"`
+	// Capacity configures the search of the capacity command
+	Capacity CapacityConfig `yaml:"capacity_search"`
+	// Query configures the query load run alongside the writes
+	Query QueryConfig `yaml:"query"`
+
+	// Destinations are the options of each destination by destination name, set in a section named after it.
+	// The available options are those registered by the destination, see generator.Register.
+	Destinations map[string]map[string]string `yaml:",inline"`
+}
+
+// WorkloadOperation is an operation of a custom workload, getting either Share of the WPS batches or its own Rate of
+// batches per second
+type WorkloadOperation struct {
+	Op    string `yaml:"op"`
+	Share int    `yaml:"share,omitempty"`
+	Rate  int    `yaml:"rate,omitempty"`
+}
+
+// Workload is a custom mix of operations. In env variables it's written as a list of op:share, e.g.
+// `insert:70,patch_replace:25,delete:5`, or of op:rate/s to give every operation its own rate.
+type Workload []WorkloadOperation
+
+// UnmarshalText parses the env variable format of a workload, which can be used in config files too
+func (w *Workload) UnmarshalText(text []byte) error {
+	var ops Workload
+	for _, item := range strings.Split(string(text), ",") {
+		op, weight, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			return fmt.Errorf("expected op:share or op:rate/s, got %q", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(weight, "/s"))
+		if err != nil {
+			return fmt.Errorf("%q is not integer", weight)
+		}
+		if strings.HasSuffix(weight, "/s") {
+			ops = append(ops, WorkloadOperation{Op: op, Rate: n})
+		} else {
+			ops = append(ops, WorkloadOperation{Op: op, Share: n})
+		}
+	}
+	*w = ops
+	return nil
+}
+
+// String renders the workload in its env variable format
+func (w Workload) String() string {
+	items := make([]string, len(w))
+	for i, op := range w {
+		if op.Rate > 0 {
+			items[i] = fmt.Sprintf("%s:%d/s", op.Op, op.Rate)
+		} else {
+			items[i] = fmt.Sprintf("%s:%d", op.Op, op.Share)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// totalRate is the sum of the rates of the operations, 0 if they have shares of WPS instead
+func (w Workload) totalRate() int {
+	total := 0
+	for _, op := range w {
+		total += op.Rate
+	}
+	return total
+}
+
+// PhaseConfig is a phase of the rate schedule, lasting Duration at Rate batches per second. If From is set, the rate
+// ramps linearly from From to Rate instead.
+type PhaseConfig struct {
+	Name     string        `yaml:"name"`
+	Duration time.Duration `yaml:"duration"`
+	From     float64       `yaml:"from,omitempty"`
+	Rate     float64       `yaml:"rate"`
+}
+
+// Phases is a schedule of rates. In env variables it's written as a list of name:duration:rate, or
+// name:duration:from-rate for ramps, e.g. `ramp:5m:1-50,steady:30m:50,spike:60s:200,cooldown:10m:50`.
+type Phases []PhaseConfig
+
+// UnmarshalText parses the env variable format of phases, which can be used in config files too
+func (p *Phases) UnmarshalText(text []byte) error {
+	var phases Phases
+	for _, item := range strings.Split(string(text), ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("expected name:duration:rate or name:duration:from-rate, got %q", item)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", parts[1])
+		}
+		phase := PhaseConfig{Name: parts[0], Duration: d}
+		rate := parts[2]
+		if from, to, ramp := strings.Cut(rate, "-"); ramp {
+			if phase.From, err = strconv.ParseFloat(from, 64); err != nil {
+				return fmt.Errorf("%q is not a number", from)
+			}
+			rate = to
+		}
+		if phase.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return fmt.Errorf("%q is not a number", rate)
+		}
+		phases = append(phases, phase)
+	}
+	*p = phases
+	return nil
+}
+
+// maxRate is the highest rate of the schedule
+func (p Phases) maxRate() float64 {
+	var highest float64
+	for _, phase := range p {
+		if phase.Rate > highest {
+			highest = phase.Rate
+		}
+		if phase.From > highest {
+			highest = phase.From
+		}
+	}
+	return highest
+}
+
+// schedule converts the phases to the schedule followed by the run
+func (p Phases) schedule() generator.Schedule {
+	s := make(generator.Schedule, len(p))
+	for i, phase := range p {
+		s[i] = generator.Phase{Name: phase.Name, Duration: phase.Duration, From: phase.From, Rate: phase.Rate}
+	}
+	return s
+}
+
+// RetryConfig configures retries of throttled or transiently failed requests, disabled by default
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts" env:"RETRY_MAX_ATTEMPTS"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env:"RETRY_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env:"RETRY_MAX_BACKOFF"`
+	MaxElapsed     time.Duration `yaml:"max_elapsed" env:"RETRY_MAX_ELAPSED"`
+}
+
+// LatencyConfig configures the latency queries of TRACK_LATENCY. The destination is queried every PollInterval on
+// average across all replicas, which Coordination spreads out:
+//
+//   - `random` polls every PollInterval*REPLICAS on every replica, starting after a random delay
+//   - `staggered` polls every PollInterval*REPLICAS on every replica, starting after REPLICA_INDEX*PollInterval, so the
+//     replicas take turns evenly
+//   - `none` polls every PollInterval on every replica, multiplying the queries by REPLICAS
+//
+// Every poll is moved by up to Jitter times the period at random. Adaptive schedules poll up to every MinInterval on
+// every replica while the latency changes, and slow down again once it settles. Objectives are the quantiles of the
+// latency summaries with their allowed error, computed over the last MaxAge. Latencies of timestamps written by another
+// replica are measured with the wall clock, and discarded if they are negative or longer than MaxPlausible.
+type LatencyConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"LATENCY_POLL_INTERVAL"`
+	Jitter       float64       `yaml:"jitter" env:"LATENCY_POLL_JITTER"`
+	Coordination string        `yaml:"coordination" env:"LATENCY_POLL_COORDINATION"`
+	Adaptive     bool          `yaml:"adaptive" env:"LATENCY_POLL_ADAPTIVE"`
+	MinInterval  time.Duration `yaml:"min_interval" env:"LATENCY_POLL_MIN_INTERVAL"`
+	Objectives   Objectives    `yaml:"objectives,omitempty" env:"LATENCY_OBJECTIVES"`
+	MaxAge       time.Duration `yaml:"max_age" env:"LATENCY_MAX_AGE"`
+	MaxPlausible time.Duration `yaml:"max_plausible" env:"LATENCY_MAX_PLAUSIBLE"`
+}
+
+// Objectives are the quantiles of a summary with their allowed error, the defaults of the generator if empty. In env
+// variables they are written as a list of quantile:error, e.g. `0.5:0.05,0.99:0.001`.
+type Objectives map[float64]float64
+
+// UnmarshalText parses the env variable format of objectives
+func (o *Objectives) UnmarshalText(text []byte) error {
+	objectives := make(Objectives)
+	for _, item := range strings.Split(string(text), ",") {
+		quantile, allowedError, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			return fmt.Errorf("expected quantile:error, got %q", item)
+		}
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", quantile)
+		}
+		e, err := strconv.ParseFloat(allowedError, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", allowedError)
+		}
+		objectives[q] = e
+	}
+	*o = objectives
+	return nil
+}
+
+// TraceConfig configures visibility tracing, disabled by default. SampleRate of the documents inserted or upserted, from
+// 0 to 1, carry a probe token which is looked for every PollInterval, until it's found or Timeout has passed.
+type TraceConfig struct {
+	SampleRate   float64       `yaml:"sample_rate" env:"TRACE_SAMPLE_RATE"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"TRACE_POLL_INTERVAL"`
+	Timeout      time.Duration `yaml:"timeout" env:"TRACE_TIMEOUT"`
+}
+
+// QueryConfig configures the query load, disabled by default. Every replica runs QPS queries per second alongside the
+// writes, with up to MaxInFlight at once, picking the kind of each according to the shares of Mix. Mix defaults to an
+// equal share of every kind of query the documents of the run support.
+type QueryConfig struct {
+	QPS         float64  `yaml:"qps" env:"QUERY_QPS"`
+	Mix         QueryMix `yaml:"mix,omitempty" env:"QUERY_MIX"`
+	MaxInFlight int      `yaml:"max_in_flight" env:"QUERY_MAX_IN_FLIGHT"`
+}
+
+// QueryMix is the share of each kind of query by name, see generator.QueryKinds. In env variables it's written as a list
+// of query:share, e.g. `point_lookup:70,company_aggregation:30`.
+type QueryMix map[string]int
+
+// UnmarshalText parses the env variable format of a query mix
+func (m *QueryMix) UnmarshalText(text []byte) error {
+	mix := make(QueryMix)
+	for _, item := range strings.Split(string(text), ",") {
+		kind, share, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			return fmt.Errorf("expected query:share, got %q", item)
+		}
+		n, err := strconv.Atoi(share)
+		if err != nil {
+			return fmt.Errorf("%q is not integer", share)
+		}
+		mix[kind] = n
+	}
+	*m = mix
+	return nil
+}
+
+// CapacityConfig configures the search for the highest rate, in batches per second, at which the p95 e2e latency
+// stays under LatencySLO and the error rate under MaxErrorRate. Every rate tried is held for Warmup and then measured
+// over Window, while the latency is polled every PollInterval.
+type CapacityConfig struct {
+	// Strategy is either `step`, raising the rate by Step from MinRate until it fails, or `binary`, bisecting the
+	// range between MinRate and MaxRate until it's narrower than Step
+	Strategy     string        `yaml:"strategy" env:"CAPACITY_STRATEGY"`
+	MinRate      float64       `yaml:"min_rate" env:"CAPACITY_MIN_RATE"`
+	MaxRate      float64       `yaml:"max_rate" env:"CAPACITY_MAX_RATE"`
+	Step         float64       `yaml:"step" env:"CAPACITY_STEP"`
+	Warmup       time.Duration `yaml:"warmup" env:"CAPACITY_WARMUP"`
+	Window       time.Duration `yaml:"window" env:"CAPACITY_WINDOW"`
+	LatencySLO   time.Duration `yaml:"p95_latency_slo" env:"CAPACITY_P95_LATENCY_SLO"`
+	MaxErrorRate float64       `yaml:"max_error_rate" env:"CAPACITY_MAX_ERROR_RATE"`
+	MinSamples   int           `yaml:"min_samples" env:"CAPACITY_MIN_SAMPLES"`
+	PollInterval time.Duration `yaml:"poll_interval" env:"CAPACITY_POLL_INTERVAL"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		NumDocs:              -1,
+		MaxDocs:              -1,
+		Mode:                 "add",
+		IDMode:               "uuid",
+		PatchMode:            "replace",
+		UpdatePercentage:     -1,
+		NumClusters:          -1,
+		HotClusterPercentage: -1,
+		PromPort:             9161,
+		Replicas:             1,
+		// Matches the number of idle connections kept per host
+		MaxInFlight:  100,
+		DrainTimeout: 30 * time.Second,
+		Retry: RetryConfig{
+			MaxAttempts:    generator.DefaultRetryPolicy.MaxAttempts,
+			InitialBackoff: generator.DefaultRetryPolicy.InitialBackoff,
+			MaxBackoff:     generator.DefaultRetryPolicy.MaxBackoff,
+			MaxElapsed:     generator.DefaultRetryPolicy.MaxElapsed,
+		},
+		Latency: LatencyConfig{
+			PollInterval: 25 * time.Second,
+			Coordination: "random",
+			MinInterval:  time.Second,
+			// The default of Prometheus summaries
+			MaxAge:       10 * time.Minute,
+			MaxPlausible: time.Hour,
+		},
+		Trace: TraceConfig{
+			PollInterval: 5 * time.Second,
+			Timeout:      5 * time.Minute,
+		},
+		Query: QueryConfig{
+			MaxInFlight: 16,
+		},
+		Capacity: CapacityConfig{
+			Strategy:     "binary",
+			MinRate:      1,
+			MaxRate:      1000,
+			Step:         5,
+			Warmup:       30 * time.Second,
+			Window:       2 * time.Minute,
+			MaxErrorRate: 0.01,
+			MinSamples:   10,
+			PollInterval: 5 * time.Second,
+		},
+		Destinations: make(map[string]map[string]string),
+	}
+}
+
+// configErrors is every problem found with a configuration
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// loadConfig loads the configuration from path, if not empty, and the environment.
+// Values that default to other values are resolved, but the configuration is not validated.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	var errs configErrors
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// JSON is valid YAML, so both are read the same way
+		if err := yaml.Unmarshal(b, &c); err != nil {
+			return c, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	errs = append(errs, applyEnv(reflect.ValueOf(&c).Elem())...)
+	applyDestinationEnv(c.Destinations)
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	c.resolve()
+	return c, nil
+}
+
+// resolve fills in values which default to other values
+func (c *Config) resolve() {
+	c.Destination = strings.ToLower(c.Destination)
+	if r, ok := generator.Lookup(c.Destination); ok {
+		c.Destinations[c.Destination] = r.WithDefaults(c.Destinations[c.Destination])
+	}
+	if c.PPS == 0 {
+		c.PPS = c.WPS
+	}
+	for i := range c.Phases {
+		if c.Phases[i].Name == "" {
+			c.Phases[i].Name = fmt.Sprintf("phase%d", i+1)
+		}
+	}
+	if c.GeneratorWorkers == 0 {
+		c.GeneratorWorkers = runtime.NumCPU()
+		if c.Seed != 0 {
+			c.GeneratorWorkers = 1
+		}
+	}
+	if c.GeneratorQueueSize == 0 {
+		// By default keep about a second worth of batches ready
+		for _, rate := range []int{c.WPS, c.PPS, c.Workload.totalRate(), int(math.Ceil(c.Phases.maxRate()))} {
+			if rate > c.GeneratorQueueSize {
+				c.GeneratorQueueSize = rate
+			}
+		}
+	}
+}
+
+// maxCapacityQueueSize caps the default generator queue of capacity searches, which can go up to rates far higher than
+// what the destination sustains
+const maxCapacityQueueSize = 100
+
+// resolveCapacity fills in the values a capacity search needs. The search needs the latency, polled every
+// CAPACITY_POLL_INTERVAL instead of LATENCY_POLL_INTERVAL, and sets the rate itself, so WPS is only the rate it starts
+// from if not set. The generator queue is sized for the highest rate searched rather
+// than WPS, within maxCapacityQueueSize.
+func (c *Config) resolveCapacity() {
+	c.TrackLatency = true
+	c.Latency.PollInterval = c.Capacity.PollInterval
+	if c.WPS == 0 {
+		c.WPS = int(math.Ceil(c.Capacity.MinRate))
+		if c.GeneratorQueueSize == 0 {
+			c.GeneratorQueueSize = int(math.Min(math.Ceil(c.Capacity.MaxRate), maxCapacityQueueSize))
+		}
+		c.resolve()
+	}
+}
+
+// Validate checks the whole configuration needed for a run, returning every problem found at once
+func (c *Config) Validate() error {
+	return c.validate(c.checkDocuments, c.checkRate, c.checkLatency, c.checkTrace, c.checkQuery, c.checkDestination)
+}
+
+// validate runs the given checks, returning every problem found at once
+func (c *Config) validate(checks ...func(*configErrors)) error {
+	var errs configErrors
+	for _, check := range checks {
+		check(&errs)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (e *configErrors) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*e = append(*e, fmt.Sprintf(format, args...))
+	}
+}
+
+// checkDocuments checks the settings of the documents and patches being generated
+func (c *Config) checkDocuments(errs *configErrors) {
+	errs.check(c.PatchMode == "replace" || c.PatchMode == "add", "Invalid patch mode specified, expecting either 'replace' or 'add'")
+	errs.check(c.Mode == "add" || c.Mode == "patch" || c.Mode == "add_then_patch" || c.Mode == "mixed",
+		"Invalid mode specified, expecting one of 'add', 'patch', 'add_then_patch', 'mixed'")
+	_, known := generator.LookupIDStrategy(c.IDMode)
+	errs.check(known, "Invalid idMode specified, expecting %s", idModes(false, "'"))
+	tracksExisting := generator.TracksExistingIDs(c.IDMode)
+
+	if c.Mode == "patch" {
+		errs.check(tracksExisting, "Patch mode supports ID_MODE %s only", idModes(true, "`"))
+		errs.check(c.NumDocs > 0, "Patch mode requires a positive number of docs to perform patches against. Please specify a number of documents via NUM_DOCS env var.")
+	}
+
+	if c.Mode == "mixed" {
+		errs.check(tracksExisting, "`mixed` MODE supports ID_MODE %s only", idModes(true, "`"))
+		errs.check(c.UpdatePercentage >= 0 && c.UpdatePercentage <= 100,
+			"`mixed` MODE requires a positive number between 0 and 100. Please specify the percentage of documents to be updates via UPDATE_PERCENTAGE env var")
+		errs.check(c.MaxDocs > 0,
+			"`mixed` MODE requires a positive number for MAX_DOCS. This tracks the maximum doc id in the collection and can be used to continue adding document ids sequentially. If no documents exist, specify 1")
+		errs.check(c.DeletePercentage >= 0 && c.UpdatePercentage+c.DeletePercentage <= 100,
+			"DELETE_PERCENTAGE must not be negative, and UPDATE_PERCENTAGE plus DELETE_PERCENTAGE must not be more than 100")
+	} else {
+		errs.check(c.DeletePercentage == 0, "DELETE_PERCENTAGE is only supported in `mixed` MODE")
+	}
+
+	c.checkWorkload(errs)
+	if c.SchemaFile != "" {
+		schema, err := generator.LoadSchema(c.SchemaFile)
+		errs.check(err == nil, "SCHEMA_FILE is invalid: %v", err)
+		if err == nil {
+			c.checkPatchedFields(errs, schema)
+		}
+	}
+	_, err := generator.ParseDocSize(c.DocSize)
+	errs.check(err == nil, "DOC_SIZE is invalid: %v", err)
+	errs.check(c.ReplicaIndex >= 0 && c.ReplicaIndex < c.Replicas, "REPLICA_INDEX must be from 0 to REPLICAS-1")
+
+	errs.check(!(c.HotClusterPercentage > 0 && c.NumClusters < 0), "NUM_CLUSTERS must be specified if HOT_CLUSTER_PERCENTAGE is provided.")
+	errs.check(!(c.HotClusterPercentage == 0 || c.HotClusterPercentage > 100 || c.NumClusters == 0),
+		"NUM_CLUSTERS must be a positive number and HOT_CLUSTER_PERCENTAGE must be greater than 0 and less than or equal to 100 if specified.")
+}
+
+// checkPatchedFields checks that schema defines the fields the patches of the run change
+func (c *Config) checkPatchedFields(errs *configErrors, schema *generator.Schema) {
+	checked := make(map[generator.Operation]bool)
+	for _, s := range c.stages() {
+		for _, op := range s.ops {
+			if !op.Op.IsPatch() || checked[op.Op] {
+				continue
+			}
+			checked[op.Op] = true
+			missing := generator.MissingPatchedFields(schema, op.Op)
+			errs.check(len(missing) == 0, "SCHEMA_FILE must define the fields %s patches, missing %s", op.Op, strings.Join(missing, ", "))
+		}
+	}
+}
+
+// idModes lists the registered id strategies for error messages, only those keeping track of existing ids if
+// tracksExisting is set
+func idModes(tracksExisting bool, quote string) string {
+	var modes []string
+	for _, name := range generator.IDStrategies() {
+		if !tracksExisting || generator.TracksExistingIDs(name) {
+			modes = append(modes, quote+name+quote)
+		}
+	}
+	return strings.Join(modes, " or ")
+}
+
+// checkWorkload checks the operations of a custom workload
+func (c *Config) checkWorkload(errs *configErrors) {
+	if len(c.Workload) == 0 {
+		return
+	}
+	errs.check(c.Mode == "add", "MODE can't be combined with WORKLOAD, the workload replaces it")
+
+	seen := make(map[generator.Operation]bool)
+	shares, rates := 0, 0
+	for _, op := range c.Workload {
+		o := generator.Operation(op.Op)
+		if !o.Valid() {
+			names := make([]string, len(generator.Operations))
+			for i, known := range generator.Operations {
+				names[i] = string(known)
+			}
+			errs.check(false, "Unknown WORKLOAD operation %q, expecting one of %s", op.Op, strings.Join(names, ", "))
+			continue
+		}
+		errs.check(!seen[o], "WORKLOAD operation %s is listed more than once", o)
+		seen[o] = true
+		errs.check(op.Share >= 0 && op.Rate >= 0 && (op.Share > 0) != (op.Rate > 0),
+			"WORKLOAD operation %s must have either a positive share or a positive rate", o)
+		if op.Share > 0 {
+			shares++
+		}
+		if op.Rate > 0 {
+			rates++
+		}
+		errs.check(!o.TargetsExisting() || generator.TracksExistingIDs(c.IDMode),
+			"WORKLOAD operation %s targets existing documents and requires ID_MODE %s", o, idModes(true, "`"))
+	}
+	errs.check(shares == 0 || rates == 0, "WORKLOAD operations must either all have a share or all have a rate")
+}
+
+// checkRate checks the settings controlling how fast batches are generated and sent
+func (c *Config) checkRate(errs *configErrors) {
+	// Workload operations with their own rates and phases don't need WPS
+	errs.check(c.WPS > 0 || c.Workload.totalRate() > 0 || len(c.Phases) > 0, "WPS must be set to a positive number")
+	errs.check(c.BatchSize > 0, "BATCH_SIZE must be set to a positive number")
+	// PPS and the generator queue size default to WPS, so are only worth checking once WPS is valid
+	if c.WPS > 0 {
+		errs.check(c.PPS > 0, "PPS must be a positive number")
+		errs.check(c.GeneratorQueueSize > 0, "GENERATOR_QUEUE_SIZE must be a positive number.")
+	}
+	c.checkPhases(errs)
+	errs.check(c.MaxInFlight > 0, "MAX_IN_FLIGHT must be a positive number.")
+	errs.check(c.GeneratorWorkers > 0, "GENERATOR_WORKERS must be a positive number.")
+	errs.check(c.Seed == 0 || c.GeneratorWorkers == 1,
+		"GENERATOR_WORKERS must be 1 if SEED is set, several workers generate batches in no particular order")
+	errs.check(c.Replicas > 0, "REPLICAS must be a positive number.")
+}
+
+// checkPhases checks the rate schedule
+func (c *Config) checkPhases(errs *configErrors) {
+	if len(c.Phases) == 0 {
+		return
+	}
+	errs.check(c.Workload.totalRate() == 0, "WORKLOAD operations must have shares rather than rates when PHASES is set")
+	seen := make(map[string]bool)
+	for _, p := range c.Phases {
+		errs.check(!seen[p.Name], "PHASES phase %s is listed more than once", p.Name)
+		seen[p.Name] = true
+		errs.check(p.Duration > 0, "PHASES phase %s must have a positive duration", p.Name)
+		errs.check(p.Rate > 0 && p.From >= 0, "PHASES phase %s must have a positive rate", p.Name)
+	}
+}
+
+// checkLatency checks the settings of latency polling
+func (c *Config) checkLatency(errs *configErrors) {
+	l := c.Latency
+	errs.check(l.PollInterval > 0, "LATENCY_POLL_INTERVAL must be a positive duration")
+	errs.check(l.Jitter >= 0 && l.Jitter < 1, "LATENCY_POLL_JITTER must be at least 0 and below 1")
+	errs.check(l.Coordination == "random" || l.Coordination == "staggered" || l.Coordination == "none",
+		"Invalid LATENCY_POLL_COORDINATION specified, expecting 'random', 'staggered' or 'none'")
+	errs.check(!l.Adaptive || l.MinInterval > 0, "LATENCY_POLL_MIN_INTERVAL must be a positive duration")
+	for q, e := range l.Objectives {
+		errs.check(q > 0 && q < 1 && e >= 0 && e < 1, "LATENCY_OBJECTIVES quantile %g and its error %g must be between 0 and 1", q, e)
+	}
+	errs.check(l.MaxAge > 0, "LATENCY_MAX_AGE must be a positive duration")
+	errs.check(l.MaxPlausible > 0, "LATENCY_MAX_PLAUSIBLE must be a positive duration")
+}
+
+// checkTrace checks the settings of visibility tracing
+func (c *Config) checkTrace(errs *configErrors) {
+	t := c.Trace
+	errs.check(t.SampleRate >= 0 && t.SampleRate <= 1, "TRACE_SAMPLE_RATE must be between 0 and 1")
+	if t.SampleRate == 0 {
+		return
+	}
+	errs.check(t.PollInterval > 0 && t.PollInterval < t.Timeout, "TRACE_POLL_INTERVAL must be positive and shorter than TRACE_TIMEOUT")
+}
+
+// checkQuery checks the settings of the query load
+func (c *Config) checkQuery(errs *configErrors) {
+	q := c.Query
+	errs.check(q.QPS >= 0, "QUERY_QPS must not be negative")
+	if q.QPS == 0 {
+		return
+	}
+	errs.check(q.MaxInFlight > 0, "QUERY_MAX_IN_FLIGHT must be a positive number")
+	spec := generator.DocumentSpec{IdMode: c.IDMode, NumClusters: c.NumClusters}
+	// checkDocuments reports a schema file failing to load, only the queries of a loaded one are checked
+	schemaLoaded := true
+	if c.SchemaFile != "" {
+		schema, err := generator.LoadSchema(c.SchemaFile)
+		spec.Schema, schemaLoaded = schema, err == nil
+	}
+	// Sorted so the problems are always reported in the same order
+	names := make([]string, 0, len(q.Mix))
+	for name := range q.Mix {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	total := 0
+	for _, name := range names {
+		share := q.Mix[name]
+		kind := generator.QueryKind(name)
+		known := false
+		for _, k := range generator.QueryKinds {
+			known = known || k == kind
+		}
+		if !known {
+			errs.check(false, "Unknown query %q in QUERY_MIX, expecting %s", name, queryKinds())
+			continue
+		}
+		errs.check(share >= 0, "QUERY_MIX share of %s must not be negative", name)
+		errs.check(kind != generator.PointLookup || spec.SupportsQuery(kind),
+			"QUERY_MIX query %s looks up existing documents and requires ID_MODE %s", name, idModes(true, "`"))
+		errs.check(kind != generator.ClusterFilter || spec.SupportsQuery(kind), "QUERY_MIX query %s requires NUM_CLUSTERS to be set", name)
+		errs.check(kind != generator.CompanyAggregation || !schemaLoaded || spec.SupportsQuery(kind),
+			"QUERY_MIX query %s requires SCHEMA_FILE to define a string Company field", name)
+		errs.check(kind != generator.CitySearch || !schemaLoaded || spec.SupportsQuery(kind),
+			"QUERY_MIX query %s requires SCHEMA_FILE to define Address.City as a string field with oneof values", name)
+		total += share
+	}
+	errs.check(len(q.Mix) == 0 || total > 0, "QUERY_MIX must give a positive share to at least one query")
+	if len(q.Mix) == 0 && schemaLoaded {
+		supported := false
+		for _, kind := range generator.QueryKinds {
+			supported = supported || spec.SupportsQuery(kind)
+		}
+		errs.check(supported, "QUERY_QPS requires the documents to support one of the queries %s", queryKinds())
+	}
+}
+
+// queryMix returns the share of every kind of query of the query load, by default every kind the documents of spec
+// support
+func (c *Config) queryMix(spec generator.DocumentSpec) map[generator.QueryKind]int {
+	mix := make(map[generator.QueryKind]int)
+	for name, share := range c.Query.Mix {
+		mix[generator.QueryKind(name)] = share
+	}
+	if len(mix) > 0 {
+		return mix
+	}
+	for _, kind := range generator.QueryKinds {
+		if spec.SupportsQuery(kind) {
+			mix[kind] = 1
+		}
+	}
+	return mix
+}
+
+// queryKinds lists the kinds of queries for error messages
+func queryKinds() string {
+	kinds := make([]string, len(generator.QueryKinds))
+	for i, kind := range generator.QueryKinds {
+		kinds[i] = fmt.Sprintf("'%s'", kind)
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// checkCapacity checks the settings of the capacity search
+func (c *Config) checkCapacity(errs *configErrors) {
+	s := c.Capacity
+	errs.check(s.Strategy == "step" || s.Strategy == "binary", "Invalid CAPACITY_STRATEGY specified, expecting 'step' or 'binary'")
+	errs.check(s.MinRate > 0 && s.MaxRate >= s.MinRate, "CAPACITY_MIN_RATE must be positive and CAPACITY_MAX_RATE must not be lower")
+	errs.check(s.Step > 0, "CAPACITY_STEP must be a positive number")
+	errs.check(s.Warmup >= 0, "CAPACITY_WARMUP must not be negative")
+	errs.check(s.Window > 0, "CAPACITY_WINDOW must be a positive duration")
+	errs.check(s.LatencySLO > 0, "CAPACITY_P95_LATENCY_SLO must be set to a positive duration")
+	errs.check(s.MaxErrorRate >= 0 && s.MaxErrorRate <= 1, "CAPACITY_MAX_ERROR_RATE must be between 0 and 1")
+	errs.check(s.MinSamples > 0, "CAPACITY_MIN_SAMPLES must be a positive number")
+	errs.check(s.PollInterval > 0 && s.PollInterval < s.Window, "CAPACITY_POLL_INTERVAL must be positive and shorter than CAPACITY_WINDOW")
+	errs.check(len(c.Phases) == 0, "PHASES can't be used with a capacity search, which sets the rate itself")
+}
+
+// search returns the capacity search to run
+func (s CapacityConfig) search(batchSize int) generator.CapacitySearch {
+	return generator.CapacitySearch{
+		Strategy:     s.Strategy,
+		MinRate:      s.MinRate,
+		MaxRate:      s.MaxRate,
+		Step:         s.Step,
+		Warmup:       s.Warmup,
+		Window:       s.Window,
+		LatencySLO:   s.LatencySLO,
+		MaxErrorRate: s.MaxErrorRate,
+		MinSamples:   s.MinSamples,
+		BatchSize:    batchSize,
+	}
+}
+
+// checkDestination checks the options of the selected destination, and that it supports what is asked of it
+func (c *Config) checkDestination(errs *configErrors) {
+	if c.Destination == "" {
+		errs.check(false, "DESTINATION must be set")
+		return
+	}
+	r, ok := generator.Lookup(c.Destination)
+	if !ok {
+		errs.check(false, "Unsupported destination %q. Supported options are %s", c.Destination, strings.Join(generator.Registered(), ", "))
+		return
+	}
+	options := c.Destinations[c.Destination]
+	*errs = append(*errs, r.ValidateOptions(options)...)
+	for _, o := range r.Options {
+		set := options[o.Name] != o.Default
+		if o.Type == generator.BoolOption {
+			set = generator.Options(options).Bool(o.Name)
+		}
+		errs.check(!o.NeedsRetries || !set || c.Retry.MaxAttempts > 1,
+			"%s has no effect unless RETRY_MAX_ATTEMPTS is above 1", o.Env)
+	}
+	for name := range c.Destinations {
+		_, ok := generator.Lookup(name)
+		errs.check(ok, "Unknown config section %q, it is neither a setting nor a destination", name)
+	}
+
+	errs.check(r.Capabilities.Patches || (c.Mode != "patch" && c.Mode != "add_then_patch"),
+		"Destination %s does not support patches, MODE must not be 'patch' or 'add_then_patch'", c.Destination)
+	errs.check(r.Capabilities.Deletes || c.DeletePercentage <= 0, "Destination %s does not support deletes, DELETE_PERCENTAGE must not be set", c.Destination)
+	for _, op := range c.Workload {
+		o := generator.Operation(op.Op)
+		errs.check(r.Capabilities.Patches || !o.IsPatch(), "Destination %s does not support patches, WORKLOAD must not include %s", c.Destination, o)
+		errs.check(r.Capabilities.Deletes || o != generator.Delete, "Destination %s does not support deletes, WORKLOAD must not include delete", c.Destination)
+	}
+	errs.check(r.Capabilities.LatencyQuery || !c.TrackLatency, "Destination %s does not support tracking latency", c.Destination)
+	errs.check(r.Capabilities.PatchLatencyQuery || !c.TrackLatency || !c.patches(),
+		"Destination %s does not support tracking the latency of patches, TRACK_LATENCY must not be set when patching", c.Destination)
+	errs.check(r.Capabilities.VisibilityQuery || c.Trace.SampleRate == 0, "Destination %s does not support tracing documents, TRACE_SAMPLE_RATE must not be set", c.Destination)
+	errs.check(r.Capabilities.Queries || c.Query.QPS == 0, "Destination %s does not support queries, QUERY_QPS must not be set", c.Destination)
+}
+
+// documentSpec returns how documents are generated for generatorIdentifier, loading the schema file if one is set
+func (c *Config) documentSpec(generatorIdentifier string) (generator.DocumentSpec, error) {
+	spec := generator.DocumentSpec{
+		GeneratorIdentifier:  generatorIdentifier,
+		BatchSize:            c.BatchSize,
+		IdMode:               c.IDMode,
+		NumClusters:          c.NumClusters,
+		HotClusterPercentage: c.HotClusterPercentage,
+		Seed:                 generator.ReplicaSeed(int64(c.Seed), c.ReplicaIndex),
+		KeepPatchedFields:    c.patches(),
+	}
+	docSize, err := generator.ParseDocSize(c.DocSize)
+	if err != nil {
+		return spec, err
+	}
+	spec.DocSize = docSize
+	if c.SchemaFile != "" {
+		schema, err := generator.LoadSchema(c.SchemaFile)
+		if err != nil {
+			return spec, err
+		}
+		spec.Schema = schema
+	}
+	return spec, nil
+}
+
+// stage is a workload sent at rate batches per second, until limit documents were sent if positive
+type stage struct {
+	ops   []generator.WorkloadOperation
+	rate  int
+	limit int
+}
+
+// patches returns whether any stage sends patches
+func (c *Config) patches() bool {
+	for _, s := range c.stages() {
+		for _, op := range s.ops {
+			if op.Op.IsPatch() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stages maps the configuration onto the workloads sent one after the other, every MODE being a fixed workload.
+// The configuration must be valid.
+func (c *Config) stages() []stage {
+	only := func(op generator.Operation) []generator.WorkloadOperation {
+		return []generator.WorkloadOperation{{Op: op, Weight: 1}}
+	}
+	patch := generator.PatchReplace
+	if c.PatchMode == "add" {
+		patch = generator.PatchAdd
+	}
+
+	if len(c.Workload) > 0 {
+		s := stage{rate: c.WPS, limit: c.NumDocs}
+		if total := c.Workload.totalRate(); total > 0 {
+			s.rate = total
+		}
+		for _, op := range c.Workload {
+			// Operations have either a share or a rate, their weight is whichever is set
+			weight := float64(op.Share + op.Rate)
+			s.ops = append(s.ops, generator.WorkloadOperation{Op: generator.Operation(op.Op), Weight: weight})
+		}
+		return []stage{s}
+	}
+
+	switch c.Mode {
+	case "patch":
+		return []stage{{ops: only(patch), rate: c.PPS, limit: -1}}
+	case "add_then_patch":
+		return []stage{
+			{ops: only(generator.Insert), rate: c.WPS, limit: c.NumDocs},
+			{ops: only(patch), rate: c.PPS, limit: -1},
+		}
+	case "mixed":
+		var ops []generator.WorkloadOperation
+		for _, op := range []generator.WorkloadOperation{
+			{Op: generator.Insert, Weight: float64(100 - c.UpdatePercentage - c.DeletePercentage)},
+			{Op: generator.Upsert, Weight: float64(c.UpdatePercentage)},
+			{Op: generator.Delete, Weight: float64(c.DeletePercentage)},
+		} {
+			if op.Weight > 0 {
+				ops = append(ops, op)
+			}
+		}
+		return []stage{{ops: ops, rate: c.WPS, limit: c.NumDocs}}
+	default:
+		return []stage{{ops: only(generator.Insert), rate: c.WPS, limit: c.NumDocs}}
+	}
+}
+
+// Redacted returns a copy of the configuration with secrets hidden, for printing
+func (c Config) Redacted() Config {
+	destinations := make(map[string]map[string]string, len(c.Destinations))
+	for name, values := range c.Destinations {
+		r, _ := generator.Lookup(name)
+		redacted := make(map[string]string, len(values))
+		for k, v := range values {
+			redacted[k] = v
+		}
+		for _, opt := range r.Options {
+			if opt.Secret && redacted[opt.Name] != "" {
+				redacted[opt.Name] = "REDACTED"
+			}
+		}
+		destinations[name] = redacted
+	}
+	c.Destinations = destinations
+	return c
+}
+
+// YAML renders the configuration with secrets redacted
+func (c Config) YAML() (string, error) {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return string(b), nil
+}
+
+// applyDestinationEnv overrides the options of every registered destination with their env variables, if set
+func applyDestinationEnv(destinations map[string]map[string]string) {
+	for _, name := range generator.Registered() {
+		r, _ := generator.Lookup(name)
+		for _, opt := range r.Options {
+			if opt.Env == "" {
+				continue
+			}
+			if v, found := os.LookupEnv(opt.Env); found {
+				if destinations[name] == nil {
+					destinations[name] = make(map[string]string)
+				}
+				destinations[name][opt.Name] = v
+			}
+		}
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides the fields of struct v that are tagged with `env` if that environment variable is set
+func applyEnv(v reflect.Value) configErrors {
+	var errs configErrors
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(value)...)
+			continue
+		}
+
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		s, found := os.LookupEnv(env)
+		if !found {
+			continue
+		}
+		if err := setFromString(value, s); err != nil {
+			errs = append(errs, fmt.Sprintf("env %s %v", env, err))
+		}
+	}
+	return errs
+}
+
+func setFromString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := u.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("is invalid: %w", err)
+		}
+		return nil
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("is not a duration!")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("is not integer!")
+		}
+		v.SetInt(int64(i))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("is not a number!")
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("is not bool!")
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("has unsupported type %s", v.Type())
+	}
+	return nil
+}
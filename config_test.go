@@ -0,0 +1,453 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/rockset/rockbench/generator"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+destination: Rockset
+wps: 10
+batch_size: 50
+drain_timeout: 10s
+rockset:
+  api_key: secret
+  api_server: https://api.usw2a1.rockset.com
+  collection: commons.bench
+`), 0o600))
+	t.Setenv("WPS", "20")
+	t.Setenv("ROCKSET_QUERY_TIMEOUT", "5s")
+
+	c, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, "rockset", c.Destination)
+	assert.Equal(t, 20, c.WPS)
+	// PPS and the generator queue default to WPS
+	assert.Equal(t, 20, c.PPS)
+	assert.Equal(t, 20, c.GeneratorQueueSize)
+	assert.Equal(t, 50, c.BatchSize)
+	assert.Equal(t, 10*time.Second, c.DrainTimeout)
+	assert.Equal(t, "5s", c.Destinations["rockset"]["query_timeout"])
+	assert.Equal(t, "1m0s", c.Destinations["rockset"]["write_timeout"])
+	assert.Equal(t, "secret", c.Destinations["rockset"]["api_key"])
+	assert.Equal(t, "add", c.Mode)
+}
+
+func TestLoadConfig_InvalidEnv(t *testing.T) {
+	t.Setenv("WPS", "lots")
+	t.Setenv("DRAIN_TIMEOUT", "30")
+
+	_, err := loadConfig("")
+	assert.EqualError(t, err, "invalid configuration:\n  env WPS is not integer!\n  env DRAIN_TIMEOUT is not a duration!")
+}
+
+func TestConfig_ValidateReportsAllProblems(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "elastic"
+	c.Mode = "patch"
+	c.DocSize = "huge"
+	c.resolve()
+
+	err := c.Validate()
+	assert.NotNil(t, err)
+	errs, ok := err.(configErrors)
+	assert.True(t, ok)
+	assert.Contains(t, errs, "WPS must be set to a positive number")
+	assert.Contains(t, errs, "Patch mode supports ID_MODE `sequential` only")
+	assert.Contains(t, errs, "ELASTIC_AUTH must be set")
+	assert.Contains(t, errs, "ELASTIC_INDEX must be set")
+	assert.Contains(t, errs, `DOC_SIZE is invalid: "huge" is not a positive size`)
+}
+
+func TestConfig_ValidateCapabilities(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "snowflake"
+	c.Mode = "add_then_patch"
+	c.Destinations["snowflake"] = map[string]string{"acount": "typo"}
+	c.resolve()
+
+	errs, ok := c.Validate().(configErrors)
+	assert.True(t, ok)
+	assert.Contains(t, errs, "Destination snowflake does not support patches, MODE must not be 'patch' or 'add_then_patch'")
+	assert.Contains(t, errs, "SNOWFLAKE_ACCOUNT must be set")
+	assert.Contains(t, errs, `unknown option "acount" for destination snowflake`)
+}
+
+func TestConfig_ValidateRetryOnlyOptions(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "elastic"
+	c.WPS = 1
+	c.Destinations["elastic"] = map[string]string{"auth": "test", "url": "http://localhost:9200", "index": "test", "retry_failed_items": "true"}
+	c.resolve()
+	errs, _ := c.validate(c.checkDestination).(configErrors)
+	assert.Contains(t, errs, "ELASTIC_RETRY_FAILED_ITEMS has no effect unless RETRY_MAX_ATTEMPTS is above 1")
+
+	c.Retry.MaxAttempts = 3
+	errs, _ = c.validate(c.checkDestination).(configErrors)
+	assert.NotContains(t, errs, "ELASTIC_RETRY_FAILED_ITEMS has no effect unless RETRY_MAX_ATTEMPTS is above 1")
+}
+
+func TestConfig_YAMLRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.Destinations["rockset"] = map[string]string{"api_key": "secret-key"}
+	c.Destinations["snowflake"] = map[string]string{"user": "bench"}
+
+	out, err := c.YAML()
+	assert.Nil(t, err)
+	assert.NotContains(t, out, "secret-key")
+	assert.Contains(t, out, "api_key: REDACTED")
+	assert.Contains(t, out, "  user: bench")
+	assert.Contains(t, out, "drain_timeout: 30s")
+	// The original is left untouched
+	assert.Equal(t, "secret-key", c.Destinations["rockset"]["api_key"])
+}
+
+func TestConfig_Workload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+destination: "null"
+batch_size: 10
+id_mode: sequential
+workload:
+  - op: insert
+    rate: 7
+  - op: patch_replace
+    rate: 3
+`), 0o600))
+
+	c, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, "insert:7/s,patch_replace:3/s", c.Workload.String())
+	assert.Equal(t, 10, c.GeneratorQueueSize)
+	assert.Equal(t, []stage{{
+		ops:   []generator.WorkloadOperation{{Op: generator.Insert, Weight: 7}, {Op: generator.PatchReplace, Weight: 3}},
+		rate:  10,
+		limit: -1,
+	}}, c.stages())
+
+	t.Setenv("WORKLOAD", "insert:70,upsert:25,delete:5")
+	t.Setenv("WPS", "20")
+	c, err = loadConfig(path)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, Workload{{Op: "insert", Share: 70}, {Op: "upsert", Share: 25}, {Op: "delete", Share: 5}}, c.Workload)
+	assert.Equal(t, 20, c.stages()[0].rate)
+
+	t.Setenv("WORKLOAD", "insert=70")
+	_, err = loadConfig(path)
+	assert.EqualError(t, err, "invalid configuration:\n  env WORKLOAD is invalid: expected op:share or op:rate/s, got \"insert=70\"")
+}
+
+func TestConfig_ValidateWorkload(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "snowflake"
+	c.WPS = 10
+	c.Mode = "mixed"
+	c.Workload = Workload{{Op: "insert", Share: 1}, {Op: "patch_add", Rate: 2}, {Op: "remove", Share: 1}, {Op: "insert", Share: 1}}
+	c.resolve()
+
+	errs, ok := c.Validate().(configErrors)
+	assert.True(t, ok)
+	assert.Contains(t, errs, "MODE can't be combined with WORKLOAD, the workload replaces it")
+	assert.Contains(t, errs, `Unknown WORKLOAD operation "remove", expecting one of insert, upsert, patch_replace, patch_add, delete`)
+	assert.Contains(t, errs, "WORKLOAD operation insert is listed more than once")
+	assert.Contains(t, errs, "WORKLOAD operations must either all have a share or all have a rate")
+	assert.Contains(t, errs, "WORKLOAD operation patch_add targets existing documents and requires ID_MODE `sequential`")
+	assert.Contains(t, errs, "Destination snowflake does not support patches, WORKLOAD must not include patch_add")
+}
+
+func TestConfig_StagesOfModes(t *testing.T) {
+	c := defaultConfig()
+	c.WPS = 10
+	c.PPS = 5
+	c.NumDocs = 1000
+	c.Mode = "add_then_patch"
+	c.PatchMode = "add"
+	assert.Equal(t, []stage{
+		{ops: []generator.WorkloadOperation{{Op: generator.Insert, Weight: 1}}, rate: 10, limit: 1000},
+		{ops: []generator.WorkloadOperation{{Op: generator.PatchAdd, Weight: 1}}, rate: 5, limit: -1},
+	}, c.stages())
+
+	c.Mode = "mixed"
+	c.UpdatePercentage = 30
+	c.DeletePercentage = 0
+	assert.Equal(t, []stage{
+		{ops: []generator.WorkloadOperation{{Op: generator.Insert, Weight: 70}, {Op: generator.Upsert, Weight: 30}}, rate: 10, limit: 1000},
+	}, c.stages())
+}
+
+func TestConfig_Phases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+destination: "null"
+batch_size: 10
+phases:
+  - name: ramp
+    duration: 5m
+    from: 1
+    rate: 50
+  - duration: 30m
+    rate: 50
+`), 0o600))
+
+	c, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Validate())
+	assert.Equal(t, Phases{
+		{Name: "ramp", Duration: 5 * time.Minute, From: 1, Rate: 50},
+		{Name: "phase2", Duration: 30 * time.Minute, Rate: 50},
+	}, c.Phases)
+	assert.Equal(t, 50, c.GeneratorQueueSize)
+
+	t.Setenv("PHASES", "ramp:5m:1-50,steady:30m:50,spike:60s:200,steady:10m:0")
+	c, err = loadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, generator.Phase{Name: "spike", Duration: time.Minute, Rate: 200}, c.Phases.schedule()[2])
+	errs, ok := c.Validate().(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{"PHASES phase steady is listed more than once", "PHASES phase steady must have a positive rate"}, errs)
+
+	t.Setenv("PHASES", "ramp:5m")
+	_, err = loadConfig(path)
+	assert.EqualError(t, err, "invalid configuration:\n  env PHASES is invalid: expected name:duration:rate or name:duration:from-rate, got \"ramp:5m\"")
+}
+
+func TestConfig_ValidateCapacity(t *testing.T) {
+	c := defaultConfig()
+	t.Setenv("CAPACITY_MAX_ERROR_RATE", "0.05")
+	assert.Nil(t, applyEnv(reflect.ValueOf(&c).Elem()))
+	assert.Equal(t, 0.05, c.Capacity.MaxErrorRate)
+
+	c.Capacity.Strategy = "random"
+	c.Capacity.MaxRate = 0.5
+	c.Capacity.PollInterval = c.Capacity.Window
+	errs, ok := c.validate(c.checkCapacity).(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{
+		"Invalid CAPACITY_STRATEGY specified, expecting 'step' or 'binary'",
+		"CAPACITY_MIN_RATE must be positive and CAPACITY_MAX_RATE must not be lower",
+		"CAPACITY_P95_LATENCY_SLO must be set to a positive duration",
+		"CAPACITY_POLL_INTERVAL must be positive and shorter than CAPACITY_WINDOW",
+	}, errs)
+}
+
+func TestConfig_ValidateLatency(t *testing.T) {
+	c := defaultConfig()
+	t.Setenv("LATENCY_OBJECTIVES", "0.5:0.05, 0.999:0.0001")
+	assert.Nil(t, applyEnv(reflect.ValueOf(&c).Elem()))
+	assert.Equal(t, Objectives{0.5: 0.05, 0.999: 0.0001}, c.Latency.Objectives)
+	assert.Nil(t, c.validate(c.checkLatency))
+
+	c.Latency.Coordination = "leader"
+	c.Latency.Jitter = 1
+	c.Latency.Objectives[1] = 0
+	c.Latency.MaxPlausible = 0
+	errs, ok := c.validate(c.checkLatency).(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{
+		"LATENCY_POLL_JITTER must be at least 0 and below 1",
+		"Invalid LATENCY_POLL_COORDINATION specified, expecting 'random', 'staggered' or 'none'",
+		"LATENCY_OBJECTIVES quantile 1 and its error 0 must be between 0 and 1",
+		"LATENCY_MAX_PLAUSIBLE must be a positive duration",
+	}, errs)
+
+	t.Setenv("LATENCY_OBJECTIVES", "0.5")
+	assert.Equal(t, configErrors{`env LATENCY_OBJECTIVES is invalid: expected quantile:error, got "0.5"`}, applyEnv(reflect.ValueOf(&c).Elem()))
+}
+
+func TestLoadConfig_LatencyObjectives(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("latency:\n  objectives:\n    0.99: 0.001\n  max_age: 1m\n"), 0o644))
+
+	c, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, Objectives{0.99: 0.001}, c.Latency.Objectives)
+	assert.Equal(t, time.Minute, c.Latency.MaxAge)
+	assert.Equal(t, 25*time.Second, c.Latency.PollInterval)
+}
+
+func TestConfig_ValidateTrace(t *testing.T) {
+	c := defaultConfig()
+	t.Setenv("TRACE_SAMPLE_RATE", "0.01")
+	assert.Nil(t, applyEnv(reflect.ValueOf(&c).Elem()))
+	assert.Equal(t, 0.01, c.Trace.SampleRate)
+	assert.Nil(t, c.validate(c.checkTrace))
+
+	c.Destination = "snowflake"
+	c.Trace.PollInterval = c.Trace.Timeout
+	errs, ok := c.validate(c.checkTrace, c.checkDestination).(configErrors)
+	assert.True(t, ok)
+	assert.Contains(t, errs, "TRACE_POLL_INTERVAL must be positive and shorter than TRACE_TIMEOUT")
+	assert.Contains(t, errs, "Destination snowflake does not support tracing documents, TRACE_SAMPLE_RATE must not be set")
+
+	c.Trace.SampleRate = 1.5
+	errs, _ = c.validate(c.checkTrace).(configErrors)
+	assert.Contains(t, errs, "TRACE_SAMPLE_RATE must be between 0 and 1")
+}
+
+func TestConfig_ValidateQuery(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "null"
+	c.IDMode = "sequential"
+	t.Setenv("QUERY_QPS", "20")
+	t.Setenv("QUERY_MIX", "point_lookup:3, company_aggregation:1")
+	assert.Nil(t, applyEnv(reflect.ValueOf(&c).Elem()))
+	assert.Equal(t, QueryMix{"point_lookup": 3, "company_aggregation": 1}, c.Query.Mix)
+	assert.Nil(t, c.validate(c.checkQuery, c.checkDestination))
+	spec := generator.DocumentSpec{IdMode: c.IDMode, NumClusters: c.NumClusters}
+	assert.Equal(t, map[generator.QueryKind]int{generator.PointLookup: 3, generator.CompanyAggregation: 1}, c.queryMix(spec))
+
+	// Every query the documents support by default
+	c.Query.Mix = nil
+	assert.Equal(t, map[generator.QueryKind]int{generator.PointLookup: 1, generator.CompanyAggregation: 1, generator.CitySearch: 1}, c.queryMix(spec))
+	spec.NumClusters = 10
+	assert.Len(t, c.queryMix(spec), 4)
+
+	c.Destination = "snowflake"
+	c.IDMode = "uuid"
+	c.NumClusters = -1
+	c.Query.MaxInFlight = 0
+	c.Query.Mix = QueryMix{"point_lookup": 1, "cluster_filter": 0, "full_scan": 1}
+	errs, ok := c.validate(c.checkQuery).(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{
+		"QUERY_MAX_IN_FLIGHT must be a positive number",
+		"QUERY_MIX query cluster_filter requires NUM_CLUSTERS to be set",
+		"Unknown query \"full_scan\" in QUERY_MIX, expecting 'point_lookup', 'cluster_filter', 'company_aggregation', 'city_search'",
+		"QUERY_MIX query point_lookup looks up existing documents and requires ID_MODE `sequential`",
+	}, errs)
+	errs, _ = c.validate(c.checkDestination).(configErrors)
+	assert.Contains(t, errs, "Destination snowflake does not support queries, QUERY_QPS must not be set")
+
+	t.Setenv("QUERY_MIX", "point_lookup")
+	assert.Equal(t, configErrors{`env QUERY_MIX is invalid: expected query:share, got "point_lookup"`}, applyEnv(reflect.ValueOf(&c).Elem()))
+}
+
+func TestConfig_ValidateQuerySchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.yaml")
+	schema := "fields:\n  - name: Company\n    type: int\n  - name: Address\n    type: object\n    fields:\n      - name: City\n        type: string\n"
+	assert.Nil(t, os.WriteFile(path, []byte(schema), 0o644))
+	c := defaultConfig()
+	c.SchemaFile = path
+	c.Query.QPS = 20
+	c.Query.Mix = QueryMix{"company_aggregation": 1, "city_search": 1}
+	errs, ok := c.validate(c.checkQuery).(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{
+		"QUERY_MIX query city_search requires SCHEMA_FILE to define Address.City as a string field with oneof values",
+		"QUERY_MIX query company_aggregation requires SCHEMA_FILE to define a string Company field",
+	}, errs)
+
+	// None of the queries by default
+	c.Query.Mix = nil
+	errs, _ = c.validate(c.checkQuery).(configErrors)
+	assert.Equal(t, configErrors{
+		"QUERY_QPS requires the documents to support one of the queries 'point_lookup', 'cluster_filter', 'company_aggregation', 'city_search'",
+	}, errs)
+}
+
+func TestConfig_ValidatePatchedFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("fields:\n  - name: Email\n    type: string\n"), 0o644))
+	c := defaultConfig()
+	c.SchemaFile = path
+	assert.Nil(t, c.validate(c.checkDocuments))
+
+	c.Mode = "add_then_patch"
+	c.PatchMode = "add"
+	errs, ok := c.validate(c.checkDocuments).(configErrors)
+	assert.True(t, ok)
+	assert.Equal(t, configErrors{"SCHEMA_FILE must define the fields patch_add patches, missing Tags"}, errs)
+}
+
+func TestConfig_PatchLatency(t *testing.T) {
+	c := defaultConfig()
+	c.Mode = "add_then_patch"
+	assert.True(t, c.patches())
+
+	// The e2e latency is only measured while inserting, the patch latency while patching
+	var queries latencyQueries
+	stages := c.stages()
+	queries.follow(stages[0].ops)
+	assert.True(t, queries.writes.Load())
+	assert.False(t, queries.patches.Load())
+	queries.follow(stages[1].ops)
+	assert.False(t, queries.writes.Load())
+	assert.True(t, queries.patches.Load())
+
+	c.Mode = "mixed"
+	assert.False(t, c.patches())
+}
+
+func TestConfig_Seed(t *testing.T) {
+	c := defaultConfig()
+	c.Destination = "null"
+	c.WPS = 10
+	c.BatchSize = 10
+	c.Seed = 42
+	c.Replicas = 2
+	c.ReplicaIndex = 1
+	c.resolve()
+	assert.Nil(t, c.Validate())
+	// Seeded runs generate with a single worker by default
+	assert.Equal(t, 1, c.GeneratorWorkers)
+	spec, err := c.documentSpec("test")
+	assert.Nil(t, err)
+	assert.Equal(t, generator.ReplicaSeed(42, 1), spec.Seed)
+
+	c.GeneratorWorkers = 4
+	c.ReplicaIndex = 2
+	err = c.Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.(configErrors), "GENERATOR_WORKERS must be 1 if SEED is set, several workers generate batches in no particular order")
+	assert.Contains(t, err.(configErrors), "REPLICA_INDEX must be from 0 to REPLICAS-1")
+}
+
+func TestConfig_DocSizeKeepsPatchedFields(t *testing.T) {
+	c := defaultConfig()
+	c.DocSize = "1KB"
+	spec, err := c.documentSpec("test")
+	assert.Nil(t, err)
+	assert.False(t, spec.KeepPatchedFields)
+
+	c.Mode = "add_then_patch"
+	spec, err = c.documentSpec("test")
+	assert.Nil(t, err)
+	assert.True(t, spec.KeepPatchedFields)
+}
+
+func TestConfig_ResolveCapacity(t *testing.T) {
+	c := defaultConfig()
+	c.resolve()
+	c.resolveCapacity()
+	assert.True(t, c.TrackLatency)
+	assert.Equal(t, c.Capacity.PollInterval, c.Latency.PollInterval)
+	// The search starts from CAPACITY_MIN_RATE, and the queue isn't sized for CAPACITY_MAX_RATE batches
+	assert.Equal(t, 1, c.WPS)
+	assert.Equal(t, 1, c.PPS)
+	assert.Equal(t, maxCapacityQueueSize, c.GeneratorQueueSize)
+
+	c = defaultConfig()
+	c.Capacity.MaxRate = 20
+	c.resolve()
+	c.resolveCapacity()
+	assert.Equal(t, 20, c.GeneratorQueueSize)
+
+	c = defaultConfig()
+	c.WPS = 50
+	c.resolve()
+	c.resolveCapacity()
+	assert.Equal(t, 50, c.WPS)
+	assert.Equal(t, 50, c.GeneratorQueueSize)
+}
@@ -0,0 +1,177 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CapacitySearch searches for the highest rate, in batches per second, at which the destination keeps the p95 e2e
+// latency under LatencySLO and the error rate under MaxErrorRate. Every rate tried is held for Warmup, so the
+// latency settles, and then measured over Window.
+type CapacitySearch struct {
+	// Strategy is either "step", raising the rate by Step until a rate fails, or "binary", bisecting the range
+	// between MinRate and MaxRate until it's narrower than Step
+	Strategy     string
+	MinRate      float64
+	MaxRate      float64
+	Step         float64
+	Warmup       time.Duration
+	Window       time.Duration
+	LatencySLO   time.Duration
+	MaxErrorRate float64
+	// MinSamples is the number of e2e latency samples a window needs for its p95 to be trusted
+	MinSamples int
+	// BatchSize converts the documents completed to batches, to check the rate was actually achieved
+	BatchSize int
+}
+
+// CapacityTrial is the outcome of holding a rate for a window
+type CapacityTrial struct {
+	Rate         float64       `json:"rate"`
+	AchievedRate float64       `json:"achieved_rate"`
+	ErrorRate    float64       `json:"error_rate"`
+	E2ELatency   LatencyReport `json:"e2e_latency"`
+	Passed       bool          `json:"passed"`
+	Reason       string        `json:"reason,omitempty"`
+}
+
+// CapacityReport is the result of a capacity search. MaxSustainableRate is 0 if even the minimum rate failed.
+type CapacityReport struct {
+	Strategy                    string          `json:"strategy"`
+	LatencySLO                  float64         `json:"p95_latency_slo_ms"`
+	MaxErrorRate                float64         `json:"max_error_rate"`
+	MaxSustainableRate          float64         `json:"max_sustainable_rate"`
+	MaxSustainableDocsPerSecond float64         `json:"max_sustainable_docs_per_second"`
+	Trials                      []CapacityTrial `json:"trials"`
+}
+
+// achievedRatio is how much of the target rate must be achieved for a trial to pass. When the destination can't keep
+// up, batches wait for an in-flight slot rather than piling up, so latency alone doesn't show it.
+const achievedRatio = 0.9
+
+// Run searches for the capacity, setting the rate of rc, until the search is over or done is closed. The result is
+// also recorded in the run report.
+func (c CapacitySearch) Run(rc *RateController, done <-chan struct{}) CapacityReport {
+	r := c.search(func(rate float64) (CapacityTrial, bool) {
+		rc.SetRate(rate)
+		if !sleep(c.Warmup, done) {
+			return CapacityTrial{}, false
+		}
+		start := time.Now()
+		completed, errored := summary.totals()
+		if !sleep(c.Window, done) {
+			return CapacityTrial{}, false
+		}
+		end := time.Now()
+		completedAfter, erroredAfter := summary.totals()
+
+		t := c.evaluate(rate, summary.latenciesBetween(start, end), completedAfter-completed, erroredAfter-errored)
+		log.Printf("capacity trial at %.1f batches per second: achieved %.1f, p95 %.1fms over %d samples, error rate %.3f, passed: %t %s",
+			rate, t.AchievedRate, t.E2ELatency.P95, t.E2ELatency.Samples, t.ErrorRate, t.Passed, t.Reason)
+		return t, true
+	})
+	recordCapacity(r)
+	return r
+}
+
+// search runs trials according to the strategy, trial returning false if the search was stopped
+func (c CapacitySearch) search(trial func(rate float64) (CapacityTrial, bool)) CapacityReport {
+	r := CapacityReport{
+		Strategy:     c.Strategy,
+		LatencySLO:   float64(c.LatencySLO.Microseconds()) / 1000,
+		MaxErrorRate: c.MaxErrorRate,
+	}
+	try := func(rate float64) (bool, bool) {
+		t, ok := trial(rate)
+		if !ok {
+			return false, false
+		}
+		r.Trials = append(r.Trials, t)
+		if t.Passed && rate > r.MaxSustainableRate {
+			r.MaxSustainableRate = rate
+			r.MaxSustainableDocsPerSecond = rate * float64(c.BatchSize)
+			capacityMaxSustainableRate.Set(rate)
+		}
+		return t.Passed, true
+	}
+
+	if c.Strategy == "step" {
+		for rate := c.MinRate; rate <= c.MaxRate; rate += c.Step {
+			if passed, ok := try(rate); !passed || !ok {
+				break
+			}
+		}
+		return r
+	}
+
+	// The bounds are tried first, so the search is short if the answer is at either end
+	lo, hi := c.MinRate, c.MaxRate
+	if passed, ok := try(lo); !passed || !ok {
+		return r
+	}
+	if passed, ok := try(hi); passed || !ok {
+		return r
+	}
+	for hi-lo > c.Step {
+		mid := (lo + hi) / 2
+		passed, ok := try(mid)
+		if !ok {
+			break
+		}
+		if passed {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return r
+}
+
+// evaluate decides whether a window at rate passed, given the latencies measured during it and the number of
+// documents completed and errored
+func (c CapacitySearch) evaluate(rate float64, latencies []float64, completed float64, errored float64) CapacityTrial {
+	t := CapacityTrial{
+		Rate:       rate,
+		E2ELatency: summarizeLatencies(latencies),
+	}
+	if total := completed + errored; total > 0 {
+		t.ErrorRate = errored / total
+		t.AchievedRate = total / c.Window.Seconds() / float64(c.BatchSize)
+	}
+
+	slo := float64(c.LatencySLO.Microseconds()) / 1000
+	switch {
+	case t.E2ELatency.Samples < c.MinSamples:
+		t.Reason = fmt.Sprintf("only %d latency samples, %d needed", t.E2ELatency.Samples, c.MinSamples)
+	case t.AchievedRate < achievedRatio*rate:
+		t.Reason = fmt.Sprintf("achieved only %.1f batches per second", t.AchievedRate)
+	case t.ErrorRate > c.MaxErrorRate:
+		t.Reason = fmt.Sprintf("error rate %.3f over %.3f", t.ErrorRate, c.MaxErrorRate)
+	case t.E2ELatency.P95 > slo:
+		t.Reason = fmt.Sprintf("p95 latency %.1fms over %.1fms", t.E2ELatency.P95, slo)
+	default:
+		t.Passed = true
+	}
+	return t
+}
+
+// sleep waits for d, returning false if done is closed first
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+var capacityMaxSustainableRate = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "capacity_max_sustainable_rate",
+	Help: "The highest rate in batches per second that passed a capacity search trial so far",
+})
@@ -0,0 +1,70 @@
+package generator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacitySearch_Strategies(t *testing.T) {
+	// The destination keeps up with up to 37 batches per second
+	tried := 0
+	trial := func(rate float64) (CapacityTrial, bool) {
+		tried++
+		return CapacityTrial{Rate: rate, Passed: rate <= 37}, true
+	}
+
+	c := CapacitySearch{Strategy: "step", MinRate: 10, MaxRate: 100, Step: 10, BatchSize: 5}
+	r := c.search(trial)
+	assert.Equal(t, 30.0, r.MaxSustainableRate)
+	assert.Equal(t, 150.0, r.MaxSustainableDocsPerSecond)
+	assert.Len(t, r.Trials, 4)
+
+	tried = 0
+	c = CapacitySearch{Strategy: "binary", MinRate: 1, MaxRate: 100, Step: 1}
+	r = c.search(trial)
+	assert.InDelta(t, 37, r.MaxSustainableRate, 1)
+	assert.LessOrEqual(t, r.MaxSustainableRate, 37.0)
+	assert.LessOrEqual(t, tried, 10)
+
+	// Stopping ends the search with what was found so far
+	stopped := func(rate float64) (CapacityTrial, bool) {
+		if rate > 1 {
+			return CapacityTrial{}, false
+		}
+		return trial(rate)
+	}
+	r = c.search(stopped)
+	assert.Equal(t, 1.0, r.MaxSustainableRate)
+	assert.Len(t, r.Trials, 1)
+}
+
+func TestCapacitySearch_Evaluate(t *testing.T) {
+	c := CapacitySearch{
+		Window:       10 * time.Second,
+		LatencySLO:   2 * time.Second,
+		MaxErrorRate: 0.01,
+		MinSamples:   3,
+		BatchSize:    10,
+	}
+	fast := []float64{500e3, 800e3, 1000e3}
+
+	tr := c.evaluate(5, fast, 500, 0)
+	assert.True(t, tr.Passed, tr.Reason)
+	assert.Equal(t, 5.0, tr.AchievedRate)
+	assert.Equal(t, 1000.0, tr.E2ELatency.P95)
+
+	tr = c.evaluate(5, fast[:2], 500, 0)
+	assert.Equal(t, "only 2 latency samples, 3 needed", tr.Reason)
+
+	tr = c.evaluate(5, fast, 300, 0)
+	assert.Equal(t, "achieved only 3.0 batches per second", tr.Reason)
+
+	tr = c.evaluate(5, fast, 480, 20)
+	assert.Equal(t, "error rate 0.040 over 0.010", tr.Reason)
+
+	tr = c.evaluate(5, append(fast, 2500e3), 500, 0)
+	assert.Equal(t, "p95 latency 2500.0ms over 2000.0ms", tr.Reason)
+	assert.False(t, tr.Passed)
+}
@@ -1,6 +1,7 @@
 package generator
 
 import (
+	"context"
 	"io"
 	"log"
 	"time"
@@ -9,19 +10,71 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-// Destination is where to send the generated documents to
+// Destination is where to send the generated documents to.
+//
+// Every method takes a context so a hung destination can't block the writers or the latency poller. Implementations
+// should bound each operation by their Timeouts as well as by the deadline of the context passed in.
 type Destination interface {
 	// SendDocument sends a batch of documents to the destination.
-	SendDocument(docs []any) error
+	// The request should be abandoned when ctx is cancelled.
+	SendDocument(ctx context.Context, docs []any) error
 
 	// Send a batch of patches to the destination.
-	SendPatch(docs []any) error
+	// The request should be abandoned when ctx is cancelled.
+	SendPatch(ctx context.Context, docs []any) error
 
 	// GetLatestTimestamp get latest timestamp seen in the destination.
-	GetLatestTimestamp() (time.Time, error)
+	GetLatestTimestamp(ctx context.Context) (time.Time, error)
 
 	// ConfigureDestination is used to make any configuration changes to the destination that might be required for sending documents.
-	ConfigureDestination() error
+	ConfigureDestination(ctx context.Context) error
+}
+
+// TeardownDestination is implemented by destinations whose ConfigureDestination creates resources for a run,
+// to remove them again once the run is over.
+type TeardownDestination interface {
+	// TeardownDestination removes what ConfigureDestination created for the generator identifier of the destination.
+	TeardownDestination(ctx context.Context) error
+}
+
+// DeleteDestination is implemented by destinations that support deleting documents
+type DeleteDestination interface {
+	// SendDelete deletes a batch of documents by id.
+	// The request should be abandoned when ctx is cancelled.
+	SendDelete(ctx context.Context, ids []string) error
+}
+
+// PatchLatencyDestination is implemented by destinations which can measure the latency of patches. GetLatestTimestamp
+// follows _event_time, which patches don't change, so patches are measured on the _ts field they set instead.
+type PatchLatencyDestination interface {
+	// GetLatestPatchTimestamp returns the latest _ts of the documents of the generator which were patched, those whose
+	// _ts is past their _event_time.
+	GetLatestPatchTimestamp(ctx context.Context) (time.Time, error)
+}
+
+// Timeouts bounds how long a single operation against a destination may take. Zero means no timeout.
+type Timeouts struct {
+	// Write bounds SendDocument, SendPatch and SendDelete
+	Write time.Duration
+	// Query bounds GetLatestTimestamp and the other queries, e.g. those of the query load
+	Query time.Duration
+	// Configure bounds ConfigureDestination and TeardownDestination
+	Configure time.Duration
+}
+
+// DefaultTimeouts are the timeouts used unless configured otherwise
+var DefaultTimeouts = Timeouts{
+	Write:     60 * time.Second,
+	Query:     30 * time.Second,
+	Configure: 5 * time.Minute,
+}
+
+// WithTimeout returns a context which is cancelled after timeout, or just when ctx is if timeout is zero
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func deferredErrorCloser(c io.Closer) {
@@ -30,29 +83,98 @@ func deferredErrorCloser(c io.Closer) {
 	}
 }
 
+// Operations used to label per-request metrics and RecordWrites
+const (
+	RequestInsert = "insert"
+	RequestPatch  = "patch"
+	RequestDelete = "delete"
+)
+
+// RecordRequest records the duration and body size of a single request made to a destination. The bodies of successful
+// requests count as bytes sent. Requests sent with RetryPolicy.Do are recorded already.
+func RecordRequest(destination string, operation string, bodySize int, start time.Time, success bool) {
+	outcome := "success"
+	if !success {
+		outcome = "error"
+	}
+	requestDurationSeconds.WithLabelValues(destination, operation, outcome).Observe(time.Since(start).Seconds())
+	requestBodyBytes.WithLabelValues(destination, operation).Observe(float64(bodySize))
+	if success && bodySize > 0 {
+		batchSizeBytes.WithLabelValues(operation).Observe(float64(bodySize))
+		summary.add(&summary.bytesSent, float64(bodySize))
+	}
+}
+
 func RecordE2ELatency(latency float64) {
 	e2eLatencies.Set(latency)
 	e2eLatenciesSummary.Observe(latency)
+	summary.addE2ELatency(latency)
 }
 
-func recordWritesCompleted(count float64) {
-	writesCompleted.Add(count)
+// ConfigureLatencySummaries replaces the summaries of e2e and patch latency with ones computing objectives, quantiles
+// with their allowed error, over the last maxAge. The default objectives are kept if none are given, and
+// prometheus.DefMaxAge is used if maxAge is 0. It must be called before any latency is recorded.
+func ConfigureLatencySummaries(objectives map[float64]float64, maxAge time.Duration) {
+	if len(objectives) == 0 {
+		objectives = objectiveMap
+	}
+	prometheus.Unregister(e2eLatenciesSummary)
+	prometheus.Unregister(patchLatenciesSummary)
+	e2eLatenciesSummary = promauto.NewSummary(e2eLatenciesSummaryOpts(objectives, maxAge))
+	patchLatenciesSummary = promauto.NewSummary(patchLatenciesSummaryOpts(objectives, maxAge))
 }
 
-func recordWritesErrored(count float64) {
-	writesErrored.Add(count)
+func e2eLatenciesSummaryOpts(objectives map[float64]float64, maxAge time.Duration) prometheus.SummaryOpts {
+	return prometheus.SummaryOpts{
+		Name:       "e2e_latencies_metric",
+		Help:       "e2e latency in micro-seconds between client and the Destination",
+		Objectives: objectives,
+		MaxAge:     maxAge,
+	}
+}
+
+func patchLatenciesSummaryOpts(objectives map[float64]float64, maxAge time.Duration) prometheus.SummaryOpts {
+	return prometheus.SummaryOpts{
+		Name:       "patch_latencies_metric",
+		Help:       "Patch latency in micro-seconds between client and the Destination",
+		Objectives: objectives,
+		MaxAge:     maxAge,
+	}
 }
 
-func recordPatchesCompleted(count float64) {
-	patchesCompleted.Add(count)
+// RecordPatchLatency records a patch latency sample in microseconds, apart from the e2e latency of documents written
+func RecordPatchLatency(latency float64) {
+	patchLatencies.Set(latency)
+	patchLatenciesSummary.Observe(latency)
+	summary.addPatchLatency(latency)
 }
 
-func recordPatchesErrored(count float64) {
-	patchesErrored.Add(count)
+// RecordWrites records the number of documents written, patched or deleted by a batch depending on operation, and the
+// number which failed
+func RecordWrites(operation string, completed int, errored int) {
+	switch operation {
+	case RequestPatch:
+		recordCount(patchesCompleted, &summary.patchesCompleted, completed)
+		recordCount(patchesErrored, &summary.patchesErrored, errored)
+	case RequestDelete:
+		recordCount(deletesCompleted, &summary.deletesCompleted, completed)
+		recordCount(deletesErrored, &summary.deletesErrored, errored)
+	default:
+		recordCount(writesCompleted, &summary.writesCompleted, completed)
+		recordCount(writesErrored, &summary.writesErrored, errored)
+	}
+}
+
+func recordCount(counter prometheus.Counter, total *float64, count int) {
+	if count > 0 {
+		counter.Add(float64(count))
+		summary.add(total, float64(count))
+	}
 }
 
 var (
 	// More info can found here: https://godoc.org/github.com/prometheus/client_golang/prometheus#NewSummary
+	// The objectives of the latency summaries unless ConfigureLatencySummaries is called
 	objectiveMap = map[float64]float64{0.5: 0.05, 0.95: 0.005, 0.99: 0.001}
 
 	writesCompleted = promauto.NewCounter(prometheus.CounterOpts{
@@ -75,17 +197,48 @@ var (
 		Help: "The total number of patches errored",
 	})
 
+	deletesCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "deletes_completed",
+		Help: "The total number of deletes completed",
+	})
+
+	deletesErrored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "deletes_errored",
+		Help: "The total number of deletes errored",
+	})
+
 	e2eLatencies = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "e2e_latencies",
 		Help: "The e2e latency between client and the Destination",
 	})
-	e2eLatenciesSummary = promauto.NewSummary(prometheus.SummaryOpts{
-		Name:       "e2e_latencies_metric",
-		Help:       "e2e latency in micro-seconds between client and the Destination",
-		Objectives: objectiveMap,
+	e2eLatenciesSummary = promauto.NewSummary(e2eLatenciesSummaryOpts(objectiveMap, 0))
+
+	patchLatencies = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patch_latencies",
+		Help: "The latency between patching a document and the patch being visible in the Destination",
 	})
+	patchLatenciesSummary = promauto.NewSummary(patchLatenciesSummaryOpts(objectiveMap, 0))
+
 	numEventIngested = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "num_events_ingested",
 		Help: "Number of events ingested to the Destination",
 	})
+
+	requestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_duration_seconds",
+		Help:    "Time in seconds taken by a single write request to the Destination",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"destination", "operation", "outcome"})
+
+	requestBodyBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_body_bytes",
+		Help:    "Size in bytes of the body of a single write request to the Destination",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"destination", "operation"})
+
+	batchSizeBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "batch_size_bytes",
+		Help:    "Size in bytes of the body of write requests to the Destination which succeeded, by operation",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"operation"})
 )
@@ -0,0 +1,80 @@
+package generator
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordRequest_Metrics(t *testing.T) {
+	statusCodes := []int{http.StatusOK, http.StatusBadRequest}
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		w.WriteHeader(statusCodes[len(bodies)-1])
+	}))
+	defer server.Close()
+
+	body := []byte(`{"data":[{"_id":"1"}]}`)
+	send := func() {
+		resp, err := DefaultRetryPolicy.Do(context.Background(), server.Client(), "metrics_test", RequestInsert, len(body),
+			func() (*http.Request, error) {
+				return http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+			})
+		assert.Nil(t, err)
+		deferredErrorCloser(resp.Body)
+	}
+
+	durations := testutil.CollectAndCount(requestDurationSeconds, "request_duration_seconds")
+	sizes := testutil.CollectAndCount(requestBodyBytes, "request_body_bytes")
+	send()
+	send()
+	assert.Len(t, bodies, 2)
+
+	// A duration series per outcome, and a single body size series
+	assert.Equal(t, durations+2, testutil.CollectAndCount(requestDurationSeconds, "request_duration_seconds"))
+	assert.Equal(t, sizes+1, testutil.CollectAndCount(requestBodyBytes, "request_body_bytes"))
+	assert.Equal(t, uint64(1), histogram(t, requestDurationSeconds.WithLabelValues("metrics_test", RequestInsert, "success")).GetSampleCount())
+	assert.Equal(t, uint64(1), histogram(t, requestDurationSeconds.WithLabelValues("metrics_test", RequestInsert, "error")).GetSampleCount())
+	sizeHistogram := histogram(t, requestBodyBytes.WithLabelValues("metrics_test", RequestInsert))
+	assert.Equal(t, uint64(2), sizeHistogram.GetSampleCount())
+	assert.Equal(t, float64(2*len(body)), sizeHistogram.GetSampleSum())
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsFailed.WithLabelValues("metrics_test", RequestInsert)))
+}
+
+func TestRecordRequest_Duration(t *testing.T) {
+	RecordRequest("metrics_test", RequestPatch, 10, time.Now().Add(-time.Second), true)
+	h := histogram(t, requestDurationSeconds.WithLabelValues("metrics_test", RequestPatch, "success"))
+	assert.Equal(t, uint64(1), h.GetSampleCount())
+	assert.GreaterOrEqual(t, h.GetSampleSum(), 1.0)
+}
+
+// histogram returns the current state of a histogram
+func histogram(t *testing.T, o prometheus.Observer) *dto.Histogram {
+	var m dto.Metric
+	assert.Nil(t, o.(prometheus.Metric).Write(&m))
+	return m.GetHistogram()
+}
+
+func TestConfigureLatencySummaries(t *testing.T) {
+	ConfigureLatencySummaries(map[float64]float64{0.9: 0.01}, time.Minute)
+	defer ConfigureLatencySummaries(nil, 0)
+	RecordE2ELatency(1000)
+
+	var m dto.Metric
+	assert.Nil(t, e2eLatenciesSummary.(prometheus.Metric).Write(&m))
+	quantiles := m.GetSummary().GetQuantile()
+	assert.Len(t, quantiles, 1)
+	assert.Equal(t, 0.9, quantiles[0].GetQuantile())
+	assert.Equal(t, 1000.0, quantiles[0].GetValue())
+}
@@ -0,0 +1,158 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DocSize is the target size of serialized documents in bytes. It's normally distributed around Mean if StdDev is
+// set, otherwise uniform from Min to Max. The zero DocSize leaves documents as the schema generates them.
+type DocSize struct {
+	Min    int
+	Max    int
+	Mean   int
+	StdDev int
+}
+
+// ParseDocSize parses a size like `512`, `2KB`, a range like `200-50KB`, or a normal distribution like
+// `normal:4KB:1KB` given as mean and standard deviation
+func ParseDocSize(s string) (DocSize, error) {
+	if s == "" {
+		return DocSize{}, nil
+	}
+	if strings.HasPrefix(s, "normal:") {
+		parts := strings.Split(strings.TrimPrefix(s, "normal:"), ":")
+		if len(parts) != 2 {
+			return DocSize{}, fmt.Errorf("expected normal:mean:stddev, got %q", s)
+		}
+		mean, err := parseBytes(parts[0])
+		if err != nil {
+			return DocSize{}, err
+		}
+		stddev, err := parseBytes(parts[1])
+		if err != nil {
+			return DocSize{}, err
+		}
+		return DocSize{Mean: mean, StdDev: stddev}, nil
+	}
+
+	min, max, isRange := strings.Cut(s, "-")
+	lo, err := parseBytes(min)
+	if err != nil {
+		return DocSize{}, err
+	}
+	hi := lo
+	if isRange {
+		if hi, err = parseBytes(max); err != nil {
+			return DocSize{}, err
+		}
+		if hi < lo {
+			return DocSize{}, fmt.Errorf("size range %q ends before it starts", s)
+		}
+	}
+	return DocSize{Min: lo, Max: hi}, nil
+}
+
+// parseBytes parses a positive number of bytes with an optional B, KB or MB suffix, in powers of 1024
+func parseBytes(s string) (int, error) {
+	multiplier := 1
+	number := strings.ToUpper(strings.TrimSpace(s))
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{{"KB", 1024}, {"MB", 1024 * 1024}, {"B", 1}} {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(number, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", s)
+	}
+	return n * multiplier, nil
+}
+
+// IsSet returns whether documents are fitted to a target size
+func (d DocSize) IsSet() bool {
+	return d.Max > 0 || d.Mean > 0
+}
+
+func (d DocSize) String() string {
+	switch {
+	case d.StdDev > 0:
+		return fmt.Sprintf("normal:%d:%d", d.Mean, d.StdDev)
+	case d.Min != d.Max:
+		return fmt.Sprintf("%d-%d", d.Min, d.Max)
+	default:
+		return strconv.Itoa(d.Max)
+	}
+}
+
+// pick returns the target size of a document
+func (d DocSize) pick(r *rand.Rand) int {
+	if d.StdDev > 0 {
+		size := int(math.Round(r.NormFloat64()*float64(d.StdDev))) + d.Mean
+		if size < 1 {
+			size = 1
+		}
+		return size
+	}
+	return between(r, d.Min, d.Max)
+}
+
+// reservedFields are never trimmed, they're needed to write documents and to track latency
+var reservedFields = map[string]bool{
+	"_id":                  true,
+	"_event_time":          true,
+	"_ts":                  true,
+	"generator_identifier": true,
+	"cluster1":             true,
+}
+
+// paddingField holds the random letters added to documents smaller than their target size
+const paddingField = "_padding"
+
+// paddingOverhead is the size of an empty padding field
+var paddingOverhead = len(`,"` + paddingField + `":""`)
+
+// fitToSize pads or trims doc so it serializes to target bytes, returning the size it ends up with. Top level fields
+// are trimmed starting from the last in key order, so the same document is always trimmed the same way, and padding
+// makes up for what's left. The fields patches change are kept too if keepPatched is set, or the patches would fail.
+// Documents end up as close to target as possible if the kept fields alone are too large, or the gap is too small for
+// a padding field.
+func fitToSize(doc map[string]interface{}, target int, r *rand.Rand, keepPatched bool) int {
+	size := jsonSize(doc)
+	if size > target {
+		keys := make([]string, 0, len(doc))
+		for k := range doc {
+			if !reservedFields[k] && !(keepPatched && patchedFields[k]) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for i := len(keys) - 1; i >= 0 && size > target; i-- {
+			delete(doc, keys[i])
+			size = jsonSize(doc)
+		}
+	}
+	if target-size >= paddingOverhead {
+		doc[paddingField] = randomLetters(r, target-size-paddingOverhead)
+		size = target
+	}
+	return size
+}
+
+// jsonSize returns the size of v serialized as JSON
+func jsonSize(v interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
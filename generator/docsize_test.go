@@ -0,0 +1,91 @@
+package generator
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDocSize(t *testing.T) {
+	for s, expected := range map[string]DocSize{
+		"":               {},
+		"512":            {Min: 512, Max: 512},
+		"2KB":            {Min: 2048, Max: 2048},
+		"200-50kb":       {Min: 200, Max: 51200},
+		"1MB":            {Min: 1 << 20, Max: 1 << 20},
+		"normal:4KB:100": {Mean: 4096, StdDev: 100},
+	} {
+		size, err := ParseDocSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, size, s)
+	}
+	for _, s := range []string{"big", "0", "-5", "50KB-200", "normal:4KB", "2GB"} {
+		_, err := ParseDocSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestGenerateDoc_DocSize(t *testing.T) {
+	spec := DocumentSpec{IdMode: "uuid", GeneratorIdentifier: "test", NumClusters: 10, HotClusterPercentage: 10}
+	for _, target := range []int{300, 2000, 50 * 1024} {
+		spec.DocSize = DocSize{Min: target, Max: target}
+		doc, err := NewGenerator(spec).GenerateDoc()
+		assert.NoError(t, err)
+		b, err := json.Marshal(doc)
+		assert.NoError(t, err)
+		assert.Len(t, b, target)
+		// Latency tracking still works on trimmed documents
+		assert.Contains(t, doc, "_event_time")
+		assert.Contains(t, doc, "cluster1")
+	}
+
+	spec.DocSize = DocSize{Min: 1000, Max: 5000}
+	for i := 0; i < 20; i++ {
+		doc, err := NewGenerator(spec).GenerateDoc()
+		assert.NoError(t, err)
+		size := jsonSize(doc)
+		assert.GreaterOrEqual(t, size, 1000)
+		assert.LessOrEqual(t, size, 5000)
+	}
+}
+
+func TestFitToSize_Deterministic(t *testing.T) {
+	fit := func() map[string]interface{} {
+		doc := map[string]interface{}{"_id": "1", "a": "one", "b": 2, "c": randomLetters(rand.New(rand.NewSource(1)), 100)}
+		size := fitToSize(doc, 90, rand.New(rand.NewSource(1)), false)
+		assert.Equal(t, 90, size)
+		return doc
+	}
+	first := fit()
+	assert.Equal(t, first, fit())
+	// Fields are trimmed from the end of key order, reserved ones are kept
+	assert.Equal(t, []string{"_id", "_padding", "a", "b"}, sortedKeys(first))
+}
+
+func TestFitToSize_KeepPatchedFields(t *testing.T) {
+	spec := DocumentSpec{IdMode: "uuid", DocSize: DocSize{Min: 300, Max: 300}}
+	doc, err := NewGenerator(spec).GenerateDoc()
+	assert.NoError(t, err)
+	assert.NotContains(t, doc, "Tags")
+
+	spec.KeepPatchedFields = true
+	doc, err = NewGenerator(spec).GenerateDoc()
+	assert.NoError(t, err)
+	for field := range patchedFields {
+		assert.Contains(t, doc, field)
+	}
+	// Unpatched fields are still trimmed
+	assert.NotContains(t, doc, "IsActive")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,9 +1,10 @@
 package generator
 
 import (
-	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-faker/faker/v4"
@@ -11,130 +12,207 @@ import (
 )
 
 type DocumentSpec struct {
-	Destination          string
 	GeneratorIdentifier  string
 	BatchSize            int
-	Mode                 string
 	IdMode               string
-	UpdatePercentage     int
 	NumClusters          int
 	HotClusterPercentage int
+	// Schema describes the documents, DefaultSchema if nil
+	Schema *Schema
+	// DocSize is the serialized size documents are padded or trimmed to, if set
+	DocSize DocSize
+	// KeepPatchedFields keeps the fields patches change when documents are trimmed to DocSize, so the run can patch them
+	KeepPatchedFields bool
+	// Seed makes the generated data reproducible, a random seed is used if 0
+	Seed int64
 }
 
-type DocStruct struct {
-	Guid       string
-	IsActive   bool
-	Balance    float64 `faker:"amount"`
-	Picture    string
-	Age        int `faker:"oneof: 15, 27, 61"`
-	Name       NameStruct
-	Company    string `faker:"oneof: facebook, google, rockset, tesla, uber, lyft"`
-	Email      string `faker:"email"`
-	Phone      string `faker:"phone_number"`
-	Address    AddressStruct
-	About      string   `faker:"sentence"`
-	Registered string   `faker:"timestamp"`
-	Tags       []string `faker:"slice_len=9,len=14"`
-	Friends    FriendStruct
-	Greeting   string `faker:"paragraph"`
+// Generator generates the documents, ids and patches of a run according to its spec. Its id allocator keeps track of
+// the ids written and deleted so far, so upserts, patches and deletes only target live documents. It's safe for use
+// by several pipeline workers, and several generators can be used at once.
+//
+// Generators with the same seed generate the same documents, ids and patches, as long as they are asked for the same
+// batches in the same order, e.g. by a single pipeline worker. Timestamps and the generator identifier still differ.
+type Generator struct {
+	spec   DocumentSpec
+	schema *Schema
+	// seed is the seed of the generator, derived from spec.Seed or random
+	seed int64
+
+	// docRand is the randomness of document contents
+	docRand *rand.Rand
+
+	// ids is created from the strategy named by spec.IdMode, nil if there is none
+	ids IDAllocator
+
+	// mu guards everything below, the randomness of patches included so they come out in a fixed order
+	mu sync.Mutex
+	// patchRand is the randomness of patch contents
+	patchRand      *rand.Rand
+	replacePatches patchFields
+	addPatches     patchFields
 }
 
-type NameStruct struct {
-	First string `faker:"first_name"`
-	Last  string `faker:"last_name"`
+// Streams of randomness derived from the seed of a generator
+const (
+	docStream = iota + 1
+	idStream
+	patchStream
+)
+
+// NewGenerator creates a generator of documents according to spec
+func NewGenerator(spec DocumentSpec) *Generator {
+	seed := spec.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	schema := spec.Schema
+	if schema == nil {
+		schema = DefaultSchema
+	}
+	g := &Generator{
+		spec:           spec,
+		schema:         schema,
+		seed:           seed,
+		docRand:        rand.New(faker.NewSafeSource(rand.NewSource(deriveSeed(seed, docStream)))),
+		patchRand:      rand.New(rand.NewSource(deriveSeed(seed, patchStream))),
+		replacePatches: patchFields{options: replaceOptions},
+		addPatches:     patchFields{options: addOptions},
+	}
+	if strategy, ok := LookupIDStrategy(spec.IdMode); ok {
+		g.ids = strategy.New(deriveSeed(seed, idStream))
+	}
+	return g
 }
 
-type AddressStruct struct {
-	Street      string `faker:"oneof: 1st, 2nd, 3rd, 4th, 5th, 6th, 7th, 8th, 9th, 10th"`
-	City        string `faker:"oneof: SF, San Mateo, San Jose, Mountain View, Menlo Park, Palo Alto"`
-	ZipCode     int16
-	Coordinates CoordinatesStruct
+// deriveSeed derives the seed of a stream of randomness from the seed of a generator, mixing the bits with splitmix64
+// so the streams, and generators with nearby seeds, don't overlap
+func deriveSeed(seed int64, stream int64) int64 {
+	return int64(mix64(uint64(seed) + uint64(stream)*splitMixGamma))
 }
 
-type CoordinatesStruct struct {
-	Latitude  float32 `faker:"lat"`
-	Longitude float32 `faker:"long"`
+// splitMixGamma is the increment of splitmix64, the golden ratio in 64 bits
+const splitMixGamma = 0x9e3779b97f4a7c15
+
+// mix64 is the output function of splitmix64
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
 }
 
-type FriendStruct struct {
-	Friend1 FriendDetailsStruct
-	Friend2 FriendDetailsStruct
-	Friend3 FriendDetailsStruct
-	Friend4 FriendDetailsStruct
-	Friend5 FriendDetailsStruct
+// ReplicaSeed returns the seed of replica replicaIndex of a run with the given seed, so every replica generates
+// different but reproducible data
+func ReplicaSeed(seed int64, replicaIndex int) int64 {
+	if seed == 0 {
+		return 0
+	}
+	return deriveSeed(seed, int64(replicaIndex))
 }
 
-type FriendDetailsStruct struct {
-	Name NameStruct
-	Age  int `faker:"oneof: 15, 27, 61"`
+// BatchSize returns the number of documents of a batch
+func (g *Generator) BatchSize() int {
+	return g.spec.BatchSize
 }
 
-var doc_id = 0
-var max_doc_id = 0
+// GenerateDoc generates a new document, with an id from the strategy named by spec.IdMode
+func (g *Generator) GenerateDoc() (interface{}, error) {
+	if g.ids == nil {
+		return nil, fmt.Errorf("unknown ID_MODE %q", g.spec.IdMode)
+	}
+	return g.generateDoc(g.ids.NewID())
+}
 
-func GenerateDoc(spec DocumentSpec) (interface{}, error) {
-	docStruct := DocStruct{}
-	err := faker.FakeData(&docStruct)
+// GenerateUpsert generates a document replacing a random live document, or a new one if there are none
+func (g *Generator) GenerateUpsert() (interface{}, error) {
+	ids, err := g.existingIDs()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate fake document: %w", err)
+		return nil, err
 	}
+	id, found := ids.RandomExisting()
+	if !found {
+		id = ids.NewID()
+	}
+	return g.generateDoc(id)
+}
 
-	doc := make(map[string]interface{})
-	j, _ := json.Marshal(docStruct)
-
-	if err = json.Unmarshal(j, &doc); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal document: %w", err)
+// GenerateDeletes returns up to count distinct live ids and tombstones them, fewer if there aren't enough left
+func (g *Generator) GenerateDeletes(count int) ([]string, error) {
+	ids, err := g.existingIDs()
+	if err != nil {
+		return nil, err
 	}
+	return ids.DeleteExisting(count), nil
+}
 
-	if spec.Mode == "mixed" {
-		// Randomly choose a number to decide whether to generate a doc with an existing doc id
-		if rand.Intn(100) < spec.UpdatePercentage {
-			// Choose random id from one already existing doc id
-			doc["_id"] = formatDocId(rand.Intn(getMaxDoc()))
-		} else {
-			doc["_id"] = formatDocId(getMaxDoc())
-			SetMaxDoc(getMaxDoc()+1)
-		}
-		doc_id = doc_id + 1
-		// All other modes
-	} else if spec.IdMode == "uuid" {
-		doc["_id"] = guuid.New().String()
-	} else if spec.IdMode == "sequential" {
-		doc["_id"] = formatDocId(doc_id)
-		doc_id = doc_id + 1
-	} else {
-		panic(fmt.Sprintf("Unsupported generateDoc case: %s", spec.IdMode))
+// existingIDs returns the id allocator if it keeps track of existing ids
+func (g *Generator) existingIDs() (ExistingIDAllocator, error) {
+	if g.ids == nil {
+		return nil, fmt.Errorf("unknown ID_MODE %q", g.spec.IdMode)
+	}
+	ids, ok := g.ids.(ExistingIDAllocator)
+	if !ok {
+		return nil, fmt.Errorf("ID_MODE %s doesn't keep track of existing ids", g.spec.IdMode)
 	}
+	return ids, nil
+}
+
+func (g *Generator) generateDoc(id string) (interface{}, error) {
+	doc := g.schema.Generate(g.docRand, g.seed)
+	doc["_id"] = id
 
-	if spec.NumClusters > 0 {
-		doc["cluster1"] = getClusterKey(spec.NumClusters, spec.HotClusterPercentage)
+	if g.spec.NumClusters > 0 {
+		doc["cluster1"] = g.clusterKey(g.docRand)
 	}
 
 	doc["_event_time"] = CurrentTimeMicros()
 	// Set _ts as _event_time is not mutable
 	doc["_ts"] = CurrentTimeMicros()
-	doc["generator_identifier"] = spec.GeneratorIdentifier
+	doc["generator_identifier"] = g.spec.GeneratorIdentifier
 
+	if g.spec.DocSize.IsSet() {
+		fitToSize(doc, g.spec.DocSize.pick(g.docRand), g.docRand, g.spec.KeepPatchedFields)
+	}
 	return doc, nil
 }
 
-func getClusterKey(numClusters int, hotClusterPercentage int) string {
- 	if hotClusterPercentage > 0 && rand.Intn(100) < hotClusterPercentage {
+// clusterKey picks the cluster key of a document using random
+func (g *Generator) clusterKey(random *rand.Rand) string {
+	if g.spec.HotClusterPercentage > 0 && random.Intn(100) < g.spec.HotClusterPercentage {
 		return "0@gmail.com"
 	} else {
-		return fmt.Sprintf("%d@gmail.com", rand.Intn(numClusters))
+		return fmt.Sprintf("%d@gmail.com", random.Intn(g.spec.NumClusters))
+	}
+}
+
+// SetMaxDoc sets the number of sequential ids already written, new documents get ids from maxDocId on. It has no
+// effect if the id allocator doesn't keep track of existing ids.
+func (g *Generator) SetMaxDoc(maxDocId int) {
+	if ids, ok := g.ids.(ExistingIDAllocator); ok {
+		ids.SetExisting(maxDocId)
 	}
 }
 
-func getMaxDoc() int {
-	// doc_ids are left padded monotonic integers,
-	//this returns the highest exclusive doc id for purposes of issuing patches.
-	return max_doc_id
+// acknowledge reports that the writes of the documents with docIDs finished, successfully if written is set, so
+// upserts, patches and deletes can target them. It has no effect if the id allocator doesn't keep track of existing ids.
+func (g *Generator) acknowledge(docIDs []string, written bool) {
+	if ids, ok := g.ids.(ExistingIDAllocator); ok {
+		ids.Acknowledge(docIDs, written)
+	}
 }
 
-func SetMaxDoc(maxDocId int) {
-	// doc_id = maxDocId
-	max_doc_id = maxDocId
+// docIDs returns the ids of docs. They are collected before the documents are sent, as destinations may remove the id
+// from the document they send, e.g. Elastic passes it in the bulk action instead.
+func docIDs(docs []interface{}) []string {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if mdoc, ok := doc.(map[string]interface{}); ok {
+			if id, ok := mdoc["_id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
 }
 
 func CurrentTimeMicros() int64 {
@@ -142,11 +220,33 @@ func CurrentTimeMicros() int64 {
 	return int64(time.Nanosecond) * t.UnixNano() / int64(time.Microsecond)
 }
 
-func GenerateDocs(spec DocumentSpec) ([]interface{}, error) {
-	var docs = make([]interface{}, spec.BatchSize, spec.BatchSize)
+// StampDocs sets the latency tracking timestamps of generated documents to now.
+// Documents can sit in the BatchPipeline queue for a while, so this is done right before they are sent.
+// The replica remembers when it sent them, see MeasureLatency.
+func StampDocs(docs []interface{}) {
+	now := stampNow()
+	for _, doc := range docs {
+		if mdoc, ok := doc.(map[string]interface{}); ok {
+			mdoc["_event_time"] = now
+			mdoc["_ts"] = now
+		}
+	}
+}
+
+func (g *Generator) GenerateDocs() ([]interface{}, error) {
+	return g.generateBatch(g.GenerateDoc)
+}
+
+// GenerateUpserts generates a batch of documents replacing existing ones
+func (g *Generator) GenerateUpserts() ([]interface{}, error) {
+	return g.generateBatch(g.GenerateUpsert)
+}
+
+func (g *Generator) generateBatch(generate func() (interface{}, error)) ([]interface{}, error) {
+	var docs = make([]interface{}, g.spec.BatchSize, g.spec.BatchSize)
 
-	for i := 0; i < spec.BatchSize; i++ {
-		doc, err := GenerateDoc(spec)
+	for i := 0; i < g.spec.BatchSize; i++ {
+		doc, err := generate()
 		if err != nil {
 			return nil, err
 		}
@@ -166,312 +266,21 @@ func RandomString(n int) string {
 	return string(s)
 }
 
-func GeneratePatches(num_patch int, destination string, c chan map[string]interface{}) ([]interface{}, error) {
-	patches := make([]interface{}, 0)
-
-	ids_to_patch := genUniqueInRange(getMaxDoc(), num_patch)
-	for _, id := range ids_to_patch {
-		if (destination == "elastic") {
-			patch := generateElasticPatch(id, <-c)
-			patches = append(patches, patch)
-
-		} else if (destination == "rockset") {
-			patch := generateRocksetPatch(id, <-c)
-			patches = append(patches, patch)
-		}
-	}
-	return patches, nil
-}
-
-func RandomFieldAdd(destination string, c chan map[string]interface{}) {
-	// Adding fields or array members
-	for {
-		if (destination == "rockset") {
-			options := []map[string]interface{}{{
-				"op":    "add",
-				"path":  "/" + faker.UUIDDigit(),
-				"value": faker.Email(),
-				},
-				{
-				"op":    "add",
-				"path":  "/Tags/-",
-				"value": faker.UUIDHyphenated(), // Append to tags array
-				},
-			}
-			shuffleAndFillChannel(options, c)
-		} else if (destination == "elastic") {
-			options := []map[string]interface{}{{
-					"doc": map[string]interface{}{
-						faker.UUIDDigit(): faker.Email(),
-						"_ts": CurrentTimeMicros(),
-					},
-				},
-				{
-					"script": map[string]interface{}{
-						"source": "ctx._source.Tags.add(params.tag)",
-						"params": map[string]interface{}{
-							"tag": faker.UUIDHyphenated(),
-							"_ts": CurrentTimeMicros(),
-						},
-					},
-				},
-			}
-			shuffleAndFillChannel(options, c)
-		}
-	}
-}
-
-func RandomFieldReplace(destination string, c chan map[string]interface{}) {
-	// Purely replacement of fields
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for {
-		if (destination == "rockset") {
-			options := []map[string]interface{}{{
-				"op":    "replace",
-				"path":  "/Email",
-				"value": faker.Email(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/About",
-				"value": faker.Sentence(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Company",
-				"value": faker.Word() + "-" + faker.Word(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Name/First",
-				"value": faker.FirstName(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Name/Last",
-				"value": faker.LastName(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Age",
-				"value": random.Intn(100),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Balance",
-				"value": random.Float64(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Registered",
-				"value": faker.Timestamp(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Phone",
-				"value": faker.Phonenumber(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Picture",
-				"value": faker.UUIDDigit(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Guid",
-				"value": faker.UUIDHyphenated(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Greeting",
-				"value": faker.Paragraph(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Address/ZipCode",
-				"value": random.Intn(100000),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Address/Coordinates/Longitude",
-				"value": faker.Longitude(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Address/Coordinates/Latitude",
-				"value": faker.Latitude(),
-			},
-			{
-				"op":    "replace",
-				"path":  "/Address/City",
-				"value": faker.Word(),
-			}}
-			shuffleAndFillChannel(options, c)
-		} else if (destination == "elastic") {
-			options := []map[string]interface{}{{
-				"doc": map[string]interface{}{
-					"Email": faker.Email(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"About": faker.Sentence(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Company": faker.Word() + "-" + faker.Word(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Name.First = params.updated_nested_first_name; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_first_name" : faker.FirstName(),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Name.Last = params.updated_nested_last_name; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_last_name": faker.LastName(),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Age": random.Intn(100),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Balance": random.Float64(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Registered": faker.Timestamp(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Phone": faker.Phonenumber(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Picture": faker.UUIDDigit(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Guid": faker.UUIDHyphenated(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"doc": map[string]interface{}{
-					"Greeting": faker.Paragraph(),
-					"_ts": CurrentTimeMicros(),
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Address.ZipCode = params.updated_nested_zcode; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_zcode": random.Intn(100000),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Address.Coordinates.Longitude = params.updated_nested_coord_long; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_coord_long": faker.Longitude(),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Address.Coordinates.Latitude = params.updated_nested_coord_lat; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_coord_lat": faker.Latitude(),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			},
-			{
-				"script": map[string]interface{}{
-					"source": "ctx._source.Address.City = params.updated_nested_city; ctx._source._ts = params.ts",
-					"params" : map[string]interface{}{
-						"updated_nested_city": faker.Word(),
-						"ts": CurrentTimeMicros(),
-					},
-				},
-			}}
-			shuffleAndFillChannel(options, c)
-		}
-	}
-}
-
-func genUniqueInRange(limit int, count int) []int {
-	random := rand.New(rand.NewSource(CurrentTimeMicros()))
-	ids_to_patch := make(map[int]struct{}, count)
-	for len(ids_to_patch) < count {
-		id := random.Intn(limit)
-		_, exists := ids_to_patch[id]
-		if !exists {
-			ids_to_patch[id] = struct{}{}
+// randomUUID returns a version 4 uuid taken from r rather than crypto/rand, so it's reproducible
+func randomUUID(r *rand.Rand) string {
+	var u guuid.UUID
+	for i := 0; i < len(u); i += 8 {
+		n := r.Uint64()
+		for j := 0; j < 8; j++ {
+			u[i+j] = byte(n >> (8 * j))
 		}
 	}
-
-	ids := make([]int, count)
-	i := 0
-	for k := range ids_to_patch {
-		ids[i] = k
-		i++
-	}
-	return ids
-}
-
-func generateRocksetPatch(id int, field_patch map[string]interface{}) map[string]interface{} {
-	patch := make(map[string]interface{})
-	patch["_id"] = formatDocId(id)
-	add_op := []map[string]interface{}{field_patch, {"op": "add", "path": "/_ts", "value": CurrentTimeMicros()}}
-	patch["patch"] = add_op
-	return patch
-}
-
-func generateElasticPatch(id int, field_patch map[string]interface{}) map[string]interface{} {
-	patch := make(map[string]interface{})
-	patch["_id"] = formatDocId(id)
-	patch["patch"] = field_patch
-	return patch
-}
-
-func shuffleAndFillChannel(options []map[string]interface{}, c chan map[string]interface{}) {
-	rand.Shuffle(len(options), func(i, j int) {
-		options[i], options[j] = options[j], options[i]
-	})
-	for _, op := range options {
-		c <- op
-
-	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return u.String()
 }
 
-func formatDocId(id int) string {
-	return fmt.Sprintf("%024d", id)
+// randomDigits returns a uuid without its dashes, like faker's UUIDDigit
+func randomDigits(r *rand.Rand) string {
+	return strings.ReplaceAll(randomUUID(r), "-", "")
 }
@@ -2,6 +2,7 @@ package generator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // Elastic contains all configurations needed to send documents to Elastic
@@ -18,12 +22,32 @@ type Elastic struct {
 	IndexName           string
 	Client              *http.Client
 	GeneratorIdentifier string
+	Timeouts            Timeouts
+	Retry               RetryPolicy
+	// RetryFailedItems resends bulk items rejected with a retryable status, up to Retry.MaxAttempts times
+	RetryFailedItems bool
 }
 
-func (e *Elastic) SendPatch(docs []interface{}) error {
+// sendBulk sends an ndjson body to the bulk API, retrying according to the retry policy
+func (e *Elastic) sendBulk(ctx context.Context, operation string, body []byte) (*http.Response, error) {
+	bulkURL := e.URL + "/_bulk"
+	return e.Retry.Do(ctx, e.Client, "elastic", operation, len(body), func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, bulkURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", e.Auth)
+		req.Header.Add("Content-Type", "application/x-ndjson")
+		return req, nil
+	})
+}
+
+func (e *Elastic) SendPatch(ctx context.Context, docs []interface{}) error {
+	ctx, cancel := WithTimeout(ctx, e.Timeouts.Write)
+	defer cancel()
 	numDocs := len(docs)
 	numEventIngested.Add(float64(numDocs))
-	var builder bytes.Buffer
+	items := make([][]byte, 0, numDocs)
 	for i := 0; i < len(docs); i++ {
 		mdoc, errb := docs[i].(map[string]interface{})
 		if !errb {
@@ -46,43 +70,21 @@ func (e *Elastic) SendPatch(docs []interface{}) error {
 			return fmt.Errorf("failed to marshal request: %w", err)
 		}
 
-		builder.Write(metaLine)
-		builder.WriteByte('\n')
-		builder.Write(line)
-		builder.WriteByte('\n')
-	}
-
-	body := builder.Bytes()
-	bulkURL := e.URL + "/_bulk"
-	elasticHTTPRequest, _ := http.NewRequest(http.MethodPost, bulkURL, bytes.NewBuffer(body))
-	elasticHTTPRequest.Header.Add("Authorization", e.Auth)
-	elasticHTTPRequest.Header.Add("Content-Type", "application/x-ndjson")
-
-	resp, err := e.Client.Do(elasticHTTPRequest)
-	if err != nil {
-		recordPatchesErrored(float64(numDocs))
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer deferredErrorCloser(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		recordPatchesErrored(float64(numDocs))
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read response body: %w", err)
-		}
-		return fmt.Errorf("error code: %d, body: %s", resp.StatusCode, string(bodyBytes))
+		items = append(items, bulkItemLines(metaLine, line))
 	}
-	recordPatchesCompleted(float64(numDocs))
-	return nil
 
+	succeeded, err := e.sendBulkItems(ctx, RequestPatch, items)
+	RecordWrites(RequestPatch, succeeded, numDocs-succeeded)
+	return err
 }
 
 // SendDocument sends a batch of documents to Elastic
-func (e *Elastic) SendDocument(docs []any) error {
+func (e *Elastic) SendDocument(ctx context.Context, docs []any) error {
+	ctx, cancel := WithTimeout(ctx, e.Timeouts.Write)
+	defer cancel()
 	numDocs := len(docs)
 	numEventIngested.Add(float64(numDocs))
-	var builder bytes.Buffer
+	items := make([][]byte, 0, numDocs)
 	for i := 0; i < len(docs); i++ {
 		mdoc, errb := docs[i].(map[string]interface{})
 		if !errb {
@@ -92,10 +94,15 @@ func (e *Elastic) SendDocument(docs []any) error {
 		index := make(map[string]interface{})
 		index["_index"] = e.IndexName
 		index["_id"] = mdoc["_id"]
-		// "_id" is not allowed in the doc
-		delete(mdoc, "_id")
+		// "_id" is not allowed in the doc. It's left out of a shallow copy, the caller still needs the document as it is.
+		source := make(map[string]interface{}, len(mdoc))
+		for k, v := range mdoc {
+			if k != "_id" {
+				source[k] = v
+			}
+		}
 
-		line, err := json.Marshal(mdoc)
+		line, err := json.Marshal(source)
 		if err != nil {
 			return fmt.Errorf("failed to marshal document: %w", err)
 		}
@@ -107,64 +114,147 @@ func (e *Elastic) SendDocument(docs []any) error {
 			return fmt.Errorf("failed to marshal request: %w", err)
 		}
 
-		builder.Write(metaLine)
-		builder.WriteByte('\n')
-		builder.Write(line)
-		builder.WriteByte('\n')
+		items = append(items, bulkItemLines(metaLine, line))
 	}
 
-	body := builder.Bytes()
-	bulkURL := e.URL + "/_bulk"
-	elasticHTTPRequest, _ := http.NewRequest(http.MethodPost, bulkURL, bytes.NewBuffer(body))
-	elasticHTTPRequest.Header.Add("Authorization", e.Auth)
-	elasticHTTPRequest.Header.Add("Content-Type", "application/x-ndjson")
+	succeeded, err := e.sendBulkItems(ctx, RequestInsert, items)
+	RecordWrites(RequestInsert, succeeded, numDocs-succeeded)
+	return err
+}
 
-	resp, err := e.Client.Do(elasticHTTPRequest)
-	if err != nil {
-		recordWritesErrored(float64(numDocs))
-		return fmt.Errorf("failed to send request: %w", err)
+// bulkResponse is the part of a bulk API response needed to tell which items failed.
+// Each item is keyed by its action, e.g. {"index": {"_id": "1", "status": 201}}
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkItemResponse `json:"items"`
+}
+
+type bulkItemResponse struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkItemLines joins the action and source lines of a single bulk item
+func bulkItemLines(metaLine []byte, line []byte) []byte {
+	item := make([]byte, 0, len(metaLine)+len(line)+2)
+	item = append(item, metaLine...)
+	item = append(item, '\n')
+	item = append(item, line...)
+	return append(item, '\n')
+}
+
+// SendDelete deletes a batch of documents from Elastic
+func (e *Elastic) SendDelete(ctx context.Context, ids []string) error {
+	ctx, cancel := WithTimeout(ctx, e.Timeouts.Write)
+	defer cancel()
+	numDocs := len(ids)
+	items := make([][]byte, 0, numDocs)
+	for _, id := range ids {
+		metaLine, err := json.Marshal(map[string]interface{}{
+			"delete": map[string]interface{}{"_index": e.IndexName, "_id": id},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		// Deletes have no document line
+		items = append(items, append(metaLine, '\n'))
 	}
-	defer deferredErrorCloser(resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		recordWritesErrored(float64(numDocs))
+	succeeded, err := e.sendBulkItems(ctx, RequestDelete, items)
+	RecordWrites(RequestDelete, succeeded, numDocs-succeeded)
+	return err
+}
+
+// sendBulkItems sends items to the bulk API and returns how many of them succeeded.
+//
+// The bulk API responds with 200 even if some items failed, so the response is checked item by item and failures are
+// counted by error type. If RetryFailedItems is set, items rejected with a retryable status, e.g. 429 when the write
+// queue is full, are sent again according to the retry policy.
+func (e *Elastic) sendBulkItems(ctx context.Context, operation string, items [][]byte) (int, error) {
+	succeeded := 0
+	for attempt := 1; ; attempt++ {
+		resp, err := e.sendBulk(ctx, operation, bytes.Join(items, nil))
+		if err != nil {
+			return succeeded, fmt.Errorf("failed to send request: %w", err)
+		}
 		bodyBytes, err := io.ReadAll(resp.Body)
+		deferredErrorCloser(resp.Body)
 		if err != nil {
-			return fmt.Errorf("failed to read response body: %w", err)
+			return succeeded, fmt.Errorf("failed to read response body: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return succeeded, fmt.Errorf("error code: %d, body: %s", resp.StatusCode, string(bodyBytes))
 		}
-		return fmt.Errorf("error code: %d, body: %s", resp.StatusCode, string(bodyBytes))
+
+		var result bulkResponse
+		if err := json.Unmarshal(bodyBytes, &result); err != nil {
+			return succeeded, fmt.Errorf("failed to unmarshal bulk response: %w", err)
+		}
+		if !result.Errors {
+			return succeeded + len(items), nil
+		}
+
+		var retry [][]byte
+		var itemErr error
+		failed := 0
+		for i, item := range result.Items {
+			for _, r := range item {
+				if r.Error == nil && r.Status < http.StatusMultipleChoices {
+					succeeded++
+					continue
+				}
+
+				failed++
+				errorType, reason := "unknown", ""
+				if r.Error != nil {
+					errorType, reason = r.Error.Type, r.Error.Reason
+				}
+				bulkItemErrors.WithLabelValues("elastic", operation, errorType).Inc()
+				if itemErr == nil {
+					itemErr = fmt.Errorf("item %s failed with status %d: %s: %s", r.ID, r.Status, errorType, reason)
+				}
+				if e.RetryFailedItems && i < len(items) && isRetryableItemStatus(r.Status) {
+					retry = append(retry, items[i])
+				}
+			}
+		}
+
+		if itemErr == nil {
+			return succeeded, nil
+		}
+		if len(retry) == 0 || attempt >= e.Retry.MaxAttempts {
+			return succeeded, fmt.Errorf("%d of %d bulk items failed, first error: %w", failed, len(items), itemErr)
+		}
+
+		requestRetries.WithLabelValues("elastic", operation).Inc()
+		timer := time.NewTimer(e.Retry.backoff(attempt, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return succeeded, fmt.Errorf("gave up retrying failed bulk items: %w", ctx.Err())
+		case <-timer.C:
+		}
+		items = retry
 	}
-	recordWritesCompleted(float64(numDocs))
-	return nil
 }
 
-// GetLatestTimestamp returns the latest _event_time in Rockset
-func (e *Elastic) GetLatestTimestamp() (time.Time, error) {
-	searchURL := fmt.Sprintf("%s/%s/_search?size=0", e.URL, e.IndexName)
+// isRetryableItemStatus returns whether a bulk item failed with a status that could succeed if sent again
+func isRetryableItemStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
 
+// GetLatestTimestamp returns the latest _event_time in Rockset
+func (e *Elastic) GetLatestTimestamp(ctx context.Context) (time.Time, error) {
 	// The identifier needs to be lowercased because by default, Elastic will index text in lowercase and the term query is case-sensitive
 	// This can be avoided using the match query, but this is slightly slower than the term query
-	jsonBody := fmt.Sprintf("{\"query\":{\"term\":{\"generator_identifier\": \"%s\"}},\"aggs\":{\"max_event_time_for_identifier\":{\"max\":{\"field\":\"_event_time\"}}}}", strings.ToLower(e.GeneratorIdentifier))
-	req, err := http.NewRequest(http.MethodPost, searchURL, bytes.NewBufferString(jsonBody))
-	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to create new request: %w", err)
-	}
-
-	req.Header.Add("Authorization", e.Auth)
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := e.Client.Do(req)
+	jsonBody := fmt.Sprintf("{\"size\":0,\"query\":{\"term\":{\"generator_identifier\": \"%s\"}},\"aggs\":{\"max_event_time_for_identifier\":{\"max\":{\"field\":\"_event_time\"}}}}", strings.ToLower(e.GeneratorIdentifier))
+	bodyBytes, err := e.search(ctx, []byte(jsonBody))
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to perform request: %w", err)
-	}
-	defer deferredErrorCloser(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return time.Time{}, fmt.Errorf("failed to read %s response body: %w", resp.Status, err)
-		}
-		return time.Time{}, fmt.Errorf("request failed: expected OK got %s: %s", resp.Status, string(bodyBytes))
+		return time.Time{}, err
 	}
 
 	// Received status 200. Result structure will look something like
@@ -179,11 +269,43 @@ func (e *Elastic) GetLatestTimestamp() (time.Time, error) {
 	// 		}
 	// 	}
 	// }
-	bodyBytes, err := io.ReadAll(resp.Body)
+	return maxTimestamp(bodyBytes, "max_event_time_for_identifier")
+}
+
+// GetLatestPatchTimestamp returns the latest _ts of patched documents, whose _ts is past their _event_time
+func (e *Elastic) GetLatestPatchTimestamp(ctx context.Context) (time.Time, error) {
+	// Microseconds from 2 minutes ago, so the script only compares the timestamps of recently changed documents
+	tsStartMicros := time.Now().Add(-2*time.Minute).UnixNano() / 1000
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{"generator_identifier": strings.ToLower(e.GeneratorIdentifier)}},
+					map[string]interface{}{"range": map[string]interface{}{"_ts": map[string]interface{}{"gt": tsStartMicros}}},
+					map[string]interface{}{"script": map[string]interface{}{
+						"script": map[string]interface{}{"source": "doc['_ts'].value > doc['_event_time'].value"},
+					}},
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"max_ts_for_identifier": map[string]interface{}{"max": map[string]interface{}{"field": "_ts"}},
+		},
+	}
+	jsonBody, err := json.Marshal(query)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to read response body: %w", err)
+		return time.Time{}, fmt.Errorf("failed to marshal query: %w", err)
 	}
+	bodyBytes, err := e.search(ctx, jsonBody)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return maxTimestamp(bodyBytes, "max_ts_for_identifier")
+}
 
+// maxTimestamp returns the value of the max aggregation named aggregation, a timestamp in microseconds
+func maxTimestamp(bodyBytes []byte, aggregation string) (time.Time, error) {
 	var result map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &result); err != nil {
 		return time.Time{}, fmt.Errorf("failed to unmarshal reponse: %w", err)
@@ -191,7 +313,7 @@ func (e *Elastic) GetLatestTimestamp() (time.Time, error) {
 
 	// TODO: check type assertions
 	result = result["aggregations"].(map[string]interface{})
-	result = result["max_event_time_for_identifier"].(map[string]interface{})
+	result = result[aggregation].(map[string]interface{})
 	if result["value"] == nil {
 		return time.Time{}, errors.New("malformed result, value is nil")
 	}
@@ -202,6 +324,204 @@ func (e *Elastic) GetLatestTimestamp() (time.Time, error) {
 	return time.Unix(timeMicro/1_000_000, (timeMicro%1_000_000)*1_000), nil
 }
 
-func (e *Elastic) ConfigureDestination() error {
+// VisibleProbes returns the probes of tokens which searches of the index return
+func (e *Elastic) VisibleProbes(ctx context.Context, tokens []string) ([]string, error) {
+	query := map[string]interface{}{
+		"size":    len(tokens),
+		"_source": []string{ProbeField},
+		"query":   map[string]interface{}{"terms": map[string]interface{}{ProbeField: tokens}},
+	}
+	jsonBody, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %w", err)
+	}
+	bodyBytes, err := e.search(ctx, jsonBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source map[string]interface{} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reponse: %w", err)
+	}
+
+	visible := make([]string, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		if token, ok := hit.Source[ProbeField].(string); ok {
+			visible = append(visible, token)
+		}
+	}
+	return visible, nil
+}
+
+// RunQuery runs a query of the query load. Strings are dynamically mapped to text with a keyword subfield, which exact
+// matches and aggregations use.
+func (e *Elastic) RunQuery(ctx context.Context, q Query) error {
+	byGenerator := map[string]interface{}{"term": map[string]interface{}{"generator_identifier": strings.ToLower(e.GeneratorIdentifier)}}
+	var query map[string]interface{}
+	switch q.Kind {
+	case PointLookup:
+		query = map[string]interface{}{
+			"query": map[string]interface{}{"ids": map[string]interface{}{"values": []string{q.Param}}},
+		}
+	case ClusterFilter, CitySearch:
+		field := "cluster1.keyword"
+		if q.Kind == CitySearch {
+			field = "Address.City.keyword"
+		}
+		query = map[string]interface{}{
+			"size": QueryLimit,
+			"query": map[string]interface{}{"bool": map[string]interface{}{"filter": []interface{}{
+				byGenerator,
+				map[string]interface{}{"term": map[string]interface{}{field: q.Param}},
+			}}},
+		}
+	case CompanyAggregation:
+		query = map[string]interface{}{
+			"size":  0,
+			"query": byGenerator,
+			"aggs": map[string]interface{}{
+				"count_by_company": map[string]interface{}{"terms": map[string]interface{}{"field": "Company.keyword"}},
+			},
+		}
+	default:
+		return fmt.Errorf("unsupported query %s", q.Kind)
+	}
+
+	jsonBody, err := json.Marshal(query)
+	if err != nil {
+		return fmt.Errorf("failed to marshal query: %w", err)
+	}
+	_, err = e.search(ctx, jsonBody)
+	return err
+}
+
+// search runs a search of the index, returning the response body
+func (e *Elastic) search(ctx context.Context, body []byte) ([]byte, error) {
+	ctx, cancel := WithTimeout(ctx, e.Timeouts.Query)
+	defer cancel()
+	searchURL := fmt.Sprintf("%s/%s/_search", e.URL, e.IndexName)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, searchURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request: %w", err)
+	}
+
+	req.Header.Add("Authorization", e.Auth)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform request: %w", err)
+	}
+	defer deferredErrorCloser(resp.Body)
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response body: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: expected OK got %s: %s", resp.Status, string(bodyBytes))
+	}
+	return bodyBytes, nil
+}
+
+func (e *Elastic) ConfigureDestination(_ context.Context) error {
 	return nil
 }
+
+var bulkItemErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bulk_item_errors",
+	Help: "The total number of items of bulk requests that failed, by error type",
+}, []string{"destination", "operation", "error_type"})
+
+func init() {
+	Register(Registration{
+		Name: "elastic",
+		Options: append([]Option{
+			{Name: "auth", Env: "ELASTIC_AUTH", Required: true, Secret: true},
+			{Name: "url", Env: "ELASTIC_URL", Required: true},
+			{Name: "index", Env: "ELASTIC_INDEX", Required: true},
+			{Name: "retry_failed_items", Env: "ELASTIC_RETRY_FAILED_ITEMS", Type: BoolOption, Default: "false", NeedsRetries: true},
+		}, TimeoutOptions("ELASTIC")...),
+		Capabilities: Capabilities{Deletes: true, LatencyQuery: true, PatchLatencyQuery: true, VisibilityQuery: true, Queries: true},
+		PatchEncoder: elasticPatchEncoder{},
+		New: func(s Settings) (Destination, error) {
+			return &Elastic{
+				Auth:                s.Options.String("auth"),
+				URL:                 s.Options.String("url"),
+				IndexName:           s.Options.String("index"),
+				Client:              s.Client,
+				GeneratorIdentifier: s.GeneratorIdentifier,
+				Timeouts:            s.Options.Timeouts(),
+				Retry:               s.Retry,
+				RetryFailedItems:    s.Options.Bool("retry_failed_items"),
+			}, nil
+		},
+	})
+}
+
+// elasticPatchEncoder renders patches as the body of a request to the update API,
+// see https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-update.html
+//
+// Patches of top level fields are partial documents, which are merged into the document. Anything else, which would
+// replace a whole object or array with a partial document, is a script.
+type elasticPatchEncoder struct{}
+
+func (elasticPatchEncoder) EncodePatch(p Patch) interface{} {
+	var body map[string]interface{}
+	if elasticPartialDocument(p.Fields) {
+		doc := map[string]interface{}{"_ts": p.Timestamp}
+		for _, f := range p.Fields {
+			doc[f.Path[0]] = f.Value
+		}
+		body = map[string]interface{}{"doc": doc}
+	} else {
+		params := map[string]interface{}{"ts": p.Timestamp}
+		statements := make([]string, 0, len(p.Fields)+1)
+		for i, f := range p.Fields {
+			param := fmt.Sprintf("p%d", i)
+			params[param] = f.Value
+			field := "ctx._source"
+			for _, name := range f.Path {
+				field += fmt.Sprintf("[%q]", name)
+			}
+			switch f.Op {
+			case SetField, SetNestedField, AddField:
+				statements = append(statements, fmt.Sprintf("%s = params.%s", field, param))
+			case AppendToArray:
+				statements = append(statements, fmt.Sprintf("%s.add(params.%s)", field, param))
+			case Increment:
+				statements = append(statements, fmt.Sprintf("%s += params.%s", field, param))
+			}
+		}
+		statements = append(statements, "ctx._source._ts = params.ts")
+		body = map[string]interface{}{
+			"script": map[string]interface{}{
+				"source": strings.Join(statements, "; "),
+				"params": params,
+			},
+		}
+	}
+
+	patch := make(map[string]interface{})
+	patch["_id"] = p.ID
+	patch["patch"] = body
+	return patch
+}
+
+// elasticPartialDocument returns whether the changes can be made by merging in a partial document
+func elasticPartialDocument(fields []FieldPatch) bool {
+	for _, f := range fields {
+		if len(f.Path) != 1 || (f.Op != SetField && f.Op != AddField) {
+			return false
+		}
+	}
+	return true
+}
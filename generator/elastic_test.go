@@ -2,9 +2,12 @@ package generator
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,26 +38,160 @@ func TestElastic_GetLatestTimestamp(t *testing.T) {
 	r := NewElasticClient(fmt.Sprintf(`{"aggregations":{"max_event_time_for_identifier":{"value":%d}}}`,
 		expected.UnixNano()/1000))
 
-	t0, err := r.GetLatestTimestamp()
+	t0, err := r.GetLatestTimestamp(context.Background())
 	assert.Nil(t, err)
 	assert.Equal(t, expected.Unix(), t0.Unix())
 }
 
-func TestElastic_SendDocument(t *testing.T) {
+func TestElastic_GetLatestPatchTimestamp(t *testing.T) {
+	expected := time.Now()
+	r := NewElasticClient(fmt.Sprintf(`{"aggregations":{"max_ts_for_identifier":{"value":%d}}}`,
+		expected.UnixNano()/1000))
+
+	t0, err := r.GetLatestPatchTimestamp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Unix(), t0.Unix())
+}
+
+func TestElastic_VisibleProbes(t *testing.T) {
+	r := NewElasticClient(`{"hits":{"hits":[{"_source":{"_probe":"abc"}}]}}`)
+
+	visible, err := r.VisibleProbes(context.Background(), []string{"abc", "def"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"abc"}, visible)
+}
+
+func TestElastic_RunQuery(t *testing.T) {
+	var bodies []string
 	r := NewElasticClient("")
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"hits":{"hits":[]}}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	for _, q := range []Query{
+		{Kind: PointLookup, Param: "0000000042"},
+		{Kind: ClusterFilter, Param: "3@gmail.com"},
+		{Kind: CompanyAggregation},
+		{Kind: CitySearch, Param: "San Mateo"},
+	} {
+		assert.Nil(t, r.RunQuery(context.Background(), q))
+	}
+	assert.Len(t, bodies, 4)
+	assert.JSONEq(t, `{"query":{"ids":{"values":["0000000042"]}}}`, bodies[0])
+	assert.Contains(t, bodies[1], `{"term":{"cluster1.keyword":"3@gmail.com"}}`)
+	assert.Contains(t, bodies[2], `"terms":{"field":"Company.keyword"}`)
+	assert.Contains(t, bodies[3], `{"term":{"Address.City.keyword":"San Mateo"}}`)
+	assert.Contains(t, bodies[3], `"size":100`)
+}
+
+func TestElastic_SendDocument(t *testing.T) {
+	r := NewElasticClient(`{"took": 3, "errors": false, "items": []}`)
 	spec := DocumentSpec{
-		Destination:          "elastic",
 		GeneratorIdentifier:  r.GeneratorIdentifier,
 		BatchSize:            10,
-		Mode:                 "add",
 		IdMode:               "sequential",
-		UpdatePercentage:     -1,
 		NumClusters:          -1,
 		HotClusterPercentage: -1,
 	};
 
-	docs, err := GenerateDocs(spec)
+	docs, err := NewGenerator(spec).GenerateDocs()
+	assert.Nil(t, err)
+	err = r.SendDocument(context.Background(), docs)
+	assert.Nil(t, err)
+}
+
+func TestElastic_InsertThenPatch(t *testing.T) {
+	var patched int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		patched += strings.Count(string(body), `{"update":`)
+		_, _ = w.Write([]byte(`{"took": 1, "errors": false, "items": []}`))
+	}))
+	defer server.Close()
+	e := &Elastic{URL: server.URL, IndexName: "test", Client: server.Client(), GeneratorIdentifier: "test"}
+
+	g := NewGenerator(DocumentSpec{GeneratorIdentifier: "test", BatchSize: 15, IdMode: "sequential", NumClusters: -1})
+	w := NewWorkload(g, elasticPatchEncoder{}, []WorkloadOperation{{Op: Insert, Weight: 1}})
+	batch, err := w.Generate(Insert)
 	assert.Nil(t, err)
-	err = r.SendDocument(docs)
+	assert.Nil(t, batch.Send(context.Background(), e))
+	// The documents are sent without _id, but are still acknowledged
+	assert.Equal(t, 15, g.ids.(*SequentialIDs).Acked())
+
+	batch, err = w.Generate(PatchReplace)
 	assert.Nil(t, err)
+	assert.Equal(t, 15, batch.Len())
+	assert.Nil(t, batch.Send(context.Background(), e))
+	assert.Equal(t, 15, patched)
+}
+
+func TestElastic_SendDocumentItemErrors(t *testing.T) {
+	r := NewElasticClient(`{"took": 3, "errors": true, "items": [
+		{"index": {"_id": "1", "status": 201}},
+		{"index": {"_id": "2", "status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse"}}},
+		{"index": {"_id": "3", "status": 201}}
+	]}`)
+	docs := []any{
+		map[string]interface{}{"_id": "1"},
+		map[string]interface{}{"_id": "2"},
+		map[string]interface{}{"_id": "3"},
+	}
+
+	succeeded, err := r.sendBulkItems(context.Background(), RequestInsert, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	assert.Equal(t, 2, succeeded)
+	assert.ErrorContains(t, err, "mapper_parsing_exception")
+
+	err = r.SendDocument(context.Background(), docs)
+	assert.ErrorContains(t, err, "1 of 3 bulk items failed")
+}
+
+func TestElastic_RetryFailedItems(t *testing.T) {
+	responses := []string{
+		`{"errors": true, "items": [
+			{"update": {"_id": "1", "status": 200}},
+			{"update": {"_id": "2", "status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "queue full"}}}
+		]}`,
+		`{"errors": false, "items": [{"update": {"_id": "2", "status": 200}}]}`,
+	}
+	var bodies []string
+	r := NewElasticClient("")
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(responses[len(bodies)-1])),
+			Header:     make(http.Header),
+		}
+	})
+	r.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	r.RetryFailedItems = true
+
+	succeeded, err := r.sendBulkItems(context.Background(), RequestPatch, [][]byte{[]byte("a\n"), []byte("b\n")})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, succeeded)
+	assert.Equal(t, []string{"a\nb\n", "b\n"}, bodies)
+}
+
+func TestElastic_SendDelete(t *testing.T) {
+	var body string
+	r := NewElasticClient("")
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errors": false, "items": []}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	assert.Nil(t, r.SendDelete(context.Background(), []string{"1", "2"}))
+	assert.Equal(t, `{"delete":{"_id":"1","_index":"test"}}`+"\n"+`{"delete":{"_id":"2","_index":"test"}}`+"\n", body)
 }
@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Realistic looking values like faker's, but taken from the randomness of a generator rather than faker's package
+// level source, so every generator has its own and seeded generators are reproducible.
+
+var firstNames = []string{
+	"Ada", "Alan", "Alice", "Amara", "Andre", "Anna", "Ben", "Carla", "Carlos", "Chen", "Chloe", "Daniel", "Diego",
+	"Elena", "Emma", "Ethan", "Fatima", "Grace", "Hana", "Hugo", "Ines", "Isaac", "Ivan", "Jack", "Jamal", "Julia",
+	"Kai", "Kenji", "Laura", "Leo", "Lina", "Lucas", "Maya", "Mei", "Mia", "Noah", "Nora", "Olga", "Omar", "Priya",
+	"Rafael", "Rosa", "Sam", "Sara", "Sofia", "Tariq", "Theo", "Uma", "Victor", "Yara", "Zoe",
+}
+
+var lastNames = []string{
+	"Adams", "Ahmed", "Alvarez", "Baker", "Becker", "Brown", "Chen", "Clark", "Costa", "Davis", "Dubois", "Evans",
+	"Fischer", "Garcia", "Gonzalez", "Gupta", "Hall", "Hernandez", "Ito", "Jackson", "Johnson", "Kim", "Kowalski",
+	"Lee", "Lopez", "Martin", "Meyer", "Miller", "Moore", "Nakamura", "Nguyen", "Novak", "Okafor", "Patel", "Perez",
+	"Rossi", "Sato", "Schmidt", "Silva", "Singh", "Smith", "Taylor", "Thomas", "Walker", "Wang", "Williams", "Wilson",
+	"Wright", "Young", "Zhang",
+}
+
+var loremWords = []string{
+	"a", "ab", "accusamus", "alias", "aliquam", "amet", "aperiam", "architecto", "aut", "autem", "beatae",
+	"blanditiis", "commodi", "consequatur", "corporis", "culpa", "cum", "debitis", "delectus", "deleniti", "dicta",
+	"dolor", "dolorem", "dolores", "ducimus", "eius", "eligendi", "enim", "eos", "error", "est", "et", "eum", "ex",
+	"excepturi", "exercitationem", "expedita", "facere", "facilis", "fugiat", "fugit", "harum", "hic", "id", "illo",
+	"impedit", "in", "incidunt", "ipsa", "ipsam", "iste", "itaque", "iure", "laboriosam", "laudantium", "libero",
+	"magnam", "magni", "maiores", "maxime", "minima", "minus", "modi", "molestiae", "mollitia", "nam", "natus",
+	"necessitatibus", "nemo", "neque", "nihil", "nisi", "nobis", "non", "nostrum", "nulla", "numquam", "odio",
+	"officia", "omnis", "optio", "pariatur", "perferendis", "placeat", "porro", "possimus", "praesentium", "provident",
+	"quae", "quam", "quas", "qui", "quia", "quibusdam", "quis", "quo", "quod", "ratione", "recusandae", "reiciendis",
+	"rem", "repellat", "rerum", "saepe", "sapiente", "sed", "sequi", "similique", "sint", "sit", "soluta", "sunt",
+	"suscipit", "tempora", "tempore", "totam", "ullam", "unde", "ut", "vel", "velit", "veniam", "veritatis", "vero",
+	"vitae", "voluptas", "voluptate", "voluptatem",
+}
+
+var topLevelDomains = []string{"com", "net", "org", "io", "biz", "info", "ru", "de"}
+
+func pick(r *rand.Rand, values []string) string {
+	return values[r.Intn(len(values))]
+}
+
+func fakeFirstName(r *rand.Rand) string {
+	return pick(r, firstNames)
+}
+
+func fakeLastName(r *rand.Rand) string {
+	return pick(r, lastNames)
+}
+
+func fakeName(r *rand.Rand) string {
+	return fakeFirstName(r) + " " + fakeLastName(r)
+}
+
+func fakeUsername(r *rand.Rand) string {
+	return strings.ToLower(fakeFirstName(r)) + fmt.Sprintf("%d", r.Intn(1000))
+}
+
+func fakeEmail(r *rand.Rand) string {
+	return fmt.Sprintf("%s.%s@%s.%s", strings.ToLower(fakeFirstName(r)), strings.ToLower(fakeLastName(r)),
+		strings.ToLower(randomLetters(r, 7)), pick(r, topLevelDomains))
+}
+
+func fakePhoneNumber(r *rand.Rand) string {
+	return fmt.Sprintf("%03d-%03d-%04d", 200+r.Intn(800), r.Intn(1000), r.Intn(10000))
+}
+
+func fakeURL(r *rand.Rand) string {
+	return fmt.Sprintf("https://www.%s%s.%s/%s", fakeWord(r), fakeWord(r), pick(r, topLevelDomains), fakeWord(r))
+}
+
+func fakeIPv4(r *rand.Rand) string {
+	return fmt.Sprintf("%d.%d.%d.%d", 1+r.Intn(254), r.Intn(256), r.Intn(256), 1+r.Intn(254))
+}
+
+func fakeWord(r *rand.Rand) string {
+	return pick(r, loremWords)
+}
+
+// fakeSentence is 4 to 12 lorem words, capitalized and ending with a period
+func fakeSentence(r *rand.Rand) string {
+	words := make([]string, 4+r.Intn(9))
+	for i := range words {
+		words[i] = fakeWord(r)
+	}
+	sentence := strings.Join(words, " ")
+	return strings.ToUpper(sentence[:1]) + sentence[1:] + "."
+}
+
+// fakeParagraph is 3 to 6 sentences
+func fakeParagraph(r *rand.Rand) string {
+	sentences := make([]string, 3+r.Intn(4))
+	for i := range sentences {
+		sentences[i] = fakeSentence(r)
+	}
+	return strings.Join(sentences, " ")
+}
@@ -0,0 +1,291 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// IDAllocator hands out the ids of new documents. Every generator owns its allocator, which must be safe for
+// concurrent use as documents are generated by several pipeline workers.
+type IDAllocator interface {
+	// NewID returns the id of a new document
+	NewID() string
+}
+
+// ExistingIDAllocator is an IDAllocator which keeps track of the ids it handed out, so upserts, patches and deletes
+// can target existing documents. Only documents whose writes were acknowledged exist, ids still waiting in the
+// pipeline queue or in flight are never targeted.
+type ExistingIDAllocator interface {
+	IDAllocator
+	// SetExisting makes the allocator continue after n documents written before, e.g. by a previous run
+	SetExisting(n int)
+	// Acknowledge reports that the writes of documents with the given ids finished, successfully if written is set.
+	// Documents which failed to be written, or were never sent, are never targeted.
+	Acknowledge(ids []string, written bool)
+	// RandomExisting returns the id of a random live document, false if there are none
+	RandomExisting() (string, bool)
+	// SampleExisting is RandomExisting picking with random instead of the randomness of the allocator, so picks made
+	// outside of generation, e.g. by queries, don't change the documents a seed generates
+	SampleExisting(random *rand.Rand) (string, bool)
+	// PickExisting returns up to count distinct ids of live documents, fewer if there aren't enough
+	PickExisting(count int) []string
+	// DeleteExisting is PickExisting, tombstoning the ids so they aren't targeted anymore
+	DeleteExisting(count int) []string
+}
+
+// IDStrategy describes a way of allocating ids to the registry of id strategies
+type IDStrategy struct {
+	// Name selects the strategy with ID_MODE
+	Name string
+	// TracksExisting is whether the allocators are ExistingIDAllocators, which upserts, patches and deletes need
+	TracksExisting bool
+	// New creates an allocator from a random seed, so allocators making up ids make up the same ones given the same
+	// seed
+	New func(seed int64) IDAllocator
+}
+
+var (
+	idStrategiesMu sync.RWMutex
+	idStrategies   = make(map[string]IDStrategy)
+)
+
+func init() {
+	RegisterIDStrategy(IDStrategy{
+		Name:           "sequential",
+		TracksExisting: true,
+		New:            func(seed int64) IDAllocator { return NewSequentialIDs(seed) },
+	})
+	RegisterIDStrategy(IDStrategy{
+		Name: "uuid",
+		New:  func(seed int64) IDAllocator { return NewUUIDs(seed) },
+	})
+}
+
+// RegisterIDStrategy makes an id strategy available to ID_MODE by name. It panics if the name is taken or the
+// strategy is incomplete, as that is a programming error.
+func RegisterIDStrategy(s IDStrategy) {
+	idStrategiesMu.Lock()
+	defer idStrategiesMu.Unlock()
+
+	if s.Name == "" || s.New == nil {
+		panic(fmt.Sprintf("id strategy %q needs a name and a New function", s.Name))
+	}
+	if _, taken := idStrategies[s.Name]; taken {
+		panic(fmt.Sprintf("id strategy %s is already registered", s.Name))
+	}
+	idStrategies[s.Name] = s
+}
+
+// LookupIDStrategy returns the id strategy registered under name
+func LookupIDStrategy(name string) (IDStrategy, bool) {
+	idStrategiesMu.RLock()
+	defer idStrategiesMu.RUnlock()
+	s, ok := idStrategies[name]
+	return s, ok
+}
+
+// IDStrategies returns the names of the registered id strategies, sorted
+func IDStrategies() []string {
+	idStrategiesMu.RLock()
+	defer idStrategiesMu.RUnlock()
+	names := make([]string, 0, len(idStrategies))
+	for name := range idStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TracksExistingIDs returns whether the id strategy registered under name keeps track of existing ids, which
+// upserts, patches and deletes need
+func TracksExistingIDs(name string) bool {
+	s, ok := LookupIDStrategy(name)
+	return ok && s.TracksExisting
+}
+
+// SequentialIDs allocates left padded monotonic integers, so existing documents are every acknowledged id except
+// those deleted
+type SequentialIDs struct {
+	mu     sync.Mutex
+	random *rand.Rand
+	// next is the next sequential id, ids below it were handed out
+	next int
+	// acked is the high-water mark of acknowledged ids, the writes of every id below it finished. Writes finish out of
+	// order, so ids acknowledged above it are kept in acknowledged until the ids below them catch up.
+	acked        int
+	acknowledged map[int]struct{}
+	// deleted are the ids which were deleted or failed to be written. Ids are tombstoned when the delete is generated,
+	// whether or not it succeeds later.
+	deleted map[int]struct{}
+	// live is the number of ids below acked which weren't deleted, kept up to date so picks don't count them
+	live int
+}
+
+// NewSequentialIDs creates an allocator starting from 0, picking existing ids with randomness seeded by seed
+func NewSequentialIDs(seed int64) *SequentialIDs {
+	return &SequentialIDs{
+		random:       rand.New(rand.NewSource(seed)),
+		acknowledged: make(map[int]struct{}),
+		deleted:      make(map[int]struct{}),
+	}
+}
+
+func (s *SequentialIDs) NewID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.next
+	s.next = s.next + 1
+	return formatDocId(id)
+}
+
+func (s *SequentialIDs) SetExisting(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = n
+	s.acked = n
+	s.acknowledged = make(map[int]struct{})
+	s.live = n
+	for id := range s.deleted {
+		if id < n {
+			s.live--
+		}
+	}
+}
+
+func (s *SequentialIDs) Acknowledge(ids []string, written bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, formatted := range ids {
+		id, err := strconv.Atoi(formatted)
+		// Ids below acked are upserts of existing documents, which exist whether or not the upsert succeeded
+		if err != nil || id < s.acked || id >= s.next {
+			continue
+		}
+		if !written {
+			s.deleted[id] = struct{}{}
+		}
+		s.acknowledged[id] = struct{}{}
+	}
+	for {
+		if _, ok := s.acknowledged[s.acked]; !ok {
+			return
+		}
+		delete(s.acknowledged, s.acked)
+		if _, isDeleted := s.deleted[s.acked]; !isDeleted {
+			s.live++
+		}
+		s.acked++
+	}
+}
+
+// Next returns the next id, the number of ids handed out so far deleted ones included
+func (s *SequentialIDs) Next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// Acked returns the high-water mark of acknowledged ids, existing documents are picked below it
+func (s *SequentialIDs) Acked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+func (s *SequentialIDs) RandomExisting() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.randomLiveID(s.random)
+}
+
+func (s *SequentialIDs) SampleExisting(random *rand.Rand) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.randomLiveID(random)
+}
+
+// randomLiveID returns an acknowledged id which was not deleted, picked with random. mu must be held.
+func (s *SequentialIDs) randomLiveID(random *rand.Rand) (string, bool) {
+	if s.live <= 0 {
+		return "", false
+	}
+	// Deletes are a fraction of the documents, so a few tries are enough to find a live one
+	for i := 0; i < 100; i++ {
+		id := random.Intn(s.acked)
+		if _, isDeleted := s.deleted[id]; !isDeleted {
+			return formatDocId(id), true
+		}
+	}
+	return "", false
+}
+
+func (s *SequentialIDs) PickExisting(count int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return formatDocIds(s.uniqueLiveIDs(count))
+}
+
+func (s *SequentialIDs) DeleteExisting(count int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := s.uniqueLiveIDs(count)
+	for _, id := range ids {
+		s.deleted[id] = struct{}{}
+	}
+	s.live -= len(ids)
+	return formatDocIds(ids)
+}
+
+// uniqueLiveIDs returns count distinct acknowledged ids which were not deleted, or all of them if there are fewer.
+// The ids come out in the order they were picked, so they're reproducible. mu must be held.
+func (s *SequentialIDs) uniqueLiveIDs(count int) []int {
+	if count > s.live {
+		count = s.live
+	}
+
+	picked := make(map[int]struct{}, count)
+	ids := make([]int, 0, count)
+	for len(ids) < count {
+		id := s.random.Intn(s.acked)
+		_, exists := picked[id]
+		_, isDeleted := s.deleted[id]
+		if !exists && !isDeleted {
+			picked[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func formatDocId(id int) string {
+	return fmt.Sprintf("%024d", id)
+}
+
+func formatDocIds(ids []int) []string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = formatDocId(id)
+	}
+	return formatted
+}
+
+// UUIDs allocates random version 4 uuids. It doesn't keep track of them, so upserts, patches and deletes can't
+// target the documents.
+type UUIDs struct {
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewUUIDs creates an allocator of uuids taken from randomness seeded by seed
+func NewUUIDs(seed int64) *UUIDs {
+	return &UUIDs{random: rand.New(rand.NewSource(seed))}
+}
+
+func (u *UUIDs) NewID() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return randomUUID(u.random)
+}
@@ -0,0 +1,155 @@
+package generator
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequentialIDs_Concurrent(t *testing.T) {
+	ids := NewSequentialIDs(1)
+	ids.SetExisting(1000)
+
+	const workers, rounds = 8, 200
+	var wg sync.WaitGroup
+	created := make([][]string, workers)
+	deleted := make([][]string, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				created[w] = append(created[w], ids.NewID())
+				deleted[w] = append(deleted[w], ids.DeleteExisting(2)...)
+				ids.PickExisting(5)
+				ids.RandomExisting()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1000+workers*rounds, ids.Next())
+	seen := make(map[string]bool)
+	for _, batch := range created {
+		for _, id := range batch {
+			assert.False(t, seen[id], "id %s was created twice", id)
+			seen[id] = true
+		}
+	}
+	seen = make(map[string]bool)
+	for _, batch := range deleted {
+		for _, id := range batch {
+			assert.False(t, seen[id], "id %s was deleted twice", id)
+			seen[id] = true
+		}
+	}
+	for _, id := range ids.PickExisting(ids.Next()) {
+		assert.False(t, seen[id], "deleted id %s was picked", id)
+	}
+}
+
+func TestSequentialIDs_Live(t *testing.T) {
+	ids := NewSequentialIDs(1)
+	ids.SetExisting(10)
+	created := make([]string, 10)
+	for i := range created {
+		created[i] = ids.NewID()
+	}
+	assert.Len(t, ids.DeleteExisting(3), 3)
+	// Acknowledged out of order, with two writes failing
+	ids.Acknowledge(created[5:], true)
+	ids.Acknowledge(created[3:5], false)
+	assert.Len(t, ids.PickExisting(100), 7)
+	ids.Acknowledge(created[:3], true)
+	assert.Equal(t, 20, ids.Acked())
+	assert.Len(t, ids.PickExisting(100), 15)
+
+	assert.Len(t, ids.DeleteExisting(100), 15)
+	_, found := ids.RandomExisting()
+	assert.False(t, found)
+	assert.Empty(t, ids.PickExisting(1))
+}
+
+func TestUUIDs_Concurrent(t *testing.T) {
+	ids := NewUUIDs(1)
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := ids.NewID()
+				mu.Lock()
+				assert.False(t, seen[id], "id %s was created twice", id)
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 800)
+}
+
+func TestRegisterIDStrategy(t *testing.T) {
+	strategy := IDStrategy{Name: "test_constant", New: func(int64) IDAllocator { return constantIDs("x") }}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			IDStrategies()
+			LookupIDStrategy("sequential")
+		}()
+	}
+	RegisterIDStrategy(strategy)
+	wg.Wait()
+
+	assert.Contains(t, IDStrategies(), "test_constant")
+	assert.False(t, TracksExistingIDs("test_constant"))
+	assert.True(t, TracksExistingIDs("sequential"))
+	assert.False(t, TracksExistingIDs("unknown"))
+	assert.Panics(t, func() { RegisterIDStrategy(strategy) })
+	assert.Panics(t, func() { RegisterIDStrategy(IDStrategy{Name: "test_incomplete"}) })
+
+	doc, err := NewGenerator(DocumentSpec{IdMode: "test_constant"}).GenerateDoc()
+	assert.NoError(t, err)
+	assert.Equal(t, "x", doc.(map[string]interface{})["_id"])
+}
+
+func TestGenerateDoc_UnknownIDMode(t *testing.T) {
+	g := NewGenerator(DocumentSpec{IdMode: "unknown"})
+	_, err := g.GenerateDoc()
+	assert.EqualError(t, err, `unknown ID_MODE "unknown"`)
+	_, err = g.GenerateDeletes(1)
+	assert.Error(t, err)
+}
+
+type constantIDs string
+
+func (c constantIDs) NewID() string {
+	return string(c)
+}
+
+func TestSequentialIDs_Acknowledge(t *testing.T) {
+	ids := NewSequentialIDs(1)
+	ids.SetExisting(2)
+	for i := 0; i < 4; i++ {
+		ids.NewID()
+	}
+	assert.Equal(t, 2, ids.Acked())
+
+	ids.Acknowledge([]string{formatDocId(3), formatDocId(5)}, true)
+	assert.Equal(t, 2, ids.Acked())
+	ids.Acknowledge([]string{formatDocId(2)}, false)
+	assert.Equal(t, 4, ids.Acked())
+	// Upserts of existing documents don't change anything, whether or not they succeed
+	ids.Acknowledge([]string{formatDocId(0)}, false)
+	ids.Acknowledge([]string{formatDocId(4)}, true)
+	assert.Equal(t, 6, ids.Acked())
+
+	assert.ElementsMatch(t, []string{formatDocId(0), formatDocId(1), formatDocId(3), formatDocId(4), formatDocId(5)},
+		ids.PickExisting(10))
+}
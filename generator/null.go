@@ -1,24 +1,60 @@
 package generator
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Null destination for local testing
 type Null struct{}
 
-func (n *Null) SendDocument(docs []any) error {
+func (n *Null) SendDocument(ctx context.Context, docs []any) error {
+	RecordRequest("null", RequestInsert, 0, time.Now(), true)
+	RecordWrites(RequestInsert, len(docs), 0)
+	return nil
+}
 
-	recordWritesCompleted(float64(len(docs)))
+func (n *Null) SendPatch(ctx context.Context, docs []interface{}) error {
+	RecordRequest("null", RequestPatch, 0, time.Now(), true)
+	RecordWrites(RequestPatch, len(docs), 0)
 	return nil
 }
 
-func (n *Null) SendPatch(docs []interface{}) error {
+func (n *Null) SendDelete(ctx context.Context, ids []string) error {
+	RecordRequest("null", RequestDelete, 0, time.Now(), true)
+	RecordWrites(RequestDelete, len(ids), 0)
 	return nil
 }
 
-func (n *Null) GetLatestTimestamp() (time.Time, error) {
+func (n *Null) GetLatestTimestamp(_ context.Context) (time.Time, error) {
+	return time.Now().Add(-10 * time.Millisecond), nil
+}
+
+func (n *Null) GetLatestPatchTimestamp(_ context.Context) (time.Time, error) {
 	return time.Now().Add(-10 * time.Millisecond), nil
 }
 
-func (n *Null) ConfigureDestination() error {
+// VisibleProbes returns every probe, documents are visible as soon as they are sent
+func (n *Null) VisibleProbes(_ context.Context, tokens []string) ([]string, error) {
+	return tokens, nil
+}
+
+// RunQuery returns right away, there are no documents to query
+func (n *Null) RunQuery(_ context.Context, _ Query) error {
+	return nil
+}
+
+func (n *Null) ConfigureDestination(_ context.Context) error {
 	return nil
 }
+
+func init() {
+	Register(Registration{
+		Name:         "null",
+		Capabilities: Capabilities{Deletes: true, LatencyQuery: true, PatchLatencyQuery: true, VisibilityQuery: true, Queries: true},
+		PatchEncoder: nullPatchEncoder{},
+		New: func(s Settings) (Destination, error) {
+			return &Null{}, nil
+		},
+	})
+}
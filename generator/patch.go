@@ -0,0 +1,203 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// PatchOp is the kind of change a FieldPatch makes
+type PatchOp int
+
+const (
+	// SetField replaces the value of an existing top level field
+	SetField PatchOp = iota
+	// SetNestedField replaces the value of an existing field of a nested object
+	SetNestedField
+	// AppendToArray appends Value to an existing array
+	AppendToArray
+	// AddField adds a field which doesn't exist yet
+	AddField
+	// Increment adds Value, a number, to an existing numeric field
+	Increment
+)
+
+func (op PatchOp) String() string {
+	switch op {
+	case SetField:
+		return "set"
+	case SetNestedField:
+		return "set_nested"
+	case AppendToArray:
+		return "append"
+	case AddField:
+		return "add"
+	case Increment:
+		return "increment"
+	default:
+		return "unknown"
+	}
+}
+
+// FieldPatch is a change to a single field of a document, independent of any destination
+type FieldPatch struct {
+	Op PatchOp
+	// Path is the path to the field from the root of the document, e.g. ["Address", "City"]
+	Path  []string
+	Value interface{}
+}
+
+// Patch is a change to the document with id ID. Patches also set the _ts field to Timestamp, so the latency of
+// patches can be measured. Timestamp is set right before the patch is encoded and sent, like the timestamps of
+// documents, so the time spent in the pipeline queue isn't counted as latency.
+type Patch struct {
+	ID        string
+	Fields    []FieldPatch
+	Timestamp int64
+}
+
+// PatchEncoder renders patches in the format a destination accepts. Destinations that register an encoder support
+// patches, and what EncodePatch returns is what their SendPatch is called with.
+type PatchEncoder interface {
+	EncodePatch(p Patch) interface{}
+}
+
+// GeneratePatches generates count patches of distinct existing documents, making the changes of op, PatchReplace or
+// PatchAdd. The patches aren't timestamped yet, see EncodePatches.
+func (g *Generator) GeneratePatches(op Operation, count int) ([]Patch, error) {
+	ids, err := g.existingIDs()
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fields := &g.replacePatches
+	switch op {
+	case PatchReplace:
+	case PatchAdd:
+		fields = &g.addPatches
+	default:
+		return nil, fmt.Errorf("%s is not a patch operation", op)
+	}
+
+	ids_to_patch := ids.PickExisting(count)
+	patches := make([]Patch, 0, len(ids_to_patch))
+	for _, id := range ids_to_patch {
+		patches = append(patches, Patch{ID: id, Fields: []FieldPatch{fields.next(g.patchRand)}})
+	}
+	return patches, nil
+}
+
+// EncodePatches timestamps patches with the current time and renders them with encoder. It's done right before they
+// are sent, as patches can sit in the BatchPipeline queue for a while.
+func EncodePatches(patches []Patch, encoder PatchEncoder) []interface{} {
+	now := stampNow()
+	encoded := make([]interface{}, len(patches))
+	for i, patch := range patches {
+		patch.Timestamp = now
+		encoded[i] = encoder.EncodePatch(patch)
+	}
+	return encoded
+}
+
+// patchFields hands out the changes of a patch operation in shuffled rounds of its options, so every kind of change
+// is made equally often
+type patchFields struct {
+	options func(random *rand.Rand) []FieldPatch
+	pending []FieldPatch
+}
+
+func (f *patchFields) next(random *rand.Rand) FieldPatch {
+	if len(f.pending) == 0 {
+		f.pending = f.options(random)
+		random.Shuffle(len(f.pending), func(i, j int) {
+			f.pending[i], f.pending[j] = f.pending[j], f.pending[i]
+		})
+	}
+	field := f.pending[0]
+	f.pending = f.pending[1:]
+	return field
+}
+
+// MissingPatchedFields returns the fields, as dotted paths, which patches of op change but schema doesn't define with a
+// suitable type. Patches change fields of DefaultSchema, so other schemas must define them as well to be patched.
+func MissingPatchedFields(schema *Schema, op Operation) []string {
+	var options []FieldPatch
+	switch op {
+	case PatchReplace:
+		options = replaceOptions(rand.New(rand.NewSource(0)))
+	case PatchAdd:
+		options = addOptions(rand.New(rand.NewSource(0)))
+	}
+
+	var missing []string
+	for _, option := range options {
+		if option.Op == AddField {
+			continue
+		}
+		field, found := schema.Field(option.Path...)
+		switch option.Op {
+		case AppendToArray:
+			found = found && field.Type == "array"
+		case Increment:
+			found = found && (field.Type == "int" || field.Type == "float")
+		}
+		if !found {
+			missing = append(missing, strings.Join(option.Path, "."))
+		}
+	}
+	return missing
+}
+
+// patchedFields are the top level fields of generated documents which patches change, and so must exist
+var patchedFields = func() map[string]bool {
+	random := rand.New(rand.NewSource(0))
+	fields := make(map[string]bool)
+	for _, options := range [][]FieldPatch{replaceOptions(random), addOptions(random)} {
+		for _, field := range options {
+			if field.Op != AddField {
+				fields[field.Path[0]] = true
+			}
+		}
+	}
+	return fields
+}()
+
+// addOptions are the changes made in `add` patch mode, adding fields or array members
+func addOptions(random *rand.Rand) []FieldPatch {
+	return []FieldPatch{
+		{Op: AddField, Path: []string{randomDigits(random)}, Value: fakeEmail(random)},
+		{Op: AppendToArray, Path: []string{"Tags"}, Value: randomUUID(random)},
+	}
+}
+
+// replaceOptions are the changes made in `replace` patch mode, purely replacing fields
+func replaceOptions(random *rand.Rand) []FieldPatch {
+	return []FieldPatch{
+		{Op: SetField, Path: []string{"Email"}, Value: fakeEmail(random)},
+		{Op: SetField, Path: []string{"About"}, Value: fakeSentence(random)},
+		{Op: SetField, Path: []string{"Company"}, Value: fakeWord(random) + "-" + fakeWord(random)},
+		{Op: SetNestedField, Path: []string{"Name", "First"}, Value: fakeFirstName(random)},
+		{Op: SetNestedField, Path: []string{"Name", "Last"}, Value: fakeLastName(random)},
+		{Op: SetField, Path: []string{"Age"}, Value: random.Intn(100)},
+		{Op: SetField, Path: []string{"Balance"}, Value: random.Float64()},
+		{Op: SetField, Path: []string{"Registered"}, Value: randomTime(random).Format(timestampLayout)},
+		{Op: SetField, Path: []string{"Phone"}, Value: fakePhoneNumber(random)},
+		{Op: SetField, Path: []string{"Picture"}, Value: randomDigits(random)},
+		{Op: SetField, Path: []string{"Guid"}, Value: randomUUID(random)},
+		{Op: SetField, Path: []string{"Greeting"}, Value: fakeParagraph(random)},
+		{Op: SetNestedField, Path: []string{"Address", "ZipCode"}, Value: random.Intn(100000)},
+		{Op: SetNestedField, Path: []string{"Address", "Coordinates", "Longitude"}, Value: random.Float64()*360 - 180},
+		{Op: SetNestedField, Path: []string{"Address", "Coordinates", "Latitude"}, Value: random.Float64()*180 - 90},
+		{Op: SetNestedField, Path: []string{"Address", "City"}, Value: fakeWord(random)},
+		{Op: Increment, Path: []string{"Friends", "Friend1", "Age"}, Value: 1},
+	}
+}
+
+// nullPatchEncoder passes patches through as they are, for destinations that don't look at them
+type nullPatchEncoder struct{}
+
+func (nullPatchEncoder) EncodePatch(p Patch) interface{} {
+	return p
+}
@@ -0,0 +1,106 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratePatches(t *testing.T) {
+	g := NewGenerator(DocumentSpec{IdMode: "sequential"})
+	g.SetMaxDoc(100)
+
+	patches, err := g.GeneratePatches(PatchReplace, 10)
+	assert.Nil(t, err)
+	assert.Len(t, patches, 10)
+	ids := make(map[string]bool)
+	for _, patch := range patches {
+		assert.Len(t, patch.ID, 24)
+		assert.Len(t, patch.Fields, 1)
+		assert.Zero(t, patch.Timestamp)
+		ids[patch.ID] = true
+	}
+	assert.Len(t, ids, 10)
+
+	// Patches are timestamped when they are encoded, right before being sent
+	before := CurrentTimeMicros()
+	for _, p := range EncodePatches(patches, nullPatchEncoder{}) {
+		assert.GreaterOrEqual(t, p.(Patch).Timestamp, before)
+	}
+	assert.Zero(t, patches[0].Timestamp)
+}
+
+func TestMissingPatchedFields(t *testing.T) {
+	assert.Empty(t, MissingPatchedFields(DefaultSchema, PatchReplace))
+	assert.Empty(t, MissingPatchedFields(DefaultSchema, PatchAdd))
+
+	s, err := ParseSchema([]byte(`
+fields:
+  - name: Email
+    type: string
+  - name: Tags
+    type: string
+  - name: Address
+    type: object
+    fields:
+      - name: City
+        type: string
+`))
+	assert.Nil(t, err)
+	field, found := s.Field("Address", "City")
+	assert.True(t, found)
+	assert.Equal(t, "string", field.Type)
+	_, found = s.Field("Address", "ZipCode")
+	assert.False(t, found)
+
+	missing := MissingPatchedFields(s, PatchReplace)
+	assert.NotContains(t, missing, "Email")
+	assert.NotContains(t, missing, "Address.City")
+	assert.Contains(t, missing, "Address.ZipCode")
+	assert.Contains(t, missing, "Friends.Friend1.Age")
+	// Tags must be an array to be appended to
+	assert.Equal(t, []string{"Tags"}, MissingPatchedFields(s, PatchAdd))
+}
+
+func TestRocksetPatchEncoder(t *testing.T) {
+	p := Patch{ID: "1", Timestamp: 42, Fields: []FieldPatch{
+		{Op: SetNestedField, Path: []string{"Address", "City"}, Value: "SF"},
+		{Op: AppendToArray, Path: []string{"Tags"}, Value: "new"},
+		{Op: Increment, Path: []string{"Age"}, Value: 1},
+	}}
+
+	assert.Equal(t, map[string]interface{}{
+		"_id": "1",
+		"patch": []map[string]interface{}{
+			{"op": "replace", "path": "/Address/City", "value": "SF"},
+			{"op": "add", "path": "/Tags/-", "value": "new"},
+			{"op": "INCR", "path": "/Age", "value": 1},
+			{"op": "add", "path": "/_ts", "value": int64(42)},
+		},
+	}, rocksetPatchEncoder{}.EncodePatch(p))
+}
+
+func TestElasticPatchEncoder(t *testing.T) {
+	doc := Patch{ID: "1", Timestamp: 42, Fields: []FieldPatch{
+		{Op: SetField, Path: []string{"Email"}, Value: "a@b.c"},
+		{Op: AddField, Path: []string{"123"}, Value: "new"},
+	}}
+	assert.Equal(t, map[string]interface{}{
+		"_id":   "1",
+		"patch": map[string]interface{}{"doc": map[string]interface{}{"Email": "a@b.c", "123": "new", "_ts": int64(42)}},
+	}, elasticPatchEncoder{}.EncodePatch(doc))
+
+	script := Patch{ID: "2", Timestamp: 42, Fields: []FieldPatch{
+		{Op: SetNestedField, Path: []string{"Name", "First"}, Value: "Ada"},
+		{Op: AppendToArray, Path: []string{"Tags"}, Value: "new"},
+		{Op: Increment, Path: []string{"Age"}, Value: 1},
+	}}
+	assert.Equal(t, map[string]interface{}{
+		"_id": "2",
+		"patch": map[string]interface{}{"script": map[string]interface{}{
+			"source": `ctx._source["Name"]["First"] = params.p0; ctx._source["Tags"].add(params.p1); ` +
+				`ctx._source["Age"] += params.p2; ctx._source._ts = params.ts`,
+			"params": map[string]interface{}{"p0": "Ada", "p1": "new", "p2": 1, "ts": int64(42)},
+		}},
+	}, elasticPatchEncoder{}.EncodePatch(script))
+}
@@ -0,0 +1,135 @@
+package generator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrPipelineStopped is returned by BatchPipeline.Next once the pipeline or the caller is done.
+var ErrPipelineStopped = errors.New("batch pipeline stopped")
+
+// BatchPipeline pre-generates batches on a pool of workers so generation is kept off the send loop.
+// Workers block once queueSize batches are ready, so at most that many batches are generated ahead of time.
+type BatchPipeline struct {
+	generate func() (Batch, error)
+	batches  chan pipelineBatch
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type pipelineBatch struct {
+	batch Batch
+	err   error
+}
+
+// NewBatchPipeline starts workers goroutines calling generate and queueing up to queueSize of the results.
+// generate must be safe for concurrent use when workers is greater than one.
+func NewBatchPipeline(workers int, queueSize int, generate func() (Batch, error)) *BatchPipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	p := &BatchPipeline{
+		generate: generate,
+		batches:  make(chan pipelineBatch, queueSize),
+		stop:     make(chan struct{}),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *BatchPipeline) work() {
+	defer p.wg.Done()
+
+	for {
+		start := time.Now()
+		batch, err := p.generate()
+		batchGenerationSeconds.Observe(time.Since(start).Seconds())
+
+		select {
+		case <-p.stop:
+			batch.Discard()
+			return
+		case p.batches <- pipelineBatch{batch: batch, err: err}:
+			generationQueueDepth.Set(float64(len(p.batches)))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Next returns the next generated batch, waiting for one if none is ready.
+// It returns ErrPipelineStopped if done is closed or Stop is called before a batch is available.
+func (p *BatchPipeline) Next(done <-chan struct{}) (Batch, error) {
+	select {
+	case <-p.stop:
+		return Batch{}, ErrPipelineStopped
+	default:
+	}
+
+	var b pipelineBatch
+	select {
+	case b = <-p.batches:
+	default:
+		// The send loop is waiting on the generators, so generation is the bottleneck
+		generationQueueStalls.Inc()
+		select {
+		case <-done:
+			return Batch{}, ErrPipelineStopped
+		case <-p.stop:
+			return Batch{}, ErrPipelineStopped
+		case b = <-p.batches:
+		}
+	}
+	generationQueueDepth.Set(float64(len(p.batches)))
+
+	return b.batch, b.err
+}
+
+// Stop stops the workers and waits for them to exit. Batches still queued are discarded.
+func (p *BatchPipeline) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	p.wg.Wait()
+	for {
+		select {
+		case b := <-p.batches:
+			b.batch.Discard()
+		default:
+			return
+		}
+	}
+}
+
+var (
+	generationQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "generation_queue_depth",
+		Help: "The number of pre-generated batches waiting to be sent",
+	})
+
+	generationQueueStalls = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "generation_queue_stalls",
+		Help: "The number of times a batch was due but none had been generated yet",
+	})
+
+	batchGenerationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "batch_generation_seconds",
+		Help:    "Time in seconds taken to generate a single batch",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+)
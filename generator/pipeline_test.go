@@ -0,0 +1,43 @@
+package generator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchPipeline(t *testing.T) {
+	spec := DocumentSpec{
+		GeneratorIdentifier:  "test",
+		BatchSize:            5,
+		IdMode:               "uuid",
+		NumClusters:          -1,
+		HotClusterPercentage: -1,
+	}
+	w := NewWorkload(NewGenerator(spec), nil, []WorkloadOperation{{Op: Insert, Weight: 1}})
+	p := NewBatchPipeline(4, 2, w.NextBatch)
+
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		batch, err := p.Next(done)
+		assert.Nil(t, err)
+		assert.Equal(t, Insert, batch.Op)
+		assert.Len(t, batch.Docs, 5)
+	}
+
+	p.Stop()
+	_, err := p.Next(done)
+	assert.Equal(t, ErrPipelineStopped, err)
+}
+
+func TestBatchPipeline_Error(t *testing.T) {
+	expected := errors.New("generation failed")
+	p := NewBatchPipeline(1, 1, func() (Batch, error) {
+		return Batch{}, expected
+	})
+	defer p.Stop()
+
+	_, err := p.Next(make(chan struct{}))
+	assert.Equal(t, expected, err)
+}
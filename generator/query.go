@@ -0,0 +1,224 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// QueryKind is a query of the query load, which every QueryDestination renders in its own query language
+type QueryKind string
+
+const (
+	// PointLookup looks up a live document by _id
+	PointLookup QueryKind = "point_lookup"
+	// ClusterFilter returns documents of the generator with a cluster1 value
+	ClusterFilter QueryKind = "cluster_filter"
+	// CompanyAggregation counts the documents of the generator by Company
+	CompanyAggregation QueryKind = "company_aggregation"
+	// CitySearch returns documents of the generator with an Address.City value
+	CitySearch QueryKind = "city_search"
+)
+
+// QueryKinds are the kinds of queries of the query load
+var QueryKinds = []QueryKind{PointLookup, ClusterFilter, CompanyAggregation, CitySearch}
+
+// QueryLimit bounds the number of documents filters and searches return
+const QueryLimit = 100
+
+// Query is a query of the query load, with its parameter picked from the documents of the run
+type Query struct {
+	Kind QueryKind
+	// Param is the _id, cluster1 or Address.City value looked for, empty for aggregations
+	Param string
+}
+
+func (q Query) String() string {
+	if q.Param == "" {
+		return string(q.Kind)
+	}
+	return fmt.Sprintf("%s(%s)", q.Kind, q.Param)
+}
+
+// QueryDestination is implemented by destinations which can run the queries of the query load
+type QueryDestination interface {
+	// RunQuery runs q against the documents of the generator, reading the results so their transfer is measured too
+	RunQuery(ctx context.Context, q Query) error
+}
+
+// SupportsQuery reports whether documents generated from spec have the parameters of queries of kind. Companies are
+// aggregated if the schema has a string Company field, and cities searched if it has a string Address.City field
+// with oneof values to pick from.
+func (spec DocumentSpec) SupportsQuery(kind QueryKind) bool {
+	schema := spec.Schema
+	if schema == nil {
+		schema = DefaultSchema
+	}
+	switch kind {
+	case PointLookup:
+		return TracksExistingIDs(spec.IdMode)
+	case ClusterFilter:
+		return spec.NumClusters > 0
+	case CompanyAggregation:
+		company, ok := schema.Field("Company")
+		return ok && company.Type == "string"
+	case CitySearch:
+		city, ok := schema.Field("Address", "City")
+		return ok && city.Type == "string" && len(city.OneOf) > 0
+	}
+	return false
+}
+
+// GenerateQuery picks the parameter of a query of kind using random, returning false if there is none to pick, e.g.
+// no documents were written yet. Cluster keys are picked the way documents get them, and cities out of the oneof
+// values of the schema.
+func (g *Generator) GenerateQuery(kind QueryKind, random *rand.Rand) (Query, bool) {
+	q := Query{Kind: kind}
+	switch kind {
+	case PointLookup:
+		ids, err := g.existingIDs()
+		if err != nil {
+			return q, false
+		}
+		// Not RandomExisting, which would draw from the seeded randomness of the documents
+		id, found := ids.SampleExisting(random)
+		q.Param = id
+		return q, found
+	case ClusterFilter:
+		if g.spec.NumClusters <= 0 {
+			return q, false
+		}
+		q.Param = g.clusterKey(random)
+		return q, true
+	case CitySearch:
+		if !g.spec.SupportsQuery(kind) {
+			return q, false
+		}
+		city, _ := g.schema.Field("Address", "City")
+		q.Param = fmt.Sprint(city.OneOf[random.Intn(len(city.OneOf))])
+		return q, true
+	}
+	return q, kind == CompanyAggregation && g.spec.SupportsQuery(kind)
+}
+
+// QueryLoad runs queries against a destination alongside the writes of a run, so the latencies of both can be
+// measured under read load. Queries are picked at random according to the shares of a mix, with parameters picked from
+// the documents of a generator.
+//
+// Queries are started at a fixed rate, and only once one of the in-flight slots is free, so a slow destination causes
+// the achieved rate to fall below the target rather than piling up queries.
+type QueryLoad struct {
+	generator *Generator
+	// kinds are the kinds of the mix, sorted so they don't follow map order, and shares their cumulative shares
+	kinds  []QueryKind
+	shares []int
+	random *rand.Rand
+
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewQueryLoad creates a query load picking queries out of mix, by share, with at most maxInFlight running at once
+func NewQueryLoad(g *Generator, mix map[QueryKind]int, maxInFlight int) *QueryLoad {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	l := &QueryLoad{
+		generator: g,
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		inFlight:  make(chan struct{}, maxInFlight),
+	}
+	for kind := range mix {
+		l.kinds = append(l.kinds, kind)
+	}
+	sort.Slice(l.kinds, func(i, j int) bool { return l.kinds[i] < l.kinds[j] })
+	total := 0
+	for _, kind := range l.kinds {
+		total += mix[kind]
+		l.shares = append(l.shares, total)
+	}
+	return l
+}
+
+func (l *QueryLoad) String() string {
+	kinds := make([]string, len(l.kinds))
+	for i, kind := range l.kinds {
+		kinds[i] = string(kind)
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// Run starts qps queries per second against d until ctx is cancelled, then waits for the queries in flight, which
+// are cancelled with ctx
+func (l *QueryLoad) Run(ctx context.Context, d QueryDestination, qps float64) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / qps))
+	defer ticker.Stop()
+	defer l.wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		q, ok := l.next()
+		if !ok {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case l.inFlight <- struct{}{}:
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			defer func() { <-l.inFlight }()
+			start := time.Now()
+			err := d.RunQuery(ctx, q)
+			if err != nil && ctx.Err() != nil {
+				// Cut short by the end of the run
+				return
+			}
+			if err != nil {
+				log.Printf("failed to run query %s: %v", q, err)
+			}
+			RecordQuery(q.Kind, time.Since(start), err == nil)
+		}()
+	}
+}
+
+// next picks the next query, false if the kind picked has no parameter to pick yet
+func (l *QueryLoad) next() (Query, bool) {
+	if len(l.kinds) == 0 || l.shares[len(l.shares)-1] <= 0 {
+		return Query{}, false
+	}
+	pick := l.random.Intn(l.shares[len(l.shares)-1])
+	i := sort.Search(len(l.shares), func(i int) bool { return l.shares[i] > pick })
+	return l.generator.GenerateQuery(l.kinds[i], l.random)
+}
+
+// RecordQuery records the latency of a query of the query load
+func RecordQuery(kind QueryKind, latency time.Duration, success bool) {
+	outcome := "success"
+	if !success {
+		outcome = "error"
+	}
+	queryLatencySeconds.WithLabelValues(string(kind), outcome).Observe(latency.Seconds())
+	summary.addQuery(kind, float64(latency.Microseconds()), success)
+}
+
+var queryLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "query_latency_seconds",
+	Help:    "Time in seconds a query of the query load took, by query and outcome",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"query", "outcome"})
@@ -0,0 +1,116 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// queryRecorder is a QueryDestination recording the queries it runs, failing those of failing kinds
+type queryRecorder struct {
+	mu      sync.Mutex
+	queries map[QueryKind][]string
+	failing QueryKind
+}
+
+func (r *queryRecorder) RunQuery(_ context.Context, q Query) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries[q.Kind] = append(r.queries[q.Kind], q.Param)
+	if q.Kind == r.failing {
+		return errors.New("query failed")
+	}
+	return nil
+}
+
+func TestGenerator_GenerateQuery(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	g := NewGenerator(DocumentSpec{BatchSize: 10, IdMode: "sequential", NumClusters: 3, Seed: 1})
+	assert.True(t, g.spec.SupportsQuery(PointLookup))
+
+	// No documents to look up yet
+	_, ok := g.GenerateQuery(PointLookup, random)
+	assert.False(t, ok)
+	docs, err := g.GenerateDocs()
+	assert.Nil(t, err)
+	g.acknowledge(docIDs(docs), true)
+	q, ok := g.GenerateQuery(PointLookup, random)
+	assert.True(t, ok)
+	assert.Regexp(t, "^[0-9]+$", q.Param)
+
+	q, ok = g.GenerateQuery(ClusterFilter, random)
+	assert.True(t, ok)
+	assert.Regexp(t, "^[0-2]@gmail.com$", q.Param)
+
+	q, ok = g.GenerateQuery(CitySearch, random)
+	assert.True(t, ok)
+	assert.Contains(t, []string{"SF", "San Mateo", "San Jose", "Mountain View", "Menlo Park", "Palo Alto"}, q.Param)
+
+	q, ok = g.GenerateQuery(CompanyAggregation, random)
+	assert.True(t, ok)
+	assert.Equal(t, Query{Kind: CompanyAggregation}, q)
+
+	schema, err := CompileSchema(SchemaSpec{Fields: []FieldSpec{
+		{Name: "Company", Type: "int"},
+		{Name: "Address", Type: "object", Fields: []FieldSpec{{Name: "City", Type: "string"}}},
+	}})
+	assert.Nil(t, err)
+	g = NewGenerator(DocumentSpec{BatchSize: 10, IdMode: "uuid", NumClusters: -1, Schema: schema})
+	for _, kind := range QueryKinds {
+		assert.False(t, g.spec.SupportsQuery(kind), "%s", kind)
+		_, ok = g.GenerateQuery(kind, random)
+		assert.False(t, ok, "%s", kind)
+	}
+}
+
+func TestGenerator_GenerateQuery_KeepsSeed(t *testing.T) {
+	// Point lookups must not change the ids a seed deletes
+	deletes := func(queries int) []string {
+		g := NewGenerator(DocumentSpec{BatchSize: 100, IdMode: "sequential", Seed: 1})
+		docs, err := g.GenerateDocs()
+		assert.Nil(t, err)
+		g.acknowledge(docIDs(docs), true)
+		random := rand.New(rand.NewSource(2))
+		for i := 0; i < queries; i++ {
+			_, ok := g.GenerateQuery(PointLookup, random)
+			assert.True(t, ok)
+		}
+		ids, err := g.GenerateDeletes(10)
+		assert.Nil(t, err)
+		return ids
+	}
+	assert.Equal(t, deletes(0), deletes(20))
+}
+
+func TestQueryLoad_Run(t *testing.T) {
+	StartRun(RunInfo{GeneratorIdentifier: "test"})
+	g := NewGenerator(DocumentSpec{BatchSize: 10, IdMode: "uuid", NumClusters: 3})
+	load := NewQueryLoad(g, map[QueryKind]int{ClusterFilter: 3, CompanyAggregation: 1, CitySearch: 0}, 2)
+	assert.Equal(t, "city_search, cluster_filter, company_aggregation", load.String())
+	d := &queryRecorder{queries: make(map[QueryKind][]string), failing: CompanyAggregation}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	load.Run(ctx, d, 1000)
+
+	filters, aggregations := len(d.queries[ClusterFilter]), len(d.queries[CompanyAggregation])
+	assert.Greater(t, filters, aggregations)
+	assert.Greater(t, aggregations, 0)
+	assert.Empty(t, d.queries[CitySearch])
+
+	r := BuildReport()
+	assert.Len(t, r.Queries, 2)
+	assert.Equal(t, ClusterFilter, r.Queries[0].Query)
+	assert.Equal(t, int64(filters), r.Queries[0].Completed)
+	assert.Equal(t, filters, r.Queries[0].Latency.Samples)
+	assert.Equal(t, CompanyAggregation, r.Queries[1].Query)
+	// Failures cut short by the end of the run aren't recorded
+	assert.Greater(t, r.Queries[1].Errored, int64(0))
+	assert.LessOrEqual(t, r.Queries[1].Errored, int64(aggregations))
+	assert.Contains(t, r.Markdown(), "## Queries")
+}
@@ -0,0 +1,171 @@
+package generator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RateController paces batches evenly across each second and caps the number of batches in flight.
+//
+// Instead of firing every batch for a second at once, a batch becomes due every 1s/rate. A batch is only started once a
+// slot is free, so a slow destination causes the achieved rate to fall below the target rather than piling up goroutines.
+type RateController struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// last is when the latest batch was due
+	last time.Time
+	// changed is closed when the rate changes, waking up Acquire to reschedule the batch it's waiting for
+	changed chan struct{}
+
+	inFlight  chan struct{}
+	wg        sync.WaitGroup
+	completed int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRateController creates a RateController issuing rate batches per second with at most maxInFlight outstanding.
+// Stop must be called to release the goroutine reporting the achieved rate.
+func NewRateController(rate float64, maxInFlight int) *RateController {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	rc := &RateController{
+		changed:  make(chan struct{}),
+		inFlight: make(chan struct{}, maxInFlight),
+		stop:     make(chan struct{}),
+	}
+	rc.SetRate(rate)
+	go rc.reportAchievedRate()
+
+	return rc
+}
+
+// SetRate changes the target to rate batches per second, which may be fractional. A batch Acquire is waiting for is
+// rescheduled to one new interval after the previous one, so the change takes effect right away.
+func (rc *RateController) SetRate(rate float64) {
+	if rate <= 0 {
+		rate = 1
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+
+	rc.mu.Lock()
+	rc.interval = interval
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	rc.mu.Unlock()
+	targetBatchesPerSecond.Set(rate)
+}
+
+// Acquire blocks until the next batch is due and an in-flight slot is free.
+// It returns false if done is closed first, in which case Release must not be called.
+func (rc *RateController) Acquire(done <-chan struct{}) bool {
+	rc.mu.Lock()
+	now := time.Now()
+	previous := rc.last
+	due := previous.Add(rc.interval)
+	// Don't burst to catch up if we fell more than a second behind schedule, just start pacing again from now
+	if previous.IsZero() || now.Sub(due) > time.Second {
+		due = now
+	}
+	rc.last = due
+	changed := rc.changed
+	rc.mu.Unlock()
+
+	for wait := time.Until(due); wait > 0; wait = time.Until(due) {
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+			rc.mu.Lock()
+			due = previous.Add(rc.interval)
+			rc.last = due
+			changed = rc.changed
+			rc.mu.Unlock()
+		}
+	}
+
+	select {
+	case <-done:
+		return false
+	case rc.inFlight <- struct{}{}:
+	}
+	rc.wg.Add(1)
+	batchesInFlight.Inc()
+	return true
+}
+
+// Release marks a batch started by Acquire as finished.
+func (rc *RateController) Release() {
+	<-rc.inFlight
+	batchesInFlight.Dec()
+	atomic.AddInt64(&rc.completed, 1)
+	rc.wg.Done()
+}
+
+// Drain waits up to timeout for every batch started by Acquire to be released.
+// It returns false if batches are still in flight when the timeout expires. Acquire must not be called concurrently.
+func (rc *RateController) Drain(timeout time.Duration) bool {
+	drained := make(chan struct{})
+	go func() {
+		rc.wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Stop stops reporting the achieved rate.
+func (rc *RateController) Stop() {
+	rc.stopOnce.Do(func() {
+		close(rc.stop)
+	})
+}
+
+func (rc *RateController) reportAchievedRate() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-rc.stop:
+			return
+		case <-t.C:
+			achievedBatchesPerSecond.Set(float64(atomic.SwapInt64(&rc.completed, 0)))
+		}
+	}
+}
+
+var (
+	targetBatchesPerSecond = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "target_batches_per_second",
+		Help: "The number of batches per second the generator is trying to send",
+	})
+
+	achievedBatchesPerSecond = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "achieved_batches_per_second",
+		Help: "The number of batches completed by the Destination in the last second",
+	})
+
+	batchesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "batches_in_flight",
+		Help: "The number of batches sent to the Destination that have not completed yet",
+	})
+)
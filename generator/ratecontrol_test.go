@@ -0,0 +1,70 @@
+package generator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateController_LimitsInFlight(t *testing.T) {
+	rc := NewRateController(1000, 2)
+	defer rc.Stop()
+
+	done := make(chan struct{})
+	assert.True(t, rc.Acquire(done))
+	assert.True(t, rc.Acquire(done))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- rc.Acquire(done)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired more slots than allowed in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rc.Release()
+	assert.True(t, <-acquired)
+
+	close(done)
+	assert.False(t, rc.Acquire(done))
+}
+
+func TestRateController_Paces(t *testing.T) {
+	rc := NewRateController(100, 10)
+	defer rc.Stop()
+
+	done := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.True(t, rc.Acquire(done))
+		rc.Release()
+	}
+
+	// The first batch is due immediately, the following nine are spaced 10ms apart
+	assert.GreaterOrEqual(t, time.Since(start), 85*time.Millisecond)
+}
+
+func TestRateController_SetRate(t *testing.T) {
+	rc := NewRateController(1, 10)
+	defer rc.Stop()
+
+	done := make(chan struct{})
+	assert.True(t, rc.Acquire(done))
+	rc.Release()
+
+	// The next batch is due in a second, raising the rate while waiting for it brings it forward
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rc.SetRate(50)
+	}()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.True(t, rc.Acquire(done))
+		rc.Release()
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
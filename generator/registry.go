@@ -0,0 +1,278 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration describes a destination to the registry: how to create it, the options it is configured with and
+// the optional operations it supports.
+//
+// Destinations register themselves from an init function, so adding one doesn't require changes anywhere else.
+// Destinations in other packages are made available by importing their package for its side effects.
+type Registration struct {
+	// Name selects the destination with DESTINATION and names its section of the config file. Lower case.
+	Name string
+	// Options are the settings of the destination
+	Options []Option
+	// Capabilities are the optional operations the destination supports
+	Capabilities Capabilities
+	// PatchEncoder renders patches for the destination. Destinations with an encoder support patches.
+	PatchEncoder PatchEncoder
+	// New creates the destination. Options are validated and defaulted before it is called.
+	New func(s Settings) (Destination, error)
+}
+
+// Capabilities are the optional operations a destination supports
+type Capabilities struct {
+	// Patches is whether SendPatch is implemented, set by Register if the destination has a PatchEncoder
+	Patches bool
+	// Deletes is whether the destination implements DeleteDestination
+	Deletes bool
+	// LatencyQuery is whether GetLatestTimestamp is implemented, so e2e latency can be tracked
+	LatencyQuery bool
+	// PatchLatencyQuery is whether the destination implements PatchLatencyDestination, so patch latency can be tracked
+	PatchLatencyQuery bool
+	// VisibilityQuery is whether the destination implements VisibilityDestination, so documents can be traced
+	VisibilityQuery bool
+	// Queries is whether the destination implements QueryDestination, so a query load can run alongside the writes
+	Queries bool
+}
+
+// OptionType is how the value of an option is parsed
+type OptionType int
+
+const (
+	StringOption OptionType = iota
+	IntOption
+	BoolOption
+	DurationOption
+)
+
+// Option is a setting of a destination
+type Option struct {
+	// Name is the key of the option in the section of the destination in the config file
+	Name string
+	// Env is the environment variable overriding the value from the config file
+	Env string
+	// Type is how the value is parsed, StringOption by default
+	Type OptionType
+	// Default is used if the option is not set
+	Default string
+	// Required options must be set to a non-empty value
+	Required bool
+	// Secret options are redacted when the configuration is printed
+	Secret bool
+	// NeedsRetries options only take effect if requests are retried, so setting them without retries is an error
+	NeedsRetries bool
+	// Validate optionally checks the value further once it is parsed
+	Validate func(value string) error
+}
+
+// Settings are what a destination is created with
+type Settings struct {
+	GeneratorIdentifier string
+	Client              *http.Client
+	Retry               RetryPolicy
+	Options             Options
+}
+
+// Options are the values of the options of a destination, by option name
+type Options map[string]string
+
+// String returns the value of an option
+func (o Options) String(name string) string {
+	return o[name]
+}
+
+// Int returns the value of an IntOption, options are validated before a destination is created
+func (o Options) Int(name string) int {
+	i, _ := strconv.Atoi(o[name])
+	return i
+}
+
+// Bool returns the value of a BoolOption, options are validated before a destination is created
+func (o Options) Bool(name string) bool {
+	b, _ := strconv.ParseBool(o[name])
+	return b
+}
+
+// Duration returns the value of a DurationOption, options are validated before a destination is created
+func (o Options) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(o[name])
+	return d
+}
+
+// Timeouts returns the timeouts defined by TimeoutOptions
+func (o Options) Timeouts() Timeouts {
+	return Timeouts{
+		Write:     o.Duration("write_timeout"),
+		Query:     o.Duration("query_timeout"),
+		Configure: o.Duration("configure_timeout"),
+	}
+}
+
+// TimeoutOptions are the options of the per-operation timeouts of a destination, read from the env variables
+// <prefix>_WRITE_TIMEOUT, <prefix>_QUERY_TIMEOUT and <prefix>_CONFIGURE_TIMEOUT
+func TimeoutOptions(prefix string) []Option {
+	return []Option{
+		{Name: "write_timeout", Env: prefix + "_WRITE_TIMEOUT", Type: DurationOption, Default: DefaultTimeouts.Write.String()},
+		{Name: "query_timeout", Env: prefix + "_QUERY_TIMEOUT", Type: DurationOption, Default: DefaultTimeouts.Query.String()},
+		{Name: "configure_timeout", Env: prefix + "_CONFIGURE_TIMEOUT", Type: DurationOption, Default: DefaultTimeouts.Configure.String()},
+	}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Registration)
+)
+
+// Register makes a destination available by name. It panics if the name is taken or the registration is incomplete,
+// as that is a programming error.
+func Register(r Registration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if r.Name == "" || r.Name != strings.ToLower(r.Name) {
+		panic(fmt.Sprintf("destination name %q must be lower case and not empty", r.Name))
+	}
+	if r.New == nil {
+		panic(fmt.Sprintf("destination %s has no factory", r.Name))
+	}
+	if r.Capabilities.Patches && r.PatchEncoder == nil {
+		panic(fmt.Sprintf("destination %s supports patches but has no patch encoder", r.Name))
+	}
+	r.Capabilities.Patches = r.PatchEncoder != nil
+	if _, exists := registry[r.Name]; exists {
+		panic(fmt.Sprintf("destination %s is registered twice", r.Name))
+	}
+	registry[r.Name] = r
+}
+
+// Lookup returns the registration of a destination
+func Lookup(name string) (Registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	r, ok := registry[name]
+	return r, ok
+}
+
+// Registered returns the names of all registered destinations, sorted
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithDefaults returns a copy of values with the defaults of the options that are not set filled in
+func (r Registration) WithDefaults(values map[string]string) Options {
+	o := make(Options, len(values))
+	for k, v := range values {
+		o[k] = v
+	}
+	for _, opt := range r.Options {
+		if _, found := o[opt.Name]; !found && opt.Default != "" {
+			o[opt.Name] = opt.Default
+		}
+	}
+	return o
+}
+
+// ValidateOptions returns every problem with the values of the options of the destination
+func (r Registration) ValidateOptions(values map[string]string) []string {
+	var problems []string
+	known := make(map[string]bool, len(r.Options))
+	for _, opt := range r.Options {
+		known[opt.Name] = true
+		name := opt.Name
+		if opt.Env != "" {
+			name = opt.Env
+		}
+
+		v, found := values[opt.Name]
+		if !found || v == "" {
+			if opt.Required {
+				problems = append(problems, fmt.Sprintf("%s must be set", name))
+			}
+			continue
+		}
+		if err := opt.parse(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %v", name, err))
+			continue
+		}
+		if opt.Validate != nil {
+			if err := opt.Validate(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %v", name, err))
+			}
+		}
+	}
+
+	// Typos would otherwise be silently ignored
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, fmt.Sprintf("unknown option %q for destination %s", name, r.Name))
+		}
+	}
+	sort.Strings(unknown)
+	return append(problems, unknown...)
+}
+
+// parse checks that v is a valid value for the type of the option
+func (opt Option) parse(v string) error {
+	switch opt.Type {
+	case IntOption:
+		if _, err := strconv.Atoi(v); err != nil {
+			return errors.New("is not integer!")
+		}
+	case BoolOption:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return errors.New("is not bool!")
+		}
+	case DurationOption:
+		if _, err := time.ParseDuration(v); err != nil {
+			return errors.New("is not a duration!")
+		}
+	}
+	return nil
+}
+
+// NewDestination creates the named destination, validating its options and filling in their defaults first
+func NewDestination(name string, s Settings) (Destination, error) {
+	r, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unsupported destination %q, supported options are %s", name, strings.Join(Registered(), ", "))
+	}
+	s.Options = r.WithDefaults(s.Options)
+	if problems := r.ValidateOptions(s.Options); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid options for destination %s: %s", name, strings.Join(problems, "; "))
+	}
+	d, err := r.New(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.(DeleteDestination); r.Capabilities.Deletes && !ok {
+		return nil, fmt.Errorf("destination %s supports deletes but does not implement DeleteDestination", name)
+	}
+	if _, ok := d.(PatchLatencyDestination); r.Capabilities.PatchLatencyQuery && !ok {
+		return nil, fmt.Errorf("destination %s supports patch latency queries but does not implement PatchLatencyDestination", name)
+	}
+	if _, ok := d.(VisibilityDestination); r.Capabilities.VisibilityQuery && !ok {
+		return nil, fmt.Errorf("destination %s supports visibility queries but does not implement VisibilityDestination", name)
+	}
+	if _, ok := d.(QueryDestination); r.Capabilities.Queries && !ok {
+		return nil, fmt.Errorf("destination %s supports queries but does not implement QueryDestination", name)
+	}
+	return d, nil
+}
@@ -0,0 +1,54 @@
+package generator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Builtins(t *testing.T) {
+	assert.Equal(t, []string{"elastic", "null", "rockset", "snowflake"}, Registered())
+
+	r, ok := Lookup("rockset")
+	assert.True(t, ok)
+	assert.True(t, r.Capabilities.Patches)
+	r, ok = Lookup("snowflake")
+	assert.True(t, ok)
+	assert.False(t, r.Capabilities.Patches)
+	r, ok = Lookup("null")
+	assert.True(t, ok)
+	assert.True(t, r.Capabilities.Patches)
+	_, ok = Lookup("mongo")
+	assert.False(t, ok)
+}
+
+func TestRegistry_RegisterTwice(t *testing.T) {
+	assert.Panics(t, func() {
+		Register(Registration{Name: "null", New: func(s Settings) (Destination, error) { return &Null{}, nil }})
+	})
+}
+
+func TestNewDestination(t *testing.T) {
+	d, err := NewDestination("rockset", Settings{
+		GeneratorIdentifier: "test",
+		Options: Options{
+			"api_key":       "key",
+			"api_server":    "https://api.usw2a1.rockset.com",
+			"collection":    "commons.bench",
+			"query_timeout": "5s",
+		},
+	})
+	assert.Nil(t, err)
+	r := d.(*Rockset)
+	assert.Equal(t, "commons.bench", r.CollectionPath)
+	assert.Equal(t, Timeouts{Write: time.Minute, Query: 5 * time.Second, Configure: 5 * time.Minute}, r.Timeouts)
+
+	_, err = NewDestination("rockset", Settings{Options: Options{"collection": "bench", "write_timeout": "soon"}})
+	assert.EqualError(t, err, "invalid options for destination rockset: ROCKSET_API_KEY must be set; "+
+		"ROCKSET_API_SERVER must be set; ROCKSET_COLLECTION should have the format <workspace_name>.<collection_name>; "+
+		"ROCKSET_WRITE_TIMEOUT is not a duration!")
+
+	_, err = NewDestination("mongo", Settings{})
+	assert.EqualError(t, err, `unsupported destination "mongo", supported options are elastic, null, rockset, snowflake`)
+}
@@ -0,0 +1,481 @@
+package generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunInfo describes the run a report is generated for. Workload is the custom mix of operations, in the format of the
+// WORKLOAD env variable, if one was used instead of a mode.
+type RunInfo struct {
+	GeneratorIdentifier string `json:"generator_identifier"`
+	Destination         string `json:"destination"`
+	Mode                string `json:"mode"`
+	Workload            string `json:"workload,omitempty"`
+	DocSize             string `json:"doc_size,omitempty"`
+	WPS                 int    `json:"wps"`
+	BatchSize           int    `json:"batch_size"`
+}
+
+// LatencyReport summarizes the latency samples taken during a run, in milliseconds
+type LatencyReport struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+	Max     float64 `json:"max_ms"`
+}
+
+// Report is the end-of-run summary of a benchmark. PatchLatency is the latency of patches, measured apart from the
+// E2ELatency of documents written. VisibilityLatency is the latency of every traced document found,
+// ProbesNeverObserved those given up on after TRACE_TIMEOUT and ProbesPending those still looked for at the end.
+// LatencySamplesDiscarded are the e2e and patch latency samples discarded because of clock skew. Queries summarize the
+// query load by kind of query.
+type Report struct {
+	RunInfo
+	StartTime        time.Time       `json:"start_time"`
+	EndTime          time.Time       `json:"end_time"`
+	DurationSeconds  float64         `json:"duration_seconds"`
+	DocsWritten      int64           `json:"docs_written"`
+	WritesErrored    int64           `json:"writes_errored"`
+	PatchesCompleted int64           `json:"patches_completed"`
+	PatchesErrored   int64           `json:"patches_errored"`
+	DeletesCompleted int64           `json:"deletes_completed"`
+	DeletesErrored   int64           `json:"deletes_errored"`
+	WritesPerSecond  float64         `json:"writes_per_second"`
+	PatchesPerSecond float64         `json:"patches_per_second"`
+	DeletesPerSecond float64         `json:"deletes_per_second"`
+	BytesSent        int64           `json:"bytes_sent"`
+	MBPerSecond      float64         `json:"mb_per_second"`
+	E2ELatency       LatencyReport   `json:"e2e_latency"`
+	Phases           []PhaseReport   `json:"phases,omitempty"`
+	Capacity         *CapacityReport `json:"capacity_search,omitempty"`
+
+	PatchLatency        LatencyReport `json:"patch_latency"`
+	VisibilityLatency   LatencyReport `json:"visibility_latency"`
+	ProbesSent          int64         `json:"probes_sent"`
+	ProbesNeverObserved int64         `json:"probes_never_observed"`
+	ProbesPending       int64         `json:"probes_pending"`
+
+	LatencySamplesDiscarded int64         `json:"latency_samples_discarded"`
+	Queries                 []QueryReport `json:"queries,omitempty"`
+}
+
+// QueryReport summarizes the queries of a kind run by the query load
+type QueryReport struct {
+	Query     QueryKind     `json:"query"`
+	Completed int64         `json:"completed"`
+	Errored   int64         `json:"errored"`
+	PerSecond float64       `json:"per_second"`
+	Latency   LatencyReport `json:"latency"`
+}
+
+// PhaseReport summarizes a phase of a scheduled run. FromRate is only set for ramps.
+type PhaseReport struct {
+	Name             string        `json:"name"`
+	StartTime        time.Time     `json:"start_time"`
+	EndTime          time.Time     `json:"end_time"`
+	FromRate         float64       `json:"from_rate,omitempty"`
+	TargetRate       float64       `json:"target_rate"`
+	DocsWritten      int64         `json:"docs_written"`
+	PatchesCompleted int64         `json:"patches_completed"`
+	DeletesCompleted int64         `json:"deletes_completed"`
+	E2ELatency       LatencyReport `json:"e2e_latency"`
+}
+
+// latencySample is an e2e latency in microseconds and when it was measured
+type latencySample struct {
+	at      time.Time
+	latency float64
+}
+
+// phaseStart is a phase and the totals of the run when it started
+type phaseStart struct {
+	Phase
+	start            time.Time
+	writesCompleted  float64
+	patchesCompleted float64
+	deletesCompleted float64
+}
+
+// runSummary accumulates the totals recorded alongside the Prometheus metrics
+type runSummary struct {
+	mu               sync.Mutex
+	info             RunInfo
+	start            time.Time
+	writesCompleted  float64
+	writesErrored    float64
+	patchesCompleted float64
+	patchesErrored   float64
+	deletesCompleted float64
+	deletesErrored   float64
+	bytesSent        float64
+	e2eLatencies     []latencySample
+	phases           []phaseStart
+	capacity         *CapacityReport
+
+	// patchLatencies are the patch latencies measured, in microseconds
+	patchLatencies []float64
+	// visibilityLatencies are the latencies of traced documents, in microseconds
+	visibilityLatencies []float64
+	probesSent          float64
+	probesNeverObserved float64
+	probesPending       float64
+
+	latencySamplesDiscarded float64
+	// queryLatencies are the latencies of the queries completed, in microseconds, and queriesErrored the number of
+	// queries which errored, by kind
+	queryLatencies map[QueryKind][]float64
+	queriesErrored map[QueryKind]float64
+}
+
+var summary = &runSummary{start: time.Now()}
+
+// StartRun resets the run summary and marks the start of the run.
+func StartRun(info RunInfo) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.info = info
+	summary.start = time.Now()
+	summary.writesCompleted = 0
+	summary.writesErrored = 0
+	summary.patchesCompleted = 0
+	summary.patchesErrored = 0
+	summary.deletesCompleted = 0
+	summary.deletesErrored = 0
+	summary.bytesSent = 0
+	summary.e2eLatencies = nil
+	summary.patchLatencies = nil
+	summary.visibilityLatencies = nil
+	summary.probesSent = 0
+	summary.probesNeverObserved = 0
+	summary.probesPending = 0
+	summary.latencySamplesDiscarded = 0
+	summary.queryLatencies = nil
+	summary.queriesErrored = nil
+	summary.phases = nil
+	summary.capacity = nil
+}
+
+func (s *runSummary) add(total *float64, count float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*total += count
+}
+
+func (s *runSummary) addE2ELatency(latency float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.e2eLatencies = append(s.e2eLatencies, latencySample{at: time.Now(), latency: latency})
+}
+
+func (s *runSummary) addPatchLatency(latency float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patchLatencies = append(s.patchLatencies, latency)
+}
+
+func (s *runSummary) addVisibilityLatency(latency float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.visibilityLatencies = append(s.visibilityLatencies, latency)
+}
+
+func (s *runSummary) addQuery(kind QueryKind, latency float64, success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queryLatencies == nil {
+		s.queryLatencies = make(map[QueryKind][]float64)
+		s.queriesErrored = make(map[QueryKind]float64)
+	}
+	if success {
+		s.queryLatencies[kind] = append(s.queryLatencies[kind], latency)
+	} else {
+		s.queriesErrored[kind]++
+	}
+}
+
+func (s *runSummary) setProbesPending(pending int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probesPending = float64(pending)
+}
+
+// totals returns the number of documents written, patched or deleted so far, and of those that errored
+func (s *runSummary) totals() (float64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writesCompleted + s.patchesCompleted + s.deletesCompleted, s.writesErrored + s.patchesErrored + s.deletesErrored
+}
+
+// latenciesBetween returns the e2e latencies measured from start up to end
+func (s *runSummary) latenciesBetween(start time.Time, end time.Time) []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latenciesBetween(s.e2eLatencies, start, end)
+}
+
+func recordCapacity(r CapacityReport) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.capacity = &r
+}
+
+// startPhase marks the start of phase p, which ends the previous one
+func startPhase(p Phase) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.phases = append(summary.phases, phaseStart{
+		Phase:            p,
+		start:            time.Now(),
+		writesCompleted:  summary.writesCompleted,
+		patchesCompleted: summary.patchesCompleted,
+		deletesCompleted: summary.deletesCompleted,
+	})
+}
+
+// BuildReport summarizes the run so far.
+func BuildReport() Report {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+
+	end := time.Now()
+	duration := end.Sub(summary.start).Seconds()
+	r := Report{
+		RunInfo:          summary.info,
+		StartTime:        summary.start,
+		EndTime:          end,
+		DurationSeconds:  duration,
+		DocsWritten:      int64(summary.writesCompleted),
+		WritesErrored:    int64(summary.writesErrored),
+		PatchesCompleted: int64(summary.patchesCompleted),
+		PatchesErrored:   int64(summary.patchesErrored),
+		DeletesCompleted: int64(summary.deletesCompleted),
+		DeletesErrored:   int64(summary.deletesErrored),
+		BytesSent:        int64(summary.bytesSent),
+		E2ELatency:       summarizeLatencies(latenciesBetween(summary.e2eLatencies, summary.start, end)),
+		Capacity:         summary.capacity,
+
+		PatchLatency:        summarizeLatencies(summary.patchLatencies),
+		VisibilityLatency:   summarizeLatencies(summary.visibilityLatencies),
+		ProbesSent:          int64(summary.probesSent),
+		ProbesNeverObserved: int64(summary.probesNeverObserved),
+		ProbesPending:       int64(summary.probesPending),
+
+		LatencySamplesDiscarded: int64(summary.latencySamplesDiscarded),
+	}
+	for i, p := range summary.phases {
+		// A phase ends when the next one starts, the last one is cut short by the end of the run
+		next := phaseStart{
+			start:            end,
+			writesCompleted:  summary.writesCompleted,
+			patchesCompleted: summary.patchesCompleted,
+			deletesCompleted: summary.deletesCompleted,
+		}
+		if i+1 < len(summary.phases) {
+			next = summary.phases[i+1]
+		}
+		r.Phases = append(r.Phases, PhaseReport{
+			Name:             p.Name,
+			StartTime:        p.start,
+			EndTime:          next.start,
+			FromRate:         p.From,
+			TargetRate:       p.Rate,
+			DocsWritten:      int64(next.writesCompleted - p.writesCompleted),
+			PatchesCompleted: int64(next.patchesCompleted - p.patchesCompleted),
+			DeletesCompleted: int64(next.deletesCompleted - p.deletesCompleted),
+			E2ELatency:       summarizeLatencies(latenciesBetween(summary.e2eLatencies, p.start, next.start)),
+		})
+	}
+	for _, kind := range QueryKinds {
+		latencies, errored := summary.queryLatencies[kind], summary.queriesErrored[kind]
+		if len(latencies) == 0 && errored == 0 {
+			continue
+		}
+		q := QueryReport{
+			Query:     kind,
+			Completed: int64(len(latencies)),
+			Errored:   int64(errored),
+			Latency:   summarizeLatencies(latencies),
+		}
+		if duration > 0 {
+			q.PerSecond = float64(len(latencies)) / duration
+		}
+		r.Queries = append(r.Queries, q)
+	}
+	if duration > 0 {
+		r.WritesPerSecond = summary.writesCompleted / duration
+		r.PatchesPerSecond = summary.patchesCompleted / duration
+		r.DeletesPerSecond = summary.deletesCompleted / duration
+		r.MBPerSecond = summary.bytesSent / duration / 1e6
+	}
+
+	return r
+}
+
+// latenciesBetween returns the latencies of the samples measured from start up to end
+func latenciesBetween(samples []latencySample, start time.Time, end time.Time) []float64 {
+	var latencies []float64
+	for _, s := range samples {
+		if !s.at.Before(start) && s.at.Before(end) {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	return latencies
+}
+
+// summarizeLatencies computes nearest-rank percentiles of latencies given in microseconds
+func summarizeLatencies(latencies []float64) LatencyReport {
+	if len(latencies) == 0 {
+		return LatencyReport{}
+	}
+
+	sorted := make([]float64, len(latencies))
+	copy(sorted, latencies)
+	sort.Float64s(sorted)
+
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return sorted[rank] / 1000
+	}
+
+	return LatencyReport{
+		Samples: len(sorted),
+		P50:     percentile(0.5),
+		P95:     percentile(0.95),
+		P99:     percentile(0.99),
+		Max:     sorted[len(sorted)-1] / 1000,
+	}
+}
+
+// Markdown renders the report as a Markdown table.
+func (r Report) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# RockBench run %s\n\n", r.GeneratorIdentifier)
+	b.WriteString("| metric | value |\n")
+	b.WriteString("| ------ | ----- |\n")
+	row := func(name string, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "| %s | %s |\n", name, fmt.Sprintf(format, args...))
+	}
+	row("destination", "%s", r.Destination)
+	row("mode", "%s", r.Mode)
+	if r.Workload != "" {
+		row("workload", "%s", r.Workload)
+	}
+	if r.DocSize != "" {
+		row("doc size", "%s", r.DocSize)
+	}
+	row("wps", "%d", r.WPS)
+	row("batch size", "%d", r.BatchSize)
+	row("start", "%s", r.StartTime.Format(time.RFC3339))
+	row("end", "%s", r.EndTime.Format(time.RFC3339))
+	row("duration", "%.1fs", r.DurationSeconds)
+	row("docs written", "%d", r.DocsWritten)
+	row("writes errored", "%d", r.WritesErrored)
+	row("patches completed", "%d", r.PatchesCompleted)
+	row("patches errored", "%d", r.PatchesErrored)
+	row("deletes completed", "%d", r.DeletesCompleted)
+	row("deletes errored", "%d", r.DeletesErrored)
+	row("writes/s", "%.1f", r.WritesPerSecond)
+	row("patches/s", "%.1f", r.PatchesPerSecond)
+	row("deletes/s", "%.1f", r.DeletesPerSecond)
+	row("bytes sent", "%d", r.BytesSent)
+	row("MB/s", "%.2f", r.MBPerSecond)
+	row("e2e latency samples", "%d", r.E2ELatency.Samples)
+	row("e2e latency p50", "%.1fms", r.E2ELatency.P50)
+	row("e2e latency p95", "%.1fms", r.E2ELatency.P95)
+	row("e2e latency p99", "%.1fms", r.E2ELatency.P99)
+	row("e2e latency max", "%.1fms", r.E2ELatency.Max)
+	if r.LatencySamplesDiscarded > 0 {
+		row("latency samples discarded", "%d", r.LatencySamplesDiscarded)
+	}
+	if r.PatchLatency.Samples > 0 {
+		row("patch latency samples", "%d", r.PatchLatency.Samples)
+		row("patch latency p50", "%.1fms", r.PatchLatency.P50)
+		row("patch latency p95", "%.1fms", r.PatchLatency.P95)
+		row("patch latency p99", "%.1fms", r.PatchLatency.P99)
+		row("patch latency max", "%.1fms", r.PatchLatency.Max)
+	}
+	if r.ProbesSent > 0 {
+		row("probes sent", "%d", r.ProbesSent)
+		row("probes never observed", "%d", r.ProbesNeverObserved)
+		row("probes pending", "%d", r.ProbesPending)
+		row("visibility latency p50", "%.1fms", r.VisibilityLatency.P50)
+		row("visibility latency p99", "%.1fms", r.VisibilityLatency.P99)
+		row("visibility latency max", "%.1fms", r.VisibilityLatency.Max)
+	}
+
+	if len(r.Phases) > 0 {
+		b.WriteString("\n## Phases\n\n")
+		b.WriteString("| phase | start | duration | target rate | docs written | patches | deletes | e2e samples | e2e p50 | e2e p95 | e2e max |\n")
+		b.WriteString("| ----- | ----- | -------- | ----------- | ------------ | ------- | ------- | ----------- | ------- | ------- | ------- |\n")
+		for _, p := range r.Phases {
+			rate := fmt.Sprintf("%.1f", p.TargetRate)
+			if p.FromRate > 0 {
+				rate = fmt.Sprintf("%.1f → %.1f", p.FromRate, p.TargetRate)
+			}
+			fmt.Fprintf(&b, "| %s | %s | %.1fs | %s | %d | %d | %d | %d | %.1fms | %.1fms | %.1fms |\n",
+				p.Name, p.StartTime.Format(time.RFC3339), p.EndTime.Sub(p.StartTime).Seconds(), rate, p.DocsWritten,
+				p.PatchesCompleted, p.DeletesCompleted, p.E2ELatency.Samples, p.E2ELatency.P50, p.E2ELatency.P95,
+				p.E2ELatency.Max)
+		}
+	}
+
+	if len(r.Queries) > 0 {
+		b.WriteString("\n## Queries\n\n")
+		b.WriteString("| query | completed | errored | queries/s | p50 | p95 | p99 | max |\n")
+		b.WriteString("| ----- | --------- | ------- | --------- | --- | --- | --- | --- |\n")
+		for _, q := range r.Queries {
+			fmt.Fprintf(&b, "| %s | %d | %d | %.1f | %.1fms | %.1fms | %.1fms | %.1fms |\n", q.Query, q.Completed,
+				q.Errored, q.PerSecond, q.Latency.P50, q.Latency.P95, q.Latency.P99, q.Latency.Max)
+		}
+	}
+
+	if c := r.Capacity; c != nil {
+		b.WriteString("\n## Capacity search\n\n")
+		fmt.Fprintf(&b, "Max sustainable rate: %.1f batches/s (%.1f docs/s) with p95 e2e latency under %.1fms and "+
+			"error rate under %.3f, found by %s search.\n\n", c.MaxSustainableRate, c.MaxSustainableDocsPerSecond,
+			c.LatencySLO, c.MaxErrorRate, c.Strategy)
+		b.WriteString("| rate | achieved | error rate | e2e samples | e2e p95 | passed |\n")
+		b.WriteString("| ---- | -------- | ---------- | ----------- | ------- | ------ |\n")
+		for _, t := range c.Trials {
+			passed := "yes"
+			if !t.Passed {
+				passed = "no, " + t.Reason
+			}
+			fmt.Fprintf(&b, "| %.1f | %.1f | %.3f | %d | %.1fms | %s |\n",
+				t.Rate, t.AchievedRate, t.ErrorRate, t.E2ELatency.Samples, t.E2ELatency.P95, passed)
+		}
+	}
+
+	return b.String()
+}
+
+// WriteReport writes the report for the run so far to path.json and path.md.
+func WriteReport(path string) error {
+	path = strings.TrimSuffix(path, filepath.Ext(path))
+	r := BuildReport()
+
+	j, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	if err := os.WriteFile(path+".json", append(j, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.WriteFile(path+".md", []byte(r.Markdown()), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package generator
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	latencies := make([]float64, 0, 100)
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, float64(i*1000))
+	}
+
+	r := summarizeLatencies(latencies)
+	assert.Equal(t, 100, r.Samples)
+	assert.Equal(t, 50.0, r.P50)
+	assert.Equal(t, 95.0, r.P95)
+	assert.Equal(t, 99.0, r.P99)
+	assert.Equal(t, 100.0, r.Max)
+
+	assert.Equal(t, LatencyReport{}, summarizeLatencies(nil))
+}
+
+func TestWriteReport(t *testing.T) {
+	StartRun(RunInfo{GeneratorIdentifier: "test", Destination: "null", Mode: "add", WPS: 1, BatchSize: 10})
+	n := &Null{}
+	assert.Nil(t, n.SendDocument(context.Background(), make([]any, 10)))
+	RecordE2ELatency(1500)
+	// Only the bodies of successful requests count as sent
+	RecordRequest("test", RequestInsert, 2048, time.Now(), true)
+	RecordRequest("test", RequestInsert, 1024, time.Now(), false)
+
+	path := filepath.Join(t.TempDir(), "report")
+	assert.Nil(t, WriteReport(path+".json"))
+
+	j, err := os.ReadFile(path + ".json")
+	assert.Nil(t, err)
+	var r Report
+	assert.Nil(t, json.Unmarshal(j, &r))
+	assert.Equal(t, "test", r.GeneratorIdentifier)
+	assert.Equal(t, int64(10), r.DocsWritten)
+	assert.Equal(t, 1, r.E2ELatency.Samples)
+	assert.Equal(t, 1.5, r.E2ELatency.Max)
+	assert.Equal(t, int64(2048), r.BytesSent)
+
+	md, err := os.ReadFile(path + ".md")
+	assert.Nil(t, err)
+	assert.Contains(t, string(md), "| docs written | 10 |")
+}
@@ -0,0 +1,154 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RetryPolicy controls how requests to a destination that fail with a retryable error are retried.
+//
+// Throttling (429) and transient server errors (408, 500, 502, 503, 504) as well as network errors are retried with
+// exponential backoff and jitter, waiting at least as long as the Retry-After header asks for. Other errors are final.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry, it doubles with each following retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff between two attempts, not counting Retry-After
+	MaxBackoff time.Duration
+	// MaxElapsed bounds the total time spent on a request including backoff. Zero means no bound.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy doesn't retry, so errors are reported as they happen unless retries are configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    1,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// Do sends the request built by newRequest until it succeeds or fails with an error that should not be retried.
+// Each attempt is recorded in the per-request metrics. On failure, the response of the last attempt is returned if
+// there was one, and it is up to the caller to close its body.
+func (p RetryPolicy) Do(ctx context.Context, client *http.Client, destination string, operation string, bodySize int,
+	newRequest func() (*http.Request, error)) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		attemptStart := time.Now()
+		resp, err := client.Do(req)
+		success := err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+		RecordRequest(destination, operation, bodySize, attemptStart, success)
+		if success {
+			return resp, nil
+		}
+
+		retryable, retryAfter := classifyResponse(ctx, resp, err)
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			requestsThrottled.WithLabelValues(destination, operation).Inc()
+		}
+		wait := p.backoff(attempt, retryAfter)
+		if !retryable || attempt >= p.MaxAttempts || (p.MaxElapsed > 0 && time.Since(start)+wait > p.MaxElapsed) {
+			requestsFailed.WithLabelValues(destination, operation).Inc()
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			deferredErrorCloser(resp.Body)
+		}
+		requestRetries.WithLabelValues(destination, operation).Inc()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			requestsFailed.WithLabelValues(destination, operation).Inc()
+			return nil, fmt.Errorf("gave up retrying after %d attempts: %w", attempt, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns how long to wait before the next attempt
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	// Equal jitter, so requests throttled together don't all come back at the same time
+	if backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+
+	if retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// classifyResponse returns whether a failed request should be retried and how long the server asked to wait for
+func classifyResponse(ctx context.Context, resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		// Network errors are transient, but there is no point retrying if the request was cancelled or timed out
+		return ctx.Err() == nil, 0
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true, 0
+	default:
+		return false, 0
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+var (
+	requestRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "request_retries",
+		Help: "The total number of requests to the Destination that were retried",
+	}, []string{"destination", "operation"})
+
+	requestsThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "requests_throttled",
+		Help: "The total number of requests to the Destination rejected with 429 Too Many Requests",
+	}, []string{"destination", "operation"})
+
+	requestsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "requests_failed",
+		Help: "The total number of requests to the Destination that failed after all retries",
+	}, []string{"destination", "operation"})
+)
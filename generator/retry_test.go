@@ -0,0 +1,84 @@
+package generator
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newStatusClient returns a client responding with the given status codes in turn, and a pointer to the request count
+func newStatusClient(statusCodes ...int) (*http.Client, *int) {
+	requests := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		statusCode := statusCodes[requests]
+		requests++
+		header := make(http.Header)
+		if statusCode == http.StatusTooManyRequests {
+			header.Set("Retry-After", "0")
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+			Header:     header,
+		}
+	})
+	return client, &requests
+}
+
+func testRequest() (*http.Request, error) {
+	return http.NewRequest(http.MethodPost, defaultRocksetEndpoint, bytes.NewReader([]byte("{}")))
+}
+
+func TestRetryPolicy_RetriesThrottling(t *testing.T) {
+	client, requests := newStatusClient(http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK)
+	p := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	resp, err := p.Do(context.Background(), client, "test", RequestInsert, 2, testRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, *requests)
+}
+
+func TestRetryPolicy_GivesUp(t *testing.T) {
+	client, requests := newStatusClient(http.StatusInternalServerError, http.StatusInternalServerError)
+	p := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	resp, err := p.Do(context.Background(), client, "test", RequestInsert, 2, testRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestRetryPolicy_DoesNotRetryClientErrors(t *testing.T) {
+	client, requests := newStatusClient(http.StatusBadRequest)
+	p := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	resp, err := p.Do(context.Background(), client, "test", RequestInsert, 2, testRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 1, *requests)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		backoff := p.backoff(attempt, 0)
+		assert.LessOrEqual(t, backoff, time.Second)
+		assert.GreaterOrEqual(t, backoff, 50*time.Millisecond)
+	}
+	assert.Equal(t, 5*time.Second, p.backoff(1, 5*time.Second))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, 10*time.Second, parseRetryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
@@ -2,7 +2,9 @@ package generator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,10 +19,24 @@ type Rockset struct {
 	CollectionPath      string
 	Client              *http.Client
 	GeneratorIdentifier string
+	Timeouts            Timeouts
+	Retry               RetryPolicy
+}
+
+func (r *Rockset) newRequest(ctx context.Context, method string, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", r.APIKey))
+	req.Header.Add("Content-Type", "application/json")
+	return req, nil
 }
 
 // SendDocument sends a batch of documents to Rockset
-func (r *Rockset) SendDocument(docs []any) error {
+func (r *Rockset) SendDocument(ctx context.Context, docs []any) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Write)
+	defer cancel()
 	numDocs := len(docs)
 	numEventIngested.Add(float64(numDocs))
 
@@ -28,22 +44,21 @@ func (r *Rockset) SendDocument(docs []any) error {
 	URL := fmt.Sprintf("%s/v1/orgs/self/ws/%s/collections/%s/docs", r.APIServer, rcollection[0], rcollection[1])
 	body := map[string][]interface{}{"data": docs}
 	jsonBody, _ := json.Marshal(body)
-	req, _ := http.NewRequest(http.MethodPost, URL, bytes.NewBuffer(jsonBody))
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", r.APIKey))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := r.Client.Do(req)
+	resp, err := r.Retry.Do(ctx, r.Client, "rockset", RequestInsert, len(jsonBody), func() (*http.Request, error) {
+		return r.newRequest(ctx, http.MethodPost, URL, jsonBody)
+	})
 	if err != nil {
-		recordWritesErrored(float64(numDocs))
+		RecordWrites(RequestInsert, 0, numDocs)
 		fmt.Println("Error during request!", err)
 		return err
 	}
 	defer deferredErrorCloser(resp.Body)
 
 	if resp.StatusCode == http.StatusOK {
-		recordWritesCompleted(float64(numDocs))
+		RecordWrites(RequestInsert, numDocs, 0)
 		_, _ = io.Copy(io.Discard, resp.Body)
 	} else {
-		recordWritesErrored(float64(numDocs))
+		RecordWrites(RequestInsert, 0, numDocs)
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err == nil {
 			bodyString := string(bodyBytes)
@@ -53,27 +68,29 @@ func (r *Rockset) SendDocument(docs []any) error {
 	return nil
 }
 
-func (r *Rockset) SendPatch(docs []interface{}) error {
+func (r *Rockset) SendPatch(ctx context.Context, docs []interface{}) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Write)
+	defer cancel()
 	numDocs := len(docs)
 	rcollection := strings.Split(r.CollectionPath, ".") // this is already validated to have two components
 	URL := fmt.Sprintf("%s/v1/orgs/self/ws/%s/collections/%s/docs", r.APIServer, rcollection[0], rcollection[1])
 	body := map[string][]interface{}{"data": docs}
 	jsonBody, _ := json.Marshal(body)
-	req, _ := http.NewRequest(http.MethodPatch, URL, bytes.NewBuffer(jsonBody))
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", r.APIKey))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := r.Client.Do(req)
+	resp, err := r.Retry.Do(ctx, r.Client, "rockset", RequestPatch, len(jsonBody), func() (*http.Request, error) {
+		return r.newRequest(ctx, http.MethodPatch, URL, jsonBody)
+	})
 	if err != nil {
+		RecordWrites(RequestPatch, 0, numDocs)
 		fmt.Println("Error during request!", err)
 		return err
 	}
 	defer deferredErrorCloser(resp.Body)
 
 	if resp.StatusCode == http.StatusOK {
-		recordPatchesCompleted(float64(numDocs))
+		RecordWrites(RequestPatch, numDocs, 0)
 		_, _ = io.Copy(io.Discard, resp.Body)
 	} else {
-		recordPatchesErrored(float64(numDocs))
+		RecordWrites(RequestPatch, 0, numDocs)
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err == nil {
 			bodyString := string(bodyBytes)
@@ -83,42 +100,160 @@ func (r *Rockset) SendPatch(docs []interface{}) error {
 	return nil
 }
 
-// GetLatestTimestamp returns the latest _event_time in Rockset
-func (r *Rockset) GetLatestTimestamp() (time.Time, error) {
+// SendDelete deletes a batch of documents from Rockset
+func (r *Rockset) SendDelete(ctx context.Context, ids []string) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Write)
+	defer cancel()
+	numDocs := len(ids)
+	rcollection := strings.Split(r.CollectionPath, ".") // this is already validated to have two components
+	URL := fmt.Sprintf("%s/v1/orgs/self/ws/%s/collections/%s/docs", r.APIServer, rcollection[0], rcollection[1])
+	data := make([]map[string]string, numDocs)
+	for i, id := range ids {
+		data[i] = map[string]string{"_id": id}
+	}
+	jsonBody, _ := json.Marshal(map[string]interface{}{"data": data})
+	resp, err := r.Retry.Do(ctx, r.Client, "rockset", RequestDelete, len(jsonBody), func() (*http.Request, error) {
+		return r.newRequest(ctx, http.MethodDelete, URL, jsonBody)
+	})
+	if err != nil {
+		RecordWrites(RequestDelete, 0, numDocs)
+		fmt.Println("Error during request!", err)
+		return err
+	}
+	defer deferredErrorCloser(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		RecordWrites(RequestDelete, numDocs, 0)
+		_, _ = io.Copy(io.Discard, resp.Body)
+	} else {
+		RecordWrites(RequestDelete, 0, numDocs)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err == nil {
+			bodyString := string(bodyBytes)
+			return fmt.Errorf("error code: %d, body: %s", resp.StatusCode, bodyString)
+		}
+	}
+	return nil
+}
 
+// GetLatestTimestamp returns the latest _event_time in Rockset
+func (r *Rockset) GetLatestTimestamp(ctx context.Context) (time.Time, error) {
 	// Unix time from 2 minutes ago to reduce the number of documents scanned by query. Query fails if result older than 2 minutes
 	eventTimeStartSec := time.Now().Unix() - 120
 
-	url := fmt.Sprintf("%s/v1/orgs/self/queries", r.APIServer)
+	query := fmt.Sprintf("select UNIX_MICROS(max(_event_time)) as ts from %s where generator_identifier = '%s' and _event_time > TIMESTAMP_SECONDS(%d)", r.collection(), r.GeneratorIdentifier, eventTimeStartSec)
+	return r.latestTimestamp(ctx, query)
+}
+
+// GetLatestPatchTimestamp returns the latest _ts of patched documents, whose _ts is past their _event_time
+func (r *Rockset) GetLatestPatchTimestamp(ctx context.Context) (time.Time, error) {
+	// Microseconds from 2 minutes ago to reduce the number of documents scanned, like GetLatestTimestamp
+	tsStartMicros := time.Now().Add(-2*time.Minute).UnixNano() / 1000
+
+	query := fmt.Sprintf("select max(_ts) as ts from %s where generator_identifier = '%s' and _ts > %d and _ts > UNIX_MICROS(_event_time)", r.collection(), r.GeneratorIdentifier, tsStartMicros)
+	return r.latestTimestamp(ctx, query)
+}
+
+// latestTimestamp runs a query returning a timestamp in microseconds as ts
+func (r *Rockset) latestTimestamp(ctx context.Context, query string) (time.Time, error) {
+	results, err := r.query(ctx, query)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// TODO: check type assertions
+	if len(results) == 0 {
+		return time.Time{}, fmt.Errorf("could not find the document")
+	}
+
+	yc := results[0]["ts"]
+	if yc == nil {
+		return time.Time{}, fmt.Errorf("malformed result")
+	}
+	timeMicro := int64(yc.(float64))
+
+	// Convert from microseconds to (secs, nanosecs)
+	return time.Unix(timeMicro/1000000, (timeMicro%1000000)*1000), nil
+}
+
+// VisibleProbes returns the probes of tokens which the collection returns
+func (r *Rockset) VisibleProbes(ctx context.Context, tokens []string) ([]string, error) {
+	quoted := make([]string, len(tokens))
+	for i, token := range tokens {
+		quoted[i] = sqlString(token)
+	}
+	query := fmt.Sprintf("select %s from %s where %s in (%s)", ProbeField, r.collection(), ProbeField, strings.Join(quoted, ", "))
+	results, err := r.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]string, 0, len(results))
+	for _, result := range results {
+		if token, ok := result[ProbeField].(string); ok {
+			visible = append(visible, token)
+		}
+	}
+	return visible, nil
+}
+
+// RunQuery runs a query of the query load. Field names are quoted as they are case-sensitive.
+func (r *Rockset) RunQuery(ctx context.Context, q Query) error {
+	var query string
+	switch q.Kind {
+	case PointLookup:
+		query = fmt.Sprintf("select * from %s where _id = %s", r.collection(), sqlString(q.Param))
+	case ClusterFilter:
+		query = fmt.Sprintf("select * from %s where generator_identifier = %s and cluster1 = %s limit %d",
+			r.collection(), sqlString(r.GeneratorIdentifier), sqlString(q.Param), QueryLimit)
+	case CompanyAggregation:
+		query = fmt.Sprintf("select \"Company\", count(*) as count from %s where generator_identifier = %s group by \"Company\"",
+			r.collection(), sqlString(r.GeneratorIdentifier))
+	case CitySearch:
+		query = fmt.Sprintf("select * from %s where generator_identifier = %s and \"Address\".\"City\" = %s limit %d",
+			r.collection(), sqlString(r.GeneratorIdentifier), sqlString(q.Param), QueryLimit)
+	default:
+		return fmt.Errorf("unsupported query %s", q.Kind)
+	}
+	_, err := r.query(ctx, query)
+	return err
+}
+
+// collection returns the quoted name of the collection for queries
+func (r *Rockset) collection() string {
 	rcollection := strings.Split(r.CollectionPath, ".") // this is already validated to have two components
-	query := fmt.Sprintf("select UNIX_MICROS(max(_event_time)) as ts from \"%s\".\"%s\" where generator_identifier = '%s' and _event_time > TIMESTAMP_SECONDS(%d)", rcollection[0], rcollection[1], r.GeneratorIdentifier, eventTimeStartSec)
+	return fmt.Sprintf("\"%s\".\"%s\"", rcollection[0], rcollection[1])
+}
+
+// query runs a SQL query, returning its results
+func (r *Rockset) query(ctx context.Context, query string) ([]map[string]interface{}, error) {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Query)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/v1/orgs/self/queries", r.APIServer)
 	body := map[string]interface{}{"sql": map[string]interface{}{"query": query}}
 	jsonBody, err := json.Marshal(body)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to marshal document: %w", err)
+		return nil, fmt.Errorf("failed to marshal query: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonBody))
+	req, err := r.newRequest(ctx, http.MethodPost, url, jsonBody)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to create new request: %w", err)
+		return nil, fmt.Errorf("failed to create new request: %w", err)
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", r.APIKey))
-	req.Header.Add("Content-Type", "application/json")
-
 	resp, err := r.Client.Do(req)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to execute request: %w", err)
+		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 
 	defer deferredErrorCloser(resp.Body)
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err == nil {
-			bodyString := string(bodyBytes)
-			fmt.Printf("Error code: %d, body: %s \n", resp.StatusCode, bodyString)
-		}
-		return time.Time{}, err
+		return nil, fmt.Errorf("query failed: expected OK got %s: %s", resp.Status, string(bodyBytes))
 	}
 
 	// Received status 200. Result structure will look something like
@@ -127,33 +262,75 @@ func (r *Rockset) GetLatestTimestamp() (time.Time, error) {
 	// 		"ts": 1000000
 	// 	}]
 	// }
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to read response body: %v", err)
+	var result struct {
+		Results []map[string]interface{} `json:"results"`
 	}
-	var result map[string]interface{}
 	if err = json.Unmarshal(bodyBytes, &result); err != nil {
-		return time.Time{}, fmt.Errorf("failed to unmarshal response body: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal response body: %w", err)
 	}
+	return result.Results, nil
+}
 
-	// TODO: check type assertions
-	x := result["results"].([]interface{})
-	if len(x) == 0 {
-		return time.Time{}, fmt.Errorf("could not find the document")
-	}
+// sqlString quotes s as a SQL string literal
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
 
-	x0 := x[0]
-	y := x0.(map[string]interface{})
-	yc := y["ts"]
-	if yc == nil {
-		return time.Time{}, fmt.Errorf("malformed result")
-	}
-	timeMicro := int64(yc.(float64))
+func (r *Rockset) ConfigureDestination(_ context.Context) error {
+	return nil
+}
 
-	// Convert from microseconds to (secs, nanosecs)
-	return time.Unix(timeMicro/1000000, (timeMicro%1000000)*1000), nil
+func init() {
+	Register(Registration{
+		Name: "rockset",
+		Options: append([]Option{
+			{Name: "api_key", Env: "ROCKSET_API_KEY", Required: true, Secret: true},
+			{Name: "api_server", Env: "ROCKSET_API_SERVER", Required: true},
+			{Name: "collection", Env: "ROCKSET_COLLECTION", Required: true, Validate: func(v string) error {
+				if len(strings.Split(v, ".")) != 2 {
+					return errors.New("should have the format <workspace_name>.<collection_name>")
+				}
+				return nil
+			}},
+		}, TimeoutOptions("ROCKSET")...),
+		Capabilities: Capabilities{Deletes: true, LatencyQuery: true, PatchLatencyQuery: true, VisibilityQuery: true, Queries: true},
+		PatchEncoder: rocksetPatchEncoder{},
+		New: func(s Settings) (Destination, error) {
+			return &Rockset{
+				APIKey:              s.Options.String("api_key"),
+				APIServer:           s.Options.String("api_server"),
+				CollectionPath:      s.Options.String("collection"),
+				Client:              s.Client,
+				GeneratorIdentifier: s.GeneratorIdentifier,
+				Timeouts:            s.Options.Timeouts(),
+				Retry:               s.Retry,
+			}, nil
+		},
+	})
 }
 
-func (r *Rockset) ConfigureDestination() error {
-	return nil
+// rocksetPatchEncoder renders patches as JSON patches, see https://rockset.com/docs/patch-documents/
+type rocksetPatchEncoder struct{}
+
+func (rocksetPatchEncoder) EncodePatch(p Patch) interface{} {
+	ops := make([]map[string]interface{}, 0, len(p.Fields)+1)
+	for _, f := range p.Fields {
+		path := "/" + strings.Join(f.Path, "/")
+		switch f.Op {
+		case SetField, SetNestedField:
+			ops = append(ops, map[string]interface{}{"op": "replace", "path": path, "value": f.Value})
+		case AddField:
+			ops = append(ops, map[string]interface{}{"op": "add", "path": path, "value": f.Value})
+		case AppendToArray:
+			ops = append(ops, map[string]interface{}{"op": "add", "path": path + "/-", "value": f.Value})
+		case Increment:
+			ops = append(ops, map[string]interface{}{"op": "INCR", "path": path, "value": f.Value})
+		}
+	}
+	ops = append(ops, map[string]interface{}{"op": "add", "path": "/_ts", "value": p.Timestamp})
+
+	patch := make(map[string]interface{})
+	patch["_id"] = p.ID
+	patch["patch"] = ops
+	return patch
 }
@@ -2,6 +2,8 @@ package generator
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -50,26 +52,134 @@ func TestRockset_GetLatestTimestamp(t *testing.T) {
 	r := NewRocksetClient(fmt.Sprintf(`{"results":[{"ts": %d}]}`,
 		expected.UnixNano()/1000))
 
-	t0, err := r.GetLatestTimestamp()
+	t0, err := r.GetLatestTimestamp(context.Background())
 	assert.Nil(t, err)
 	assert.Equal(t, expected.Unix(), t0.Unix())
 }
 
+func TestRockset_GetLatestPatchTimestamp(t *testing.T) {
+	expected := time.Now()
+	var query string
+	r := NewRocksetClient("")
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		var body struct {
+			SQL struct {
+				Query string `json:"query"`
+			} `json:"sql"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		query = body.SQL.Query
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"results":[{"ts": %d}]}`, expected.UnixNano()/1000))),
+			Header:     make(http.Header),
+		}
+	})
+
+	t0, err := r.GetLatestPatchTimestamp(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Unix(), t0.Unix())
+	assert.Contains(t, query, "select max(_ts) as ts from \"ws\".\"test\" where generator_identifier = 'test'")
+	assert.Contains(t, query, "_ts > UNIX_MICROS(_event_time)")
+}
+
+func TestRockset_VisibleProbes(t *testing.T) {
+	r := NewRocksetClient(`{"results":[{"_probe":"abc"}]}`)
+
+	visible, err := r.VisibleProbes(context.Background(), []string{"abc", "def"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"abc"}, visible)
+}
+
+func TestRockset_RunQuery(t *testing.T) {
+	var queries []string
+	r := NewRocksetClient("")
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		var body struct {
+			SQL struct {
+				Query string `json:"query"`
+			} `json:"sql"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		queries = append(queries, body.SQL.Query)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"results":[]}`)),
+			Header:     make(http.Header),
+		}
+	})
+
+	for _, q := range []Query{
+		{Kind: PointLookup, Param: "0000000042"},
+		{Kind: ClusterFilter, Param: "3@gmail.com"},
+		{Kind: CompanyAggregation},
+		{Kind: CitySearch, Param: "San Mateo"},
+	} {
+		assert.Nil(t, r.RunQuery(context.Background(), q))
+	}
+	assert.Equal(t, []string{
+		"select * from \"ws\".\"test\" where _id = '0000000042'",
+		"select * from \"ws\".\"test\" where generator_identifier = 'test' and cluster1 = '3@gmail.com' limit 100",
+		"select \"Company\", count(*) as count from \"ws\".\"test\" where generator_identifier = 'test' group by \"Company\"",
+		"select * from \"ws\".\"test\" where generator_identifier = 'test' and \"Address\".\"City\" = 'San Mateo' limit 100",
+	}, queries)
+}
+
 func TestRockset_SendDocument(t *testing.T) {
 	r := NewRocksetClient("")
 	spec := DocumentSpec{
-		Destination:          "rockset",
 		GeneratorIdentifier:  r.GeneratorIdentifier,
 		BatchSize:            10,
-		Mode:                 "add",
 		IdMode:               "uuid",
-		UpdatePercentage:     -1,
 		NumClusters:          -1,
 		HotClusterPercentage: -1,
 	};
 
-	docs, err := GenerateDocs(spec)
+	docs, err := NewGenerator(spec).GenerateDocs()
 	assert.Nil(t, err)
-	err = r.SendDocument(docs)
+	err = r.SendDocument(context.Background(), docs)
 	assert.Nil(t, err)
 }
+
+func TestRockset_GetLatestTimestampTimeout(t *testing.T) {
+	r := NewRocksetClient("")
+	// Hang until the request is cancelled, like an unresponsive server
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		<-req.Context().Done()
+		return nil
+	})
+	r.Timeouts.Query = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := r.GetLatestTimestamp(context.Background())
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRockset_SendDelete(t *testing.T) {
+	var method, body string
+	r := NewRocksetClient("")
+	r.CollectionPath = "commons.test"
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		method = req.Method
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString("{}")), Header: make(http.Header)}
+	})
+
+	assert.Nil(t, r.SendDelete(context.Background(), []string{"1", "2"}))
+	assert.Equal(t, http.MethodDelete, method)
+	assert.JSONEq(t, `{"data": [{"_id": "1"}, {"_id": "2"}]}`, body)
+}
+
+func TestRockset_SendPatchError(t *testing.T) {
+	StartRun(RunInfo{GeneratorIdentifier: "test"})
+	r := NewRocksetClient("")
+	// Fail like an unreachable server
+	r.Client = NewTestClient(func(req *http.Request) *http.Response {
+		return nil
+	})
+
+	assert.NotNil(t, r.SendPatch(context.Background(), []interface{}{map[string]interface{}{"_id": "1"}, map[string]interface{}{"_id": "2"}}))
+	assert.Equal(t, int64(2), BuildReport().PatchesErrored)
+}
@@ -0,0 +1,96 @@
+package generator
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Phase is a part of a run with its own target rate, in batches per second. If From is set, the rate ramps linearly
+// from From to Rate over Duration, otherwise it's Rate throughout.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+	From     float64
+	Rate     float64
+}
+
+// rateAt returns the target rate elapsed into the phase
+func (p Phase) rateAt(elapsed time.Duration) float64 {
+	if p.From <= 0 {
+		return p.Rate
+	}
+	return p.From + (p.Rate-p.From)*float64(elapsed)/float64(p.Duration)
+}
+
+// Schedule is a sequence of phases, e.g. a ramp up, a steady state, a spike and a cooldown
+type Schedule []Phase
+
+// At returns the index of the phase elapsed into the schedule and its target rate at that point.
+// It returns false once the last phase is over.
+func (s Schedule) At(elapsed time.Duration) (int, float64, bool) {
+	for i, p := range s {
+		if elapsed < p.Duration {
+			return i, p.rateAt(elapsed), true
+		}
+		elapsed -= p.Duration
+	}
+	return 0, 0, false
+}
+
+// rampStep is how often the rate is updated during a ramp
+const rampStep = time.Second
+
+// FollowSchedule sets the rate of rc along the phases of s, recording every phase in the run report, until the last
+// phase is over or done is closed.
+func FollowSchedule(s Schedule, rc *RateController, done <-chan struct{}) {
+	start := time.Now()
+	current := -1
+	for {
+		elapsed := time.Since(start)
+		i, rate, ok := s.At(elapsed)
+		if !ok {
+			return
+		}
+		if i != current {
+			current = i
+			p := s[i]
+			log.Printf("starting phase %s for %s at %.1f batches per second", p.Name, p.Duration, rate)
+			startPhase(p)
+			for _, other := range s {
+				currentPhase.WithLabelValues(other.Name).Set(0)
+			}
+			currentPhase.WithLabelValues(p.Name).Set(1)
+		}
+		rc.SetRate(rate)
+
+		// Wake up at the end of the phase, or in time for the next step of a ramp
+		wait := phaseEnd(s, i) - elapsed
+		if s[i].From > 0 && wait > rampStep {
+			wait = rampStep
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// phaseEnd returns how long after the start of the schedule phase i ends
+func phaseEnd(s Schedule, i int) time.Duration {
+	var end time.Duration
+	for _, p := range s[:i+1] {
+		end += p.Duration
+	}
+	return end
+}
+
+var currentPhase = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "current_phase",
+	Help: "1 for the phase of the schedule being run, 0 for the others",
+}, []string{"phase"})
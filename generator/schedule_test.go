@@ -0,0 +1,56 @@
+package generator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule_At(t *testing.T) {
+	s := Schedule{
+		{Name: "ramp", Duration: 5 * time.Minute, From: 1, Rate: 51},
+		{Name: "steady", Duration: 30 * time.Minute, Rate: 50},
+		{Name: "spike", Duration: time.Minute, Rate: 200},
+	}
+
+	i, rate, ok := s.At(0)
+	assert.True(t, ok)
+	assert.Equal(t, 0, i)
+	assert.Equal(t, 1.0, rate)
+
+	_, rate, _ = s.At(150 * time.Second)
+	assert.Equal(t, 26.0, rate)
+
+	i, rate, _ = s.At(35*time.Minute + time.Second)
+	assert.Equal(t, 2, i)
+	assert.Equal(t, 200.0, rate)
+
+	_, _, ok = s.At(36 * time.Minute)
+	assert.False(t, ok)
+}
+
+func TestFollowSchedule(t *testing.T) {
+	StartRun(RunInfo{GeneratorIdentifier: "test"})
+	rc := NewRateController(1, 1)
+	defer rc.Stop()
+
+	s := Schedule{
+		{Name: "steady", Duration: 50 * time.Millisecond, Rate: 10},
+		{Name: "spike", Duration: 50 * time.Millisecond, Rate: 100},
+	}
+	go func() {
+		time.Sleep(75 * time.Millisecond)
+		RecordWrites(RequestInsert, 20, 0)
+	}()
+	FollowSchedule(s, rc, make(chan struct{}))
+
+	r := BuildReport()
+	assert.Len(t, r.Phases, 2)
+	assert.Equal(t, "steady", r.Phases[0].Name)
+	assert.Equal(t, int64(0), r.Phases[0].DocsWritten)
+	assert.Equal(t, "spike", r.Phases[1].Name)
+	assert.Equal(t, 100.0, r.Phases[1].TargetRate)
+	assert.Equal(t, int64(20), r.Phases[1].DocsWritten)
+	assert.Equal(t, r.Phases[0].EndTime, r.Phases[1].StartTime)
+}
@@ -0,0 +1,449 @@
+package generator
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaSpec describes the documents to generate, as read from a schema file
+type SchemaSpec struct {
+	Fields []FieldSpec `yaml:"fields"`
+}
+
+// FieldSpec describes a field of the generated documents.
+//
+// Type is one of string, int, float, bool, object or array. Values are picked from OneOf if set. Otherwise strings are
+// made by Generator, e.g. first_name or email, or are random letters of Length, or between MinLength and MaxLength,
+// characters. Numbers are uniform between Min and Max, or made by Generator for floats, e.g. latitude. Objects have
+// Fields, arrays have Length, or between MinLength and MaxLength, Items. Cardinality limits a field to that many
+// distinct values.
+type FieldSpec struct {
+	Name        string        `yaml:"name"`
+	Type        string        `yaml:"type"`
+	Generator   string        `yaml:"generator"`
+	OneOf       []interface{} `yaml:"oneof"`
+	Min         *float64      `yaml:"min"`
+	Max         *float64      `yaml:"max"`
+	Length      int           `yaml:"length"`
+	MinLength   int           `yaml:"min_length"`
+	MaxLength   int           `yaml:"max_length"`
+	Cardinality int           `yaml:"cardinality"`
+	Fields      []FieldSpec   `yaml:"fields"`
+	Items       *FieldSpec    `yaml:"items"`
+}
+
+// Schema is a compiled SchemaSpec, generating documents without reflection
+type Schema struct {
+	fields []compiledField
+	// spec is what the schema was compiled from, to look fields up by path
+	spec SchemaSpec
+}
+
+type compiledField struct {
+	name     string
+	generate valueGenerator
+}
+
+// valueGenerator generates the value of a field using r for randomness
+type valueGenerator func(r *fieldRand) interface{}
+
+// fieldRand is the randomness values are generated with, along with the seed of the generator so fields with a
+// cardinality pick from the same values whenever a generator with that seed is used
+type fieldRand struct {
+	*rand.Rand
+	seed int64
+}
+
+// defaultStringLength matches the length of the random strings faker generates
+const defaultStringLength = 25
+
+// maxCardinality bounds the cardinality of a field, fields with more distinct values are better off without one
+const maxCardinality = 1000000
+
+// stringGenerators are the generators of string fields, see fake.go for the realistic looking ones
+var stringGenerators = map[string]valueGenerator{
+	"first_name":   func(r *fieldRand) interface{} { return fakeFirstName(r.Rand) },
+	"last_name":    func(r *fieldRand) interface{} { return fakeLastName(r.Rand) },
+	"name":         func(r *fieldRand) interface{} { return fakeName(r.Rand) },
+	"username":     func(r *fieldRand) interface{} { return fakeUsername(r.Rand) },
+	"email":        func(r *fieldRand) interface{} { return fakeEmail(r.Rand) },
+	"phone_number": func(r *fieldRand) interface{} { return fakePhoneNumber(r.Rand) },
+	"url":          func(r *fieldRand) interface{} { return fakeURL(r.Rand) },
+	"ipv4":         func(r *fieldRand) interface{} { return fakeIPv4(r.Rand) },
+	"word":         func(r *fieldRand) interface{} { return fakeWord(r.Rand) },
+	"sentence":     func(r *fieldRand) interface{} { return fakeSentence(r.Rand) },
+	"paragraph":    func(r *fieldRand) interface{} { return fakeParagraph(r.Rand) },
+	"timestamp":    func(r *fieldRand) interface{} { return randomTime(r.Rand).Format(timestampLayout) },
+	"date":         func(r *fieldRand) interface{} { return randomTime(r.Rand).Format(dateLayout) },
+	"uuid":         func(r *fieldRand) interface{} { return randomUUID(r.Rand) },
+}
+
+// floatGenerators are the generators of float fields
+var floatGenerators = map[string]valueGenerator{
+	// amount is a number of cents, like faker's amount tag
+	"amount":    func(r *fieldRand) interface{} { return math.Round(r.Float64()*1000000) / 100 },
+	"latitude":  func(r *fieldRand) interface{} { return r.Float64()*180 - 90 },
+	"longitude": func(r *fieldRand) interface{} { return r.Float64()*360 - 180 },
+}
+
+//go:embed default_schema.yaml
+var defaultSchemaYAML []byte
+
+// DefaultSchema generates the documents RockBench has always generated, with names, addresses, friends and tags
+var DefaultSchema = mustParseSchema(defaultSchemaYAML)
+
+func mustParseSchema(b []byte) *Schema {
+	s, err := ParseSchema(b)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in schema: %v", err))
+	}
+	return s
+}
+
+// LoadSchema reads and compiles the schema file at path
+func LoadSchema(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %w", err)
+	}
+	s, err := ParseSchema(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema file %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// ParseSchema compiles a schema written in YAML, rejecting unknown settings
+func ParseSchema(b []byte) (*Schema, error) {
+	var spec SchemaSpec
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+	return CompileSchema(spec)
+}
+
+// CompileSchema checks spec and compiles it into a Schema
+func CompileSchema(spec SchemaSpec) (*Schema, error) {
+	if len(spec.Fields) == 0 {
+		return nil, errors.New("schema has no fields")
+	}
+	fields, err := compileFields(spec.Fields, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{fields: fields, spec: spec}, nil
+}
+
+// Generate generates a document with randomness from r. Fields with a cardinality pick from values derived from seed
+// rather than r, so they're the same for every document generated with the seed.
+func (s *Schema) Generate(r *rand.Rand, seed int64) map[string]interface{} {
+	return generateObject(s.fields, &fieldRand{Rand: r, seed: seed})
+}
+
+// Field returns the spec of the field at path, e.g. ["Address", "City"], false if the schema doesn't define it
+func (s *Schema) Field(path ...string) (FieldSpec, bool) {
+	fields := s.spec.Fields
+	var field FieldSpec
+	for _, name := range path {
+		found := false
+		for _, f := range fields {
+			if f.Name == name {
+				field, found = f, true
+				break
+			}
+		}
+		if !found {
+			return FieldSpec{}, false
+		}
+		fields = field.Fields
+	}
+	return field, len(path) > 0
+}
+
+func generateObject(fields []compiledField, r *fieldRand) map[string]interface{} {
+	doc := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		doc[f.name] = f.generate(r)
+	}
+	return doc
+}
+
+func compileFields(specs []FieldSpec, parent string) ([]compiledField, error) {
+	fields := make([]compiledField, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		path := spec.Name
+		if parent != "" {
+			path = parent + "." + spec.Name
+		}
+		if spec.Name == "" {
+			return nil, fmt.Errorf("field of %s has no name", describePath(parent))
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("field %s is defined more than once", path)
+		}
+		seen[spec.Name] = true
+
+		generate, err := compileField(spec, path)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, compiledField{name: spec.Name, generate: generate})
+	}
+	return fields, nil
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "the document"
+	}
+	return path
+}
+
+func compileField(spec FieldSpec, path string) (valueGenerator, error) {
+	generate, err := compileValue(spec, path)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Cardinality < 0 || spec.Cardinality > maxCardinality {
+		return nil, fmt.Errorf("field %s: cardinality must be between 0 and %d", path, maxCardinality)
+	}
+	if spec.Cardinality > 0 {
+		generate = withCardinality(generate, spec.Cardinality, path)
+	}
+	return generate, nil
+}
+
+func compileValue(spec FieldSpec, path string) (valueGenerator, error) {
+	if spec.Type != "object" && len(spec.Fields) > 0 {
+		return nil, fmt.Errorf("field %s: only objects have fields", path)
+	}
+	if spec.Type != "array" && spec.Items != nil {
+		return nil, fmt.Errorf("field %s: only arrays have items", path)
+	}
+
+	if len(spec.OneOf) > 0 {
+		if spec.Type == "object" || spec.Type == "array" {
+			return nil, fmt.Errorf("field %s: oneof is only supported for scalar types", path)
+		}
+		for _, v := range spec.OneOf {
+			switch v.(type) {
+			case map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("field %s: oneof values must be scalars", path)
+			}
+		}
+		values := spec.OneOf
+		return func(r *fieldRand) interface{} { return values[r.Intn(len(values))] }, nil
+	}
+
+	switch spec.Type {
+	case "string":
+		if spec.Generator != "" {
+			g, ok := stringGenerators[spec.Generator]
+			if !ok {
+				return nil, fmt.Errorf("field %s: unknown string generator %q, expecting one of %s", path, spec.Generator, generatorNames(stringGenerators))
+			}
+			return g, nil
+		}
+		minLength, maxLength, err := lengthRange(spec, path, defaultStringLength)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *fieldRand) interface{} { return randomLetters(r.Rand, between(r.Rand, minLength, maxLength)) }, nil
+	case "int":
+		lo, hi, err := numberRange(spec, path, 0, math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		first, span, err := intRange(lo, hi, path)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *fieldRand) interface{} { return first + r.Int63n(span) }, nil
+	case "float":
+		if spec.Generator != "" {
+			g, ok := floatGenerators[spec.Generator]
+			if !ok {
+				return nil, fmt.Errorf("field %s: unknown float generator %q, expecting one of %s", path, spec.Generator, generatorNames(floatGenerators))
+			}
+			return g, nil
+		}
+		lo, hi, err := numberRange(spec, path, 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *fieldRand) interface{} { return lo + r.Float64()*(hi-lo) }, nil
+	case "bool":
+		return func(r *fieldRand) interface{} { return r.Intn(2) == 1 }, nil
+	case "object":
+		if len(spec.Fields) == 0 {
+			return nil, fmt.Errorf("field %s: objects need fields", path)
+		}
+		fields, err := compileFields(spec.Fields, path)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *fieldRand) interface{} { return generateObject(fields, r) }, nil
+	case "array":
+		if spec.Items == nil {
+			return nil, fmt.Errorf("field %s: arrays need items", path)
+		}
+		item, err := compileField(*spec.Items, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		minLength, maxLength, err := lengthRange(spec, path, 3)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *fieldRand) interface{} {
+			values := make([]interface{}, between(r.Rand, minLength, maxLength))
+			for i := range values {
+				values[i] = item(r)
+			}
+			return values
+		}, nil
+	default:
+		return nil, fmt.Errorf("field %s: unknown type %q, expecting one of string, int, float, bool, object, array", path, spec.Type)
+	}
+}
+
+// lengthRange returns the range of lengths of a string or array, Length if set and otherwise MinLength to MaxLength
+func lengthRange(spec FieldSpec, path string, defaultLength int) (int, int, error) {
+	if spec.Length < 0 || spec.MinLength < 0 || spec.MaxLength < 0 {
+		return 0, 0, fmt.Errorf("field %s: lengths must not be negative", path)
+	}
+	if spec.Length > 0 {
+		return spec.Length, spec.Length, nil
+	}
+	if spec.MaxLength == 0 {
+		if spec.MinLength > defaultLength {
+			return spec.MinLength, spec.MinLength, nil
+		}
+		return spec.MinLength, defaultLength, nil
+	}
+	if spec.MinLength > spec.MaxLength {
+		return 0, 0, fmt.Errorf("field %s: min_length must not be greater than max_length", path)
+	}
+	return spec.MinLength, spec.MaxLength, nil
+}
+
+// intRange converts the range of an int field to its first value and the number of values in it, checking min and max
+// are whole numbers which fit in an int64 and that there are fewer than 2^63-1 values in between
+func intRange(lo float64, hi float64, path string) (int64, int64, error) {
+	// 2^63 is exactly representable as a float64, unlike math.MaxInt64
+	const limit = 1 << 63
+	if lo < -limit || hi >= limit {
+		return 0, 0, fmt.Errorf("field %s: min and max of int fields must be from %d to %d", path, math.MinInt64, math.MaxInt64)
+	}
+	if lo != math.Trunc(lo) || hi != math.Trunc(hi) {
+		return 0, 0, fmt.Errorf("field %s: min and max of int fields must be whole numbers", path)
+	}
+	first, last := int64(lo), int64(hi)
+	// The difference wraps around in int64 but not in uint64, as last >= first
+	if uint64(last)-uint64(first) >= math.MaxInt64 {
+		return 0, 0, fmt.Errorf("field %s: the range from min to max is too large, it must be less than %d", path, int64(math.MaxInt64))
+	}
+	return first, last - first + 1, nil
+}
+
+// numberRange returns Min and Max, or the defaults for those not set
+func numberRange(spec FieldSpec, path string, defaultMin float64, defaultMax float64) (float64, float64, error) {
+	lo, hi := defaultMin, defaultMax
+	if spec.Min != nil {
+		lo = *spec.Min
+	}
+	if spec.Max != nil {
+		hi = *spec.Max
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("field %s: min must not be greater than max", path)
+	}
+	return lo, hi, nil
+}
+
+// withCardinality limits generate to n distinct values. Value i is generated with randomness seeded by the seed of
+// the generator, path and i, so nothing is kept in memory and fields with the same cardinality have different values.
+func withCardinality(generate valueGenerator, n int, path string) valueGenerator {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	pathSeed := int64(h.Sum64())
+	return func(r *fieldRand) interface{} {
+		i := r.Intn(n)
+		seed := deriveSeed(deriveSeed(r.seed, pathSeed), int64(i))
+		return generate(&fieldRand{Rand: rand.New(&splitMix{state: uint64(seed)}), seed: r.seed})
+	}
+}
+
+// splitMix is a rand.Source cheap enough to create for every value of a field with a cardinality
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += splitMixGamma
+	return mix64(s.state)
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// between returns a random number from lo to hi, both included
+func between(r *rand.Rand, lo int, hi int) int {
+	if hi <= lo {
+		return lo
+	}
+	return lo + r.Intn(hi-lo+1)
+}
+
+// Layouts of the timestamps and dates generated, the same as faker's
+const (
+	timestampLayout = "2006-01-02 15:04:05"
+	dateLayout      = "2006-01-02"
+)
+
+// timeRangeEnd bounds random times. Unlike faker, which picks times up to now, the range is fixed so the times are
+// reproducible.
+var timeRangeEnd = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// randomTime returns a random time between the Unix epoch and timeRangeEnd
+func randomTime(r *rand.Rand) time.Time {
+	return time.Unix(r.Int63n(timeRangeEnd), 0).UTC()
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randomLetters(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func generatorNames(generators map[string]valueGenerator) string {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,124 @@
+package generator
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultSchema(t *testing.T) {
+	doc := DefaultSchema.Generate(rand.New(rand.NewSource(1)), 1)
+
+	assert.Len(t, doc["Guid"], 25)
+	assert.Contains(t, []interface{}{15, 27, 61}, doc["Age"])
+	assert.Len(t, doc["Tags"], 9)
+	assert.Len(t, doc["Tags"].([]interface{})[0], 14)
+	address := doc["Address"].(map[string]interface{})
+	assert.Contains(t, []interface{}{"SF", "San Mateo", "San Jose", "Mountain View", "Menlo Park", "Palo Alto"}, address["City"])
+	assert.Contains(t, address["Coordinates"], "Latitude")
+	// The fields patches change exist
+	friend := doc["Friends"].(map[string]interface{})["Friend5"].(map[string]interface{})
+	assert.Contains(t, friend["Name"], "First")
+	assert.Contains(t, friend, "Age")
+}
+
+func TestParseSchema(t *testing.T) {
+	s, err := ParseSchema([]byte(`
+fields:
+  - name: device
+    type: string
+    cardinality: 3
+  - name: reading
+    type: float
+    min: 10
+    max: 20
+  - name: count
+    type: int
+    min: -5
+    max: 5
+  - name: labels
+    type: array
+    min_length: 1
+    max_length: 4
+    items:
+      type: object
+      fields:
+        - name: key
+          type: string
+          oneof: [a, b]
+`))
+	assert.Nil(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	devices := make(map[interface{}]bool)
+	for i := 0; i < 100; i++ {
+		doc := s.Generate(r, 1)
+		devices[doc["device"]] = true
+		assert.GreaterOrEqual(t, doc["reading"], 10.0)
+		assert.LessOrEqual(t, doc["reading"], 20.0)
+		assert.GreaterOrEqual(t, doc["count"], int64(-5))
+		assert.LessOrEqual(t, doc["count"], int64(5))
+		labels := doc["labels"].([]interface{})
+		assert.True(t, len(labels) >= 1 && len(labels) <= 4)
+		assert.Contains(t, []interface{}{"a", "b"}, labels[0].(map[string]interface{})["key"])
+	}
+	assert.Len(t, devices, 3)
+}
+
+func TestParseSchema_Errors(t *testing.T) {
+	cases := map[string]string{
+		"fields: []":                           "schema has no fields",
+		"fields:\n  - name: a\n    type: text": `field a: unknown type "text", expecting one of string, int, float, bool, object, array`,
+		"fields:\n  - name: a\n    type: object\n    fields:\n      - name: b\n        type: string\n        generator: town": `field a.b: unknown string generator "town", expecting one of date, email, first_name, ipv4, last_name, name, paragraph, phone_number, sentence, timestamp, url, username, uuid, word`,
+		"fields:\n  - name: a\n    type: array":                              "field a: arrays need items",
+		"fields:\n  - name: a\n    type: int\n    min: 5\n    max: 1":        "field a: min must not be greater than max",
+		"fields:\n  - name: a\n    type: int\n    max: 1e19":                 "field a: min and max of int fields must be from -9223372036854775808 to 9223372036854775807",
+		"fields:\n  - name: a\n    type: int\n    min: -1e19":                "field a: min and max of int fields must be from -9223372036854775808 to 9223372036854775807",
+		"fields:\n  - name: a\n    type: int\n    max: 2.5":                  "field a: min and max of int fields must be whole numbers",
+		"fields:\n  - name: a\n    type: int\n    min: -5e18\n    max: 5e18": "field a: the range from min to max is too large, it must be less than 9223372036854775807",
+		"fields:\n  - name: a\n    type: int\n  - name: a\n    type: int":    "field a is defined more than once",
+		"fields:\n  - name: a\n    typ: int":                                 "failed to parse schema: yaml: unmarshal errors:\n  line 3: field typ not found in type generator.FieldSpec",
+	}
+	for schema, expected := range cases {
+		_, err := ParseSchema([]byte(schema))
+		assert.EqualError(t, err, expected, schema)
+	}
+
+	// Ranges up to the limits of int64 are fine
+	s, err := ParseSchema([]byte("fields:\n  - name: a\n    type: int\n    min: -9e18\n    max: 0\n  - name: b\n    type: int\n    min: 0\n    max: 9.2e18"))
+	assert.NoError(t, err)
+	doc := s.Generate(rand.New(rand.NewSource(1)), 1)
+	assert.LessOrEqual(t, doc["a"], int64(0))
+	assert.GreaterOrEqual(t, doc["b"], int64(0))
+}
+
+func TestSchema_CardinalityFollowsSeed(t *testing.T) {
+	s, err := ParseSchema([]byte(`
+fields:
+  - name: user
+    type: string
+    generator: email
+    cardinality: 4
+  - name: host
+    type: string
+    generator: email
+    cardinality: 4
+`))
+	assert.Nil(t, err)
+
+	values := func(seed int64, field string, docSeed int64) map[interface{}]bool {
+		r := rand.New(rand.NewSource(docSeed))
+		seen := make(map[interface{}]bool)
+		for i := 0; i < 200; i++ {
+			seen[s.Generate(r, seed)[field]] = true
+		}
+		return seen
+	}
+	users := values(1, "user", 1)
+	assert.Len(t, users, 4)
+	// The values only depend on the seed of the generator and the field, not on the rest of the randomness
+	assert.Equal(t, users, values(1, "user", 99))
+	assert.NotEqual(t, users, values(1, "host", 1))
+	assert.NotEqual(t, users, values(2, "user", 1))
+}
@@ -0,0 +1,114 @@
+package generator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// sendLogMaxAge is how long the send times of timestamps are remembered. Latency queries only look a few minutes back,
+// older documents are measured with the wall clock.
+const sendLogMaxAge = 5 * time.Minute
+
+// stampTolerance is how much lower than the stamped value a timestamp found by a query can be and still be matched to
+// it, so databases keeping timestamps to the millisecond are still measured with the monotonic clock
+const stampTolerance = time.Millisecond
+
+// Reasons latency samples are discarded for, see MeasureLatency
+const (
+	// DiscardNegative is a document which seems to have been written in the future, the wall clock of the replica
+	// which stamped it is ahead of this one's
+	DiscardNegative = "negative"
+	// DiscardImplausible is a latency longer than the plausible maximum, e.g. a clock far behind or a rewritten
+	// timestamp
+	DiscardImplausible = "implausible"
+)
+
+// send is a timestamp this replica stamped documents or patches with, and when it did with the monotonic clock
+type send struct {
+	stamp int64
+	at    time.Time
+}
+
+// sendLog remembers the recent sends of this replica by timestamp, so their latency can be measured without trusting
+// the wall clock to agree with the timestamp
+type sendLog struct {
+	mu sync.Mutex
+	// sends are sorted by stamp. Stamps mostly come in order, as they are taken right before sending.
+	sends []send
+}
+
+var sends = &sendLog{}
+
+// record remembers that stamp was taken at at, forgetting sends older than sendLogMaxAge
+func (l *sendLog) record(stamp int64, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := 0
+	for expired < len(l.sends) && at.Sub(l.sends[expired].at) > sendLogMaxAge {
+		expired++
+	}
+	l.sends = l.sends[expired:]
+
+	i := sort.Search(len(l.sends), func(i int) bool { return l.sends[i].stamp > stamp })
+	l.sends = append(l.sends, send{})
+	copy(l.sends[i+1:], l.sends[i:])
+	l.sends[i] = send{stamp: stamp, at: at}
+}
+
+// lookup returns when this replica took the stamp of a timestamp found by a query
+func (l *sendLog) lookup(stamp int64) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.sends), func(i int) bool { return l.sends[i].stamp >= stamp })
+	if i == len(l.sends) || l.sends[i].stamp-stamp >= stampTolerance.Microseconds() {
+		return time.Time{}, false
+	}
+	return l.sends[i].at, true
+}
+
+// stampNow returns the current time in microseconds, to stamp documents or patches with, and remembers when it was taken
+func stampNow() int64 {
+	at := time.Now()
+	stamp := at.UnixNano() / int64(time.Microsecond)
+	sends.record(stamp, at)
+	return stamp
+}
+
+// MeasureLatency returns the latency of the latest timestamp found by a latency query. Timestamps stamped by this
+// replica are measured with the monotonic clock from when they were taken, so the wall clock stepping doesn't matter.
+// Others, stamped by another replica or rewritten by the database, are measured with the wall clock, and are discarded
+// with an error if the latency is negative or longer than maxPlausible, as the clocks can't agree. Discarded samples
+// are counted by reason.
+func MeasureLatency(timestamp time.Time, maxPlausible time.Duration) (time.Duration, error) {
+	if at, ok := sends.lookup(timestamp.UnixNano() / int64(time.Microsecond)); ok {
+		return time.Since(at), nil
+	}
+
+	latency := time.Now().Sub(timestamp)
+	switch {
+	case latency < 0:
+		recordDiscardedLatency(DiscardNegative)
+		return 0, fmt.Errorf("latency of %s is negative, the clock of the writer is ahead", latency)
+	case maxPlausible > 0 && latency > maxPlausible:
+		recordDiscardedLatency(DiscardImplausible)
+		return 0, fmt.Errorf("latency of %s is longer than the plausible maximum of %s", latency, maxPlausible)
+	}
+	return latency, nil
+}
+
+func recordDiscardedLatency(reason string) {
+	latencySamplesDiscarded.WithLabelValues(reason).Inc()
+	summary.add(&summary.latencySamplesDiscarded, 1)
+}
+
+var latencySamplesDiscarded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "latency_samples_discarded",
+	Help: "The number of latency samples discarded because of clock skew, by reason",
+}, []string{"reason"})
@@ -0,0 +1,61 @@
+package generator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendLog_Lookup(t *testing.T) {
+	l := &sendLog{}
+	start := time.Now()
+	l.record(2000, start.Add(time.Second))
+	l.record(1000, start)
+	l.record(3000, start.Add(2*time.Second))
+
+	at, ok := l.lookup(2000)
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second), at)
+	// Truncated to the millisecond by the database
+	at, ok = l.lookup(1500)
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second), at)
+	l.record(5500, start.Add(3*time.Second))
+	_, ok = l.lookup(4000)
+	assert.False(t, ok)
+	_, ok = l.lookup(6000)
+	assert.False(t, ok)
+
+	// Sends older than sendLogMaxAge are forgotten
+	l.record(9000, start.Add(sendLogMaxAge+time.Second+time.Millisecond))
+	_, ok = l.lookup(1000)
+	assert.False(t, ok)
+	_, ok = l.lookup(3000)
+	assert.True(t, ok)
+}
+
+func TestMeasureLatency(t *testing.T) {
+	// Stamped by this replica, measured with the monotonic clock even if the timestamp was rewritten to the millisecond
+	stamp := stampNow()
+	latency, err := MeasureLatency(time.UnixMilli(stamp/1000), time.Hour)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, latency, time.Duration(0))
+	assert.Less(t, latency, time.Second)
+
+	// Stamped by another replica
+	latency, err = MeasureLatency(time.Now().Add(-time.Minute), time.Hour)
+	assert.Nil(t, err)
+	assert.InDelta(t, time.Minute, latency, float64(time.Second))
+
+	negative := testutil.ToFloat64(latencySamplesDiscarded.WithLabelValues(DiscardNegative))
+	_, err = MeasureLatency(time.Now().Add(time.Minute), time.Hour)
+	assert.NotNil(t, err)
+	assert.Equal(t, negative+1, testutil.ToFloat64(latencySamplesDiscarded.WithLabelValues(DiscardNegative)))
+
+	implausible := testutil.ToFloat64(latencySamplesDiscarded.WithLabelValues(DiscardImplausible))
+	_, err = MeasureLatency(time.Now().Add(-2*time.Hour), time.Hour)
+	assert.NotNil(t, err)
+	assert.Equal(t, implausible+1, testutil.ToFloat64(latencySamplesDiscarded.WithLabelValues(DiscardImplausible)))
+}
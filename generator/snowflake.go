@@ -34,9 +34,10 @@ type Snowflake struct {
 	AWSRegion           string
 	Table               string
 	DBConnection        *sql.DB
+	Timeouts            Timeouts
 }
 
-func (r *Snowflake) SendPatch(docs []interface{}) error {
+func (r *Snowflake) SendPatch(ctx context.Context, docs []interface{}) error {
 	//TODO implement me
 	panic("implement me")
 }
@@ -49,8 +50,9 @@ func (r *Snowflake) SendPatch(docs []interface{}) error {
 //    It configures S3 bucket to trigger snowpipe to load data into snowflake table as soon as it is written to stage (s3 bucket).
 
 // SendDocument sends a batch of documents to Snowflake
-func (r *Snowflake) SendDocument(docs []any) error {
-	ctx := context.TODO()
+func (r *Snowflake) SendDocument(ctx context.Context, docs []any) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Write)
+	defer cancel()
 	numDocs := len(docs)
 	numEventIngested.Add(float64(numDocs))
 
@@ -67,26 +69,38 @@ func (r *Snowflake) SendDocument(docs []any) error {
 	data := bytes.NewReader(jsonBody)
 
 	// Upload the file to S3.
+	start := time.Now()
 	result, err := uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket: &r.StageS3BucketName,
 		Key:    aws.String(time.Now().String()),
 		Body:   data,
 	})
+	RecordRequest("snowflake", RequestInsert, len(jsonBody), start, err == nil)
 	if err != nil {
-		recordWritesErrored(float64(numDocs))
+		RecordWrites(RequestInsert, 0, numDocs)
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
 	fmt.Printf("file uploaded to, %s\n", result.Location)
-	recordWritesCompleted(float64(numDocs))
+	RecordWrites(RequestInsert, numDocs, 0)
 
 	return nil
 }
 
 // GetLatestTimestamp returns the latest _event_time in Snowflake
-func (r *Snowflake) GetLatestTimestamp() (time.Time, error) {
+func (r *Snowflake) GetLatestTimestamp(ctx context.Context) (time.Time, error) {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Query)
+	defer cancel()
+
+	// When only polling latency of an earlier run, the connection and table were not set up by ConfigureDestination
+	if err := r.connect(); err != nil {
+		return time.Time{}, err
+	}
+	if r.Table == "" {
+		r.Table = r.tableName()
+	}
 
 	getLatestTimeStampQuery := "select JSONTEXT:data[0]._event_time AS unixtime from " + r.Table + " where JSONTEXT:data[0].generator_identifier = '" + r.GeneratorIdentifier + "' ORDER BY JSONTEXT:data[0]._event_time DESC limit 1"
-	rows, err := r.DBConnection.Query(getLatestTimeStampQuery)
+	rows, err := r.DBConnection.QueryContext(ctx, getLatestTimeStampQuery)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("failed to run a query. %v, err: %v", getLatestTimeStampQuery, err)
 	}
@@ -117,8 +131,9 @@ func (r *Snowflake) GetLatestTimestamp() (time.Time, error) {
 }
 
 // ConfigureDestination is used to make configuration changes to the Snowflake instance for sending documents.
-func (r *Snowflake) ConfigureDestination() error {
-	ctx := context.TODO()
+func (r *Snowflake) ConfigureDestination(ctx context.Context) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Configure)
+	defer cancel()
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(r.AWSRegion))
 	if err != nil {
 		return fmt.Errorf("unable to load SDK config, %v", err)
@@ -128,32 +143,14 @@ func (r *Snowflake) ConfigureDestination() error {
 		return fmt.Errorf("unable retrieve credentials, %v", err)
 	}
 
-	snowflakeConfig := &snowflake.Config{
-		Account:   r.Account,
-		User:      r.User,
-		Password:  r.Password,
-		Database:  r.Database,
-		Warehouse: r.Warehouse,
-		Schema:    r.Schema,
-	}
-
-	// create DSN for snowflake
-	dsn, err := snowflake.DSN(snowflakeConfig)
-
-	if err != nil {
-		return fmt.Errorf("failed to create DSN to connect snowflake: %w", err)
-	}
-
-	// open a connection with snowflake
-	r.DBConnection, err = sql.Open("snowflake", dsn)
-	if err != nil {
-		return fmt.Errorf("failed to open a connection with snowflake: %w", err)
+	if err := r.connect(); err != nil {
+		return err
 	}
 
 	// create stage
-	stageName := "perfstage" + r.GeneratorIdentifier
+	stageName := r.stageName()
 	createStageQuery := "create stage " + stageName + " url='s3://" + r.StageS3BucketName + "' credentials = (AWS_KEY_ID = '" + creds.AccessKeyID + "' AWS_SECRET_KEY = '" + creds.SecretAccessKey + "' );"
-	_, err = r.DBConnection.Query(createStageQuery)
+	_, err = r.DBConnection.QueryContext(ctx, createStageQuery)
 
 	if err != nil {
 		return fmt.Errorf("failed to run a query. %v, err: %v", createStageQuery, err)
@@ -161,9 +158,9 @@ func (r *Snowflake) ConfigureDestination() error {
 	fmt.Println("created a stage named: ", stageName)
 
 	// create table
-	tableName := "perftable" + r.GeneratorIdentifier
+	tableName := r.tableName()
 	createTableQuery := "create table " + tableName + " ( jsontext variant );"
-	_, err = r.DBConnection.Query(createTableQuery)
+	_, err = r.DBConnection.QueryContext(ctx, createTableQuery)
 	if err != nil {
 		return fmt.Errorf("failed to run a query. %v, err: %v", createTableQuery, err)
 	}
@@ -171,9 +168,9 @@ func (r *Snowflake) ConfigureDestination() error {
 	r.Table = tableName
 
 	// create pipe which will ingest data from s3 to snowflake table
-	pipeName := "perfpipe" + r.GeneratorIdentifier
+	pipeName := r.pipeName()
 	createPipeQuery := "create pipe " + pipeName + " auto_ingest=true as copy into " + tableName + " from @" + stageName + " file_format = (type = 'JSON');"
-	_, err = r.DBConnection.Query(createPipeQuery)
+	_, err = r.DBConnection.QueryContext(ctx, createPipeQuery)
 	if err != nil {
 		return fmt.Errorf("failed to run a query. %v, err: %v", createPipeQuery, err)
 	}
@@ -181,7 +178,7 @@ func (r *Snowflake) ConfigureDestination() error {
 
 	// get the list of pipes and extract the notification channel for the pipe we created earlier
 	showPipeQuery := "show pipes"
-	rows, err := r.DBConnection.Query(showPipeQuery)
+	rows, err := r.DBConnection.QueryContext(ctx, showPipeQuery)
 	if err != nil {
 		return fmt.Errorf("failed to run a query. %v, err: %v", showPipeQuery, err)
 	}
@@ -226,3 +223,99 @@ func (r *Snowflake) ConfigureDestination() error {
 
 	return nil
 }
+
+// TeardownDestination drops the pipe, table and stage created by ConfigureDestination for the generator identifier.
+// The S3 bucket and its event notification are left as they are, as the bucket is not created by rockbench.
+func (r *Snowflake) TeardownDestination(ctx context.Context) error {
+	ctx, cancel := WithTimeout(ctx, r.Timeouts.Configure)
+	defer cancel()
+	if err := r.connect(); err != nil {
+		return err
+	}
+
+	// The pipe loads into the table from the stage, so is dropped first
+	queries := []string{
+		"drop pipe if exists " + r.pipeName(),
+		"drop table if exists " + r.tableName(),
+		"drop stage if exists " + r.stageName(),
+	}
+	for _, query := range queries {
+		if _, err := r.DBConnection.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to run a query. %v, err: %v", query, err)
+		}
+		fmt.Println("ran: ", query)
+	}
+	return nil
+}
+
+// connect opens the connection with Snowflake, unless it is open already
+func (r *Snowflake) connect() error {
+	if r.DBConnection != nil {
+		return nil
+	}
+
+	snowflakeConfig := &snowflake.Config{
+		Account:   r.Account,
+		User:      r.User,
+		Password:  r.Password,
+		Database:  r.Database,
+		Warehouse: r.Warehouse,
+		Schema:    r.Schema,
+	}
+
+	// create DSN for snowflake
+	dsn, err := snowflake.DSN(snowflakeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create DSN to connect snowflake: %w", err)
+	}
+
+	// open a connection with snowflake
+	r.DBConnection, err = sql.Open("snowflake", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open a connection with snowflake: %w", err)
+	}
+	return nil
+}
+
+func (r *Snowflake) stageName() string {
+	return "perfstage" + r.GeneratorIdentifier
+}
+
+func (r *Snowflake) tableName() string {
+	return "perftable" + r.GeneratorIdentifier
+}
+
+func (r *Snowflake) pipeName() string {
+	return "perfpipe" + r.GeneratorIdentifier
+}
+
+func init() {
+	Register(Registration{
+		Name: "snowflake",
+		Options: append([]Option{
+			{Name: "account", Env: "SNOWFLAKE_ACCOUNT", Required: true},
+			{Name: "user", Env: "SNOWFLAKE_USER", Required: true},
+			{Name: "password", Env: "SNOWFLAKE_PASSWORD", Required: true, Secret: true},
+			{Name: "warehouse", Env: "SNOWFLAKE_WAREHOUSE", Required: true},
+			{Name: "database", Env: "SNOWFLAKE_DATABASE", Required: true},
+			{Name: "schema", Env: "SNOWFLAKE_SCHEMA", Default: "PUBLIC"},
+			{Name: "stage_s3_bucket_name", Env: "SNOWFLAKE_STAGES3BUCKETNAME", Required: true},
+			{Name: "aws_region", Env: "AWS_REGION", Required: true},
+		}, TimeoutOptions("SNOWFLAKE")...),
+		Capabilities: Capabilities{LatencyQuery: true},
+		New: func(s Settings) (Destination, error) {
+			return &Snowflake{
+				Account:             s.Options.String("account"),
+				User:                s.Options.String("user"),
+				Password:            s.Options.String("password"),
+				Warehouse:           s.Options.String("warehouse"),
+				Database:            s.Options.String("database"),
+				Schema:              s.Options.String("schema"),
+				GeneratorIdentifier: s.GeneratorIdentifier,
+				StageS3BucketName:   s.Options.String("stage_s3_bucket_name"),
+				AWSRegion:           s.Options.String("aws_region"),
+				Timeouts:            s.Options.Timeouts(),
+			}, nil
+		},
+	})
+}
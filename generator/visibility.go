@@ -0,0 +1,186 @@
+package generator
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ProbeField holds the probe token of documents traced by a VisibilityTracker
+const ProbeField = "_probe"
+
+// maxProbesPerQuery bounds the number of probes a single visibility query asks for, the oldest are asked for first
+const maxProbesPerQuery = 500
+
+// VisibilityDestination is implemented by destinations which can tell whether traced documents are visible to queries
+type VisibilityDestination interface {
+	// VisibleProbes returns the tokens, out of tokens, of the documents with a ProbeField which queries return
+	VisibleProbes(ctx context.Context, tokens []string) ([]string, error)
+}
+
+// VisibilityTracker measures the data latency of individual documents. A sample of the documents sent carry a random
+// probe token, and the tracker records when each was sent, with the monotonic clock, until a query finds it.
+//
+// Unlike polling the latest timestamp, where the fastest document hides all the others, this gives a distribution of
+// the latency of every traced document, and counts documents which never became visible within the timeout. The
+// latency is measured when a poll finds a document, so it's only as precise as the poll interval.
+type VisibilityTracker struct {
+	sampleRate float64
+	timeout    time.Duration
+
+	mu     sync.Mutex
+	random *rand.Rand
+	// pending are the send times of the probes not found yet, by token
+	pending map[string]time.Time
+}
+
+// NewVisibilityTracker creates a tracker probing sampleRate of the documents sent, from 0 to 1. Probes not found
+// within timeout of being sent count as never observed.
+func NewVisibilityTracker(sampleRate float64, timeout time.Duration) *VisibilityTracker {
+	return &VisibilityTracker{
+		sampleRate: sampleRate,
+		timeout:    timeout,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		pending:    make(map[string]time.Time),
+	}
+}
+
+// Tag adds a probe token to a sample of docs right before they are sent, returning the tokens to pass to Sent
+func (t *VisibilityTracker) Tag(docs []interface{}) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var tokens []string
+	now := time.Now()
+	for _, doc := range docs {
+		mdoc, ok := doc.(map[string]interface{})
+		if !ok || t.random.Float64() >= t.sampleRate {
+			continue
+		}
+		// Lower case letters only, so text analysis, e.g. Elastic's, keeps the token as it is
+		token := strings.ToLower(randomLetters(t.random, 24))
+		mdoc[ProbeField] = token
+		t.pending[token] = now
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// Sent reports whether the documents tagged with tokens were written. Probes of documents which failed to be written
+// are dropped, as they would never be found.
+func (t *VisibilityTracker) Sent(tokens []string, written bool) {
+	if len(tokens) == 0 {
+		return
+	}
+	if written {
+		probesSent.Add(float64(len(tokens)))
+		summary.add(&summary.probesSent, float64(len(tokens)))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, token := range tokens {
+		delete(t.pending, token)
+	}
+}
+
+// Poll asks d which of the oldest pending probes are visible and records their latency. Probes pending for longer
+// than the timeout are counted as never observed and given up on.
+func (t *VisibilityTracker) Poll(ctx context.Context, d VisibilityDestination) error {
+	tokens := t.oldestPending(maxProbesPerQuery)
+	if len(tokens) == 0 {
+		return nil
+	}
+	visible, err := d.VisibleProbes(ctx, tokens)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, token := range visible {
+		sentAt, ok := t.pending[token]
+		if !ok {
+			continue
+		}
+		delete(t.pending, token)
+		recordVisibilityLatency(now.Sub(sentAt))
+	}
+	for token, sentAt := range t.pending {
+		if now.Sub(sentAt) > t.timeout {
+			delete(t.pending, token)
+			probesNeverObserved.Inc()
+			summary.add(&summary.probesNeverObserved, 1)
+		}
+	}
+	probesPending.Set(float64(len(t.pending)))
+	summary.setProbesPending(len(t.pending))
+	return err
+}
+
+// Run polls d every interval until ctx is cancelled
+func (t *VisibilityTracker) Run(ctx context.Context, d VisibilityDestination, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.Poll(ctx, d); err != nil && ctx.Err() == nil {
+				log.Printf("failed to query visible probes: %v", err)
+			}
+		}
+	}
+}
+
+// oldestPending returns up to n pending tokens, the oldest first
+func (t *VisibilityTracker) oldestPending(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tokens := make([]string, 0, len(t.pending))
+	for token := range t.pending {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return t.pending[tokens[i]].Before(t.pending[tokens[j]])
+	})
+	if len(tokens) > n {
+		tokens = tokens[:n]
+	}
+	return tokens
+}
+
+func recordVisibilityLatency(latency time.Duration) {
+	visibilityLatencySeconds.Observe(latency.Seconds())
+	summary.addVisibilityLatency(float64(latency.Microseconds()))
+}
+
+var (
+	visibilityLatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "visibility_latency_seconds",
+		Help:    "Time in seconds from sending a traced document until a query found it",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+
+	probesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "probes_sent",
+		Help: "The total number of traced documents written",
+	})
+
+	probesNeverObserved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "probes_never_observed",
+		Help: "The total number of traced documents queries didn't find within TRACE_TIMEOUT",
+	})
+
+	probesPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "probes_pending",
+		Help: "The number of traced documents sent which queries haven't found yet",
+	})
+)
@@ -0,0 +1,79 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// visibleProbes is a VisibilityDestination returning the probes it was given
+type visibleProbes struct {
+	visible map[string]bool
+	err     error
+}
+
+func (v visibleProbes) VisibleProbes(_ context.Context, tokens []string) ([]string, error) {
+	var visible []string
+	for _, token := range tokens {
+		if v.visible[token] {
+			visible = append(visible, token)
+		}
+	}
+	return visible, v.err
+}
+
+func TestVisibilityTracker_Tag(t *testing.T) {
+	tracker := NewVisibilityTracker(0.5, time.Minute)
+	docs := make([]interface{}, 1000)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"_id": formatDocId(i)}
+	}
+
+	tokens := tracker.Tag(docs)
+	assert.InDelta(t, 500, len(tokens), 100)
+	tagged := 0
+	for _, doc := range docs {
+		if token, ok := doc.(map[string]interface{})[ProbeField].(string); ok {
+			assert.Regexp(t, "^[a-z]{24}$", token)
+			tagged++
+		}
+	}
+	assert.Equal(t, len(tokens), tagged)
+
+	// Probes of failed writes are never looked for
+	tracker.Sent(tokens, false)
+	assert.Empty(t, tracker.oldestPending(maxProbesPerQuery))
+}
+
+func TestVisibilityTracker_Poll(t *testing.T) {
+	StartRun(RunInfo{})
+	tracker := NewVisibilityTracker(1, time.Hour)
+	docs := []interface{}{map[string]interface{}{}, map[string]interface{}{}, map[string]interface{}{}}
+	tokens := tracker.Tag(docs)
+	tracker.Sent(tokens, true)
+	assert.Len(t, tokens, 3)
+
+	d := visibleProbes{visible: map[string]bool{tokens[0]: true}}
+	assert.Nil(t, tracker.Poll(context.Background(), d))
+	d.visible[tokens[1]] = true
+	d.err = errors.New("partial failure")
+	assert.EqualError(t, tracker.Poll(context.Background(), d), "partial failure")
+
+	r := BuildReport()
+	assert.Equal(t, int64(3), r.ProbesSent)
+	assert.Equal(t, 2, r.VisibilityLatency.Samples)
+	assert.Equal(t, int64(1), r.ProbesPending)
+	assert.Equal(t, int64(0), r.ProbesNeverObserved)
+
+	// The last probe is given up on after the timeout
+	tracker.timeout = 0
+	d.err = nil
+	assert.Nil(t, tracker.Poll(context.Background(), d))
+	r = BuildReport()
+	assert.Equal(t, int64(1), r.ProbesNeverObserved)
+	assert.Equal(t, int64(0), r.ProbesPending)
+	assert.Equal(t, 2, r.VisibilityLatency.Samples)
+}
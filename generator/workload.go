@@ -0,0 +1,239 @@
+package generator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operation is the kind of write a batch of a workload makes
+type Operation string
+
+const (
+	// Insert writes new documents
+	Insert Operation = "insert"
+	// Upsert fully replaces existing documents with new ones with the same id
+	Upsert Operation = "upsert"
+	// PatchReplace patches existing documents, replacing the value of a field
+	PatchReplace Operation = "patch_replace"
+	// PatchAdd patches existing documents, adding fields or array members
+	PatchAdd Operation = "patch_add"
+	// Delete deletes existing documents
+	Delete Operation = "delete"
+)
+
+// Operations are all the operations a workload can be made of
+var Operations = []Operation{Insert, Upsert, PatchReplace, PatchAdd, Delete}
+
+// Valid returns whether op is one of Operations
+func (op Operation) Valid() bool {
+	for _, o := range Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPatch returns whether op is sent with SendPatch
+func (op Operation) IsPatch() bool {
+	return op == PatchReplace || op == PatchAdd
+}
+
+// TargetsExisting returns whether op picks documents which were written before, which needs sequential ids
+func (op Operation) TargetsExisting() bool {
+	return op == Upsert || op.IsPatch() || op == Delete
+}
+
+// WorkloadOperation is an operation of a workload, getting Weight out of the total weight of its batches
+type WorkloadOperation struct {
+	Op     Operation
+	Weight float64
+}
+
+// Batch is a batch of a single operation. Docs are the documents to send, Patches the patches, encoded when the batch
+// is sent, and IDs the ids to delete.
+type Batch struct {
+	Op      Operation
+	Docs    []interface{}
+	Patches []Patch
+	IDs     []string
+
+	// encoder renders Patches in the format of the destination
+	encoder PatchEncoder
+	// acknowledge reports that the documents of an insert or upsert were written or not, so they can be targeted
+	acknowledge func(written bool)
+	// tracker traces a sample of the documents of an insert or upsert, if set
+	tracker *VisibilityTracker
+}
+
+// Len returns the number of documents the batch writes, patches or deletes
+func (b Batch) Len() int {
+	switch {
+	case b.Op == Delete:
+		return len(b.IDs)
+	case b.Op.IsPatch():
+		return len(b.Patches)
+	default:
+		return len(b.Docs)
+	}
+}
+
+// Send sends the batch to d with the method of its operation. Empty batches, e.g. patches when no documents exist yet,
+// are skipped.
+func (b Batch) Send(ctx context.Context, d Destination) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	workloadBatches.WithLabelValues(string(b.Op)).Inc()
+
+	var err error
+	switch {
+	case b.Op == Delete:
+		dd, ok := d.(DeleteDestination)
+		if !ok {
+			return errors.New("destination does not support deletes")
+		}
+		err = dd.SendDelete(ctx, b.IDs)
+	case b.Op.IsPatch():
+		if b.encoder == nil {
+			return errors.New("patches need a patch encoder")
+		}
+		err = d.SendPatch(ctx, EncodePatches(b.Patches, b.encoder))
+	default:
+		StampDocs(b.Docs)
+		var probes []string
+		if b.tracker != nil {
+			probes = b.tracker.Tag(b.Docs)
+		}
+		err = d.SendDocument(ctx, b.Docs)
+		if b.tracker != nil {
+			b.tracker.Sent(probes, err == nil)
+		}
+		if b.acknowledge != nil {
+			b.acknowledge(err == nil)
+		}
+	}
+	return err
+}
+
+// Discard reports that the batch will never be sent, so the documents it would have written are never targeted
+func (b Batch) Discard() {
+	if b.acknowledge != nil {
+		b.acknowledge(false)
+	}
+}
+
+// Workload generates batches of a weighted mix of operations. It's safe for concurrent use, so it can be used as the
+// generate function of a BatchPipeline.
+type Workload struct {
+	g       *Generator
+	encoder PatchEncoder
+	ops     []WorkloadOperation
+	tracker *VisibilityTracker
+
+	mu sync.Mutex
+	// current and total are the state of the smooth weighted round robin picking operations
+	current []float64
+	total   float64
+}
+
+// NewWorkload creates a workload of ops, generating documents and patches with g. encoder renders the patches and is
+// only needed if ops include patches.
+func NewWorkload(g *Generator, encoder PatchEncoder, ops []WorkloadOperation) *Workload {
+	w := &Workload{
+		g:       g,
+		encoder: encoder,
+		ops:     ops,
+		current: make([]float64, len(ops)),
+	}
+	for _, op := range ops {
+		w.total += op.Weight
+	}
+	return w
+}
+
+// Trace makes inserts and upserts trace a sample of their documents with t
+func (w *Workload) Trace(t *VisibilityTracker) {
+	w.tracker = t
+}
+
+// Next picks the operation of the next batch. Operations are interleaved with a smooth weighted round robin, so every
+// operation gets its share of any stretch of batches rather than only on average, e.g. a 70/25/5 mix makes exactly
+// 70, 25 and 5 batches of every 100.
+func (w *Workload) Next() Operation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best := 0
+	for i, op := range w.ops {
+		w.current[i] += op.Weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return w.ops[best].Op
+}
+
+// NextBatch picks the operation of the next batch and generates it
+func (w *Workload) NextBatch() (Batch, error) {
+	return w.Generate(w.Next())
+}
+
+// Generate generates a batch of op
+func (w *Workload) Generate(op Operation) (Batch, error) {
+	var docs []interface{}
+	var err error
+	switch op {
+	case Insert:
+		docs, err = w.g.GenerateDocs()
+	case Upsert:
+		docs, err = w.g.GenerateUpserts()
+	case PatchReplace, PatchAdd:
+		if w.encoder == nil {
+			return Batch{}, errors.New("patches need a patch encoder")
+		}
+		patches, err := w.g.GeneratePatches(op, w.g.BatchSize())
+		if err != nil {
+			return Batch{}, err
+		}
+		return Batch{Op: op, Patches: patches, encoder: w.encoder}, nil
+	case Delete:
+		ids, err := w.g.GenerateDeletes(w.g.BatchSize())
+		if err != nil {
+			return Batch{}, err
+		}
+		return Batch{Op: op, IDs: ids}, nil
+	default:
+		return Batch{}, fmt.Errorf("unsupported operation %q", op)
+	}
+	if err != nil {
+		return Batch{}, err
+	}
+	batch := Batch{Op: op, Docs: docs, tracker: w.tracker}
+	if op == Insert || op == Upsert {
+		ids := docIDs(docs)
+		batch.acknowledge = func(written bool) { w.g.acknowledge(ids, written) }
+	}
+	return batch, nil
+}
+
+// String describes the mix, e.g. "insert 70%, patch_replace 25%, delete 5%"
+func (w *Workload) String() string {
+	parts := make([]string, len(w.ops))
+	for i, op := range w.ops {
+		parts[i] = fmt.Sprintf("%s %.0f%%", op.Op, 100*op.Weight/w.total)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var workloadBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "workload_batches",
+	Help: "The number of batches sent by operation",
+}, []string{"operation"})
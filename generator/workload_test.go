@@ -0,0 +1,133 @@
+package generator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkload_Mix(t *testing.T) {
+	w := NewWorkload(NewGenerator(DocumentSpec{BatchSize: 1, IdMode: "sequential"}), nil, []WorkloadOperation{
+		{Op: Insert, Weight: 70},
+		{Op: Upsert, Weight: 25},
+		{Op: Delete, Weight: 5},
+	})
+	assert.Equal(t, "insert 70%, upsert 25%, delete 5%", w.String())
+
+	counts := make(map[Operation]int)
+	for i := 0; i < 100; i++ {
+		counts[w.Next()]++
+	}
+	assert.Equal(t, map[Operation]int{Insert: 70, Upsert: 25, Delete: 5}, counts)
+
+	// Batches of the same operation are spread out rather than sent back to back
+	w = NewWorkload(NewGenerator(DocumentSpec{}), nil, []WorkloadOperation{{Op: Insert, Weight: 1}, {Op: Delete, Weight: 1}})
+	assert.Equal(t, []Operation{Insert, Delete, Insert, Delete}, []Operation{w.Next(), w.Next(), w.Next(), w.Next()})
+}
+
+func TestWorkload_Deletes(t *testing.T) {
+	g := NewGenerator(DocumentSpec{BatchSize: 10, IdMode: "sequential", NumClusters: -1})
+	g.SetMaxDoc(50)
+	w := NewWorkload(g, nullPatchEncoder{}, []WorkloadOperation{
+		{Op: Insert, Weight: 1},
+		{Op: Upsert, Weight: 3},
+		{Op: Delete, Weight: 2},
+	})
+
+	// A document is deleted at most once, and not upserted once it is deleted
+	deletedIDs := make(map[string]bool)
+	for i := 0; i < 60; i++ {
+		batch, err := w.NextBatch()
+		assert.Nil(t, err)
+		for _, id := range batch.IDs {
+			assert.False(t, deletedIDs[id], "deleted twice: %s", id)
+			deletedIDs[id] = true
+		}
+		if batch.Op == Upsert {
+			for _, doc := range batch.Docs {
+				id := doc.(map[string]interface{})["_id"].(string)
+				assert.False(t, deletedIDs[id], "upserted after delete: %s", id)
+			}
+		}
+		assert.Nil(t, batch.Send(context.Background(), &Null{}))
+	}
+	assert.NotEmpty(t, deletedIDs)
+
+	// Patches only target live documents
+	patches, err := w.Generate(PatchReplace)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, patches.Patches)
+	for _, p := range patches.Patches {
+		assert.False(t, deletedIDs[p.ID])
+	}
+	ids := g.ids.(*SequentialIDs)
+	for _, id := range ids.PickExisting(ids.Next()) {
+		assert.False(t, deletedIDs[id])
+	}
+}
+
+func TestWorkload_TargetsAcknowledged(t *testing.T) {
+	g := NewGenerator(DocumentSpec{BatchSize: 5, IdMode: "sequential"})
+	w := NewWorkload(g, nullPatchEncoder{}, []WorkloadOperation{{Op: Insert, Weight: 1}})
+
+	// Nothing is targeted while the inserts are queued
+	first, err := w.Generate(Insert)
+	assert.Nil(t, err)
+	second, err := w.Generate(Insert)
+	assert.Nil(t, err)
+	patches, err := w.Generate(PatchReplace)
+	assert.Nil(t, err)
+	assert.Empty(t, patches.Patches)
+
+	// Writes finishing out of order only count once the ones before them finished
+	assert.Nil(t, second.Send(context.Background(), &Null{}))
+	patches, err = w.Generate(PatchReplace)
+	assert.Nil(t, err)
+	assert.Empty(t, patches.Patches)
+	first.Discard()
+
+	// The discarded documents were never written
+	patches, err = w.Generate(PatchReplace)
+	assert.Nil(t, err)
+	assert.Len(t, patches.Patches, 5)
+	written := make(map[string]bool)
+	for _, doc := range second.Docs {
+		written[doc.(map[string]interface{})["_id"].(string)] = true
+	}
+	for _, p := range patches.Patches {
+		assert.True(t, written[p.ID], "patched a document never written: %s", p.ID)
+	}
+}
+
+func TestWorkload_Seeded(t *testing.T) {
+	generate := func(seed int64) []Batch {
+		g := NewGenerator(DocumentSpec{BatchSize: 5, IdMode: "sequential", NumClusters: 10, Seed: seed, DocSize: DocSize{Min: 500, Max: 5000}})
+		g.SetMaxDoc(20)
+		w := NewWorkload(g, nullPatchEncoder{}, []WorkloadOperation{
+			{Op: Insert, Weight: 4},
+			{Op: Upsert, Weight: 2},
+			{Op: PatchReplace, Weight: 2},
+			{Op: PatchAdd, Weight: 1},
+			{Op: Delete, Weight: 1},
+		})
+		var batches []Batch
+		for i := 0; i < 30; i++ {
+			batch, err := w.NextBatch()
+			assert.Nil(t, err)
+			// Timestamps are the only thing that differs, the acknowledge callbacks can't be compared
+			batch.acknowledge = nil
+			for _, doc := range batch.Docs {
+				delete(doc.(map[string]interface{}), "_event_time")
+				delete(doc.(map[string]interface{}), "_ts")
+			}
+			batches = append(batches, batch)
+		}
+		return batches
+	}
+
+	first := generate(ReplicaSeed(42, 0))
+	assert.Equal(t, first, generate(ReplicaSeed(42, 0)))
+	assert.NotEqual(t, first, generate(ReplicaSeed(42, 1)))
+	assert.NotEqual(t, first, generate(ReplicaSeed(43, 0)))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// adaptiveChange is how much the latency must change from one sample to the next, relative to the previous one, for
+// an adaptive schedule to poll more often
+const adaptiveChange = 0.2
+
+// pollSchedule decides when the latency is polled next on this replica, see LatencyConfig
+type pollSchedule struct {
+	// period is the time between polls, and initialDelay the time before the first one
+	period       time.Duration
+	initialDelay time.Duration
+	jitter       float64
+	// adaptive schedules poll down to every minPeriod while the latency changes
+	adaptive  bool
+	minPeriod time.Duration
+
+	random *rand.Rand
+	// current is the period of an adaptive schedule, and last the latest latency sample, 0 if there is none yet
+	current time.Duration
+	last    time.Duration
+}
+
+// newPollSchedule creates the schedule of replica replicaIndex out of replicas
+func newPollSchedule(c LatencyConfig, replicas int, replicaIndex int) *pollSchedule {
+	s := &pollSchedule{
+		period:    c.PollInterval,
+		jitter:    c.Jitter,
+		adaptive:  c.Adaptive,
+		minPeriod: c.MinInterval,
+		random:    rand.New(rand.NewSource(time.Now().UnixNano() + int64(replicaIndex))),
+	}
+	switch c.Coordination {
+	case "random":
+		s.period = time.Duration(replicas) * c.PollInterval
+		// Sleep a random amount to space requests out between each other
+		s.initialDelay = time.Duration(s.random.Int63n(int64(s.period)))
+	case "staggered":
+		s.period = time.Duration(replicas) * c.PollInterval
+		s.initialDelay = time.Duration(replicaIndex) * c.PollInterval
+	}
+	if s.minPeriod > s.period {
+		s.minPeriod = s.period
+	}
+	s.current = s.period
+	return s
+}
+
+// next returns the time until the next poll
+func (s *pollSchedule) next() time.Duration {
+	period := s.period
+	if s.adaptive {
+		period = s.current
+	}
+	if s.jitter > 0 {
+		period += time.Duration(s.jitter * (2*s.random.Float64() - 1) * float64(period))
+	}
+	return period
+}
+
+// observe adapts the schedule to a latency sample. An adaptive schedule halves its period down to minPeriod while the
+// latency changes by more than adaptiveChange from one sample to the next, and doubles it back up to period otherwise.
+func (s *pollSchedule) observe(latency time.Duration) {
+	last := s.last
+	s.last = latency
+	if !s.adaptive || last <= 0 {
+		return
+	}
+
+	change := float64(latency-last) / float64(last)
+	if change > adaptiveChange || change < -adaptiveChange {
+		s.current /= 2
+		if s.current < s.minPeriod {
+			s.current = s.minPeriod
+		}
+	} else {
+		s.current *= 2
+		if s.current > s.period {
+			s.current = s.period
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollSchedule_Coordination(t *testing.T) {
+	c := defaultConfig().Latency
+	c.PollInterval = 10 * time.Second
+
+	s := newPollSchedule(c, 3, 2)
+	assert.Equal(t, 30*time.Second, s.period)
+	assert.Less(t, s.initialDelay, 30*time.Second)
+
+	c.Coordination = "staggered"
+	s = newPollSchedule(c, 3, 2)
+	assert.Equal(t, 30*time.Second, s.period)
+	assert.Equal(t, 20*time.Second, s.initialDelay)
+	assert.Equal(t, 30*time.Second, s.next())
+
+	c.Coordination = "none"
+	s = newPollSchedule(c, 3, 2)
+	assert.Equal(t, 10*time.Second, s.period)
+	assert.Equal(t, time.Duration(0), s.initialDelay)
+}
+
+func TestPollSchedule_Jitter(t *testing.T) {
+	c := defaultConfig().Latency
+	c.Coordination = "none"
+	c.PollInterval = 10 * time.Second
+	c.Jitter = 0.2
+
+	s := newPollSchedule(c, 1, 0)
+	for i := 0; i < 100; i++ {
+		next := s.next()
+		assert.GreaterOrEqual(t, next, 8*time.Second)
+		assert.LessOrEqual(t, next, 12*time.Second)
+	}
+}
+
+func TestPollSchedule_Adaptive(t *testing.T) {
+	c := defaultConfig().Latency
+	c.Coordination = "none"
+	c.PollInterval = 8 * time.Second
+	c.MinInterval = 3 * time.Second
+	c.Adaptive = true
+
+	s := newPollSchedule(c, 1, 0)
+	s.observe(time.Second)
+	assert.Equal(t, 8*time.Second, s.next())
+	// Polls more often while the latency changes, down to the min interval
+	s.observe(2 * time.Second)
+	assert.Equal(t, 4*time.Second, s.next())
+	s.observe(time.Second)
+	assert.Equal(t, 3*time.Second, s.next())
+	// And slows down again once it settles
+	s.observe(1100 * time.Millisecond)
+	assert.Equal(t, 6*time.Second, s.next())
+	s.observe(1100 * time.Millisecond)
+	assert.Equal(t, 8*time.Second, s.next())
+
+	c.Adaptive = false
+	s = newPollSchedule(c, 1, 0)
+	s.observe(time.Second)
+	s.observe(time.Minute)
+	assert.Equal(t, 8*time.Second, s.next())
+}
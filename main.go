@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,341 +19,457 @@ import (
 	"github.com/rockset/rockbench/generator"
 )
 
+// reportPath is where the end-of-run report is written to, reports are disabled if empty
+var reportPath string
+
 func main() {
-	// Seed so that values are random across replicas
-	rand.Seed(time.Now().UnixNano())
-	wps := mustGetEnvInt("WPS")
-	batchSize := mustGetEnvInt("BATCH_SIZE")
-	destination := strings.ToLower(mustGetEnvString("DESTINATION"))
-	numDocs := getEnvDefaultInt("NUM_DOCS", -1)
-	maxDocs := getEnvDefaultInt("MAX_DOCS", -1) // Used to track the known max doc id for upserts to update existing collections
-	mode := getEnvDefault("MODE", "add")
-	idMode := getEnvDefault("ID_MODE", "uuid")
-	patchMode := getEnvDefault("PATCH_MODE", "replace")
-	exportMetrics := getEnvDefaultBool("EXPORT_METRICS", false)
-	trackLatency := getEnvDefaultBool("TRACK_LATENCY", false)
-	// Used to dynamically adjust the period between latency calculations to reduce the total rate of queries
-	// Ex. If we want 1 query per 25s and we have 2 replicas, the polling period should be 2 * 25s=50s for each replica.
-	// Note: Increasing the polling period often results in not enough samples for calculating p99 latency.
-	replicas := getEnvDefaultInt("REPLICAS", 1)
-	promPort := getEnvDefaultInt("PROM_PORT", 9161)
+	args := os.Args[1:]
+	// Without a subcommand, run as before so existing env var based setups, like the Docker image, keep working
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	// A bare --help lists the commands rather than only the flags of run
+	if name == "help" || (len(os.Args) == 2 && isHelpFlag(os.Args[1])) {
+		usage(os.Stdout)
+		return
+	}
 
-	// Mixed mode related settings
-	updatePercentage := getEnvDefaultInt("UPDATE_PERCENTAGE", -1) // Percentage of documents that update existing documents
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
 
-	// Clustering related settings
-	numClusters := getEnvDefaultInt("NUM_CLUSTERS", -1)                    // Number of distinct values for the cluster key
-	hotClusterPercentage := getEnvDefaultInt("HOT_CLUSTER_PERCENTAGE", -1) // Percentage of inserts/updates that go to single cluster key. Remaining percentage is uniformly distributed
+func runCommand(args []string) error {
+	flags, configPath := newFlagSet("run", "Generates documents and sends them to the destination at the configured rate, "+
+		"optionally tracking the e2e latency. This is the default command.")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	skipSetup := flags.Bool("skip-setup", false, "don't configure the destination, reuse what `rockbench setup` created for GENERATOR_IDENTIFIER")
+	_ = flags.Parse(args)
 
-	if !(patchMode == "replace" || patchMode == "add") {
-		panic("Invalid patch mode specified, expecting either 'replace' or 'add'")
-	}
-	if !(mode == "add" || mode == "patch" || mode == "add_then_patch" || mode == "mixed") {
-		panic("Invalid mode specified, expecting one of 'add', 'patch', 'add_then_patch', 'mixed'")
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
 	}
-	if !(idMode == "uuid" || idMode == "sequential") {
-		panic("Invalid idMode specified, expecting 'uuid' or 'sequential'")
+	if *printConfig {
+		out, err := cfg.YAML()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return cfg.Validate()
 	}
-
-	if mode == "patch" && idMode != "sequential" {
-		panic("Patch mode supports ID_MODE `sequential` only")
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-
-	if mode == "patch" && numDocs <= 0 {
-		panic("Patch mode requires a positive number of docs to perform patches against. Please specify a number of documents via NUM_DOCS env var.")
+	if *skipSetup && cfg.GeneratorIdentifier == "" {
+		return fmt.Errorf("--skip-setup requires GENERATOR_IDENTIFIER to be set to the identifier used with setup")
 	}
 
-	if mode == "mixed" {
-		if idMode != "sequential" {
-			panic("`mixed` MODE supports ID_MODE `sequential` only")
-		}
-		if updatePercentage < 0 || updatePercentage > 100 {
-			panic("`mixed` MODE requires a positive number between 0 and 100. Please specify the percentage of documents to be updates via UPDATE_PERCENTAGE env var")
-		}
-		if maxDocs <= 0 {
-			panic("`mixed` MODE requires a positive number for MAX_DOCS. This tracks the maximum doc id in the collection and can be used to continue adding document ids sequentially. If no documents exist, specify 1")
+	opts := runOptions{skipSetup: *skipSetup}
+	if len(cfg.Phases) > 0 {
+		opts.control = func(rc *generator.RateController, done <-chan struct{}) {
+			generator.FollowSchedule(cfg.Phases.schedule(), rc, done)
 		}
 	}
+	return run(cfg, opts)
+}
 
-	if hotClusterPercentage > 0 && numClusters < 0 {
-		panic("NUM_CLUSTERS must be specified if HOT_CLUSTER_PERCENTAGE is provided.")
+// runOptions are what the commands sending documents change about a run
+type runOptions struct {
+	// skipSetup reuses the destination configured by `rockbench setup`
+	skipSetup bool
+	// control drives the rate of the run, instead of the rate of the workload, until it returns and ends the run
+	control func(rc *generator.RateController, done <-chan struct{})
+}
+
+// run sends the workload of cfg, which must be valid, until it's done or a signal is received, and exits
+func run(cfg Config, opts runOptions) error {
+	// Seed so that latency polling and retries are jittered differently across replicas, documents have their own seed
+	rand.Seed(time.Now().UnixNano())
+	reportPath = cfg.ReportPath
+
+	client := newHTTPClient()
+
+	generatorIdentifier := cfg.GeneratorIdentifier
+	if generatorIdentifier == "" {
+		generatorIdentifier = generator.RandomString(10)
 	}
+	fmt.Println("Generator identifier: ", generatorIdentifier)
 
-	if hotClusterPercentage == 0 || hotClusterPercentage > 100 || numClusters == 0 {
-		panic("NUM_CLUSTERS must be a positive number and HOT_CLUSTER_PERCENTAGE must be greater than 0 and less than or equal to 100 if specified.")
+	documentSpec, err := cfg.documentSpec(generatorIdentifier)
+	if err != nil {
+		return err
 	}
 
-	pps := getEnvDefaultInt("PPS", wps)
-	defaultRoundTripper := http.DefaultTransport
-	defaultTransportPointer, ok := defaultRoundTripper.(*http.Transport)
-	if !ok {
-		panic(fmt.Sprintf("defaultRoundTripper not an *http.Transport"))
+	d, err := newDestination(cfg, client, generatorIdentifier)
+	if err != nil {
+		return err
+	}
+	if !opts.skipSetup {
+		if err := d.ConfigureDestination(context.Background()); err != nil {
+			return fmt.Errorf("unable to configure %s for sending documents: %w", cfg.Destination, err)
+		}
 	}
-	defaultTransport := defaultTransportPointer
-	defaultTransport.MaxIdleConns = 100
-	defaultTransport.MaxIdleConnsPerHost = 100
-	client := &http.Client{Transport: defaultTransport}
 
-	generatorIdentifier := generator.RandomString(10)
-	fmt.Println("Generator identifier: ", generatorIdentifier)
+	generator.ConfigureLatencySummaries(cfg.Latency.Objectives, cfg.Latency.MaxAge)
+	if cfg.ExportMetrics {
+		go metricListener(cfg.PromPort)
+	}
 
-	documentSpec := generator.DocumentSpec{
-		Destination:          destination,
-		GeneratorIdentifier:  generatorIdentifier,
-		BatchSize:            batchSize,
-		Mode:                 mode,
-		IdMode:               idMode,
-		UpdatePercentage:     updatePercentage,
-		NumClusters:          numClusters,
-		HotClusterPercentage: hotClusterPercentage,
+	mode := cfg.Mode
+	if len(cfg.Workload) > 0 {
+		mode = "workload"
+	}
+	generator.StartRun(generator.RunInfo{
+		GeneratorIdentifier: generatorIdentifier,
+		Destination:         cfg.Destination,
+		Mode:                mode,
+		Workload:            cfg.Workload.String(),
+		DocSize:             cfg.DocSize,
+		WPS:                 cfg.WPS,
+		BatchSize:           cfg.BatchSize,
+	})
+
+	doneChan, force := handleSignals()
+
+	stages := cfg.stages()
+	queries := &latencyQueries{maxPlausible: cfg.Latency.MaxPlausible}
+	queries.follow(stages[0].ops)
+	if cfg.TrackLatency {
+		go func() {
+			// Cancel a latency query in progress when stopping
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-doneChan
+				cancel()
+			}()
+
+			pollLatency(ctx, d, newPollSchedule(cfg.Latency, cfg.Replicas, cfg.ReplicaIndex), queries)
+		}()
 	}
 
-	var d generator.Destination
+	var tracker *generator.VisibilityTracker
+	if cfg.Trace.SampleRate > 0 {
+		// Validation made sure the destination supports visibility queries
+		vd := d.(generator.VisibilityDestination)
+		tracker = generator.NewVisibilityTracker(cfg.Trace.SampleRate, cfg.Trace.Timeout)
+		go func() {
+			// Cancel a visibility query in progress when stopping
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-doneChan
+				cancel()
+			}()
+			tracker.Run(ctx, vd, cfg.Trace.PollInterval)
+		}()
+	}
 
-	switch destination {
-	case "rockset":
-		apiKey := mustGetEnvString("ROCKSET_API_KEY")
-		apiServer := mustGetEnvString("ROCKSET_API_SERVER")
-		collectionPath := mustGetEnvString("ROCKSET_COLLECTION")
+	g := generator.NewGenerator(documentSpec)
+	if cfg.Mode == "patch" {
+		// must explicitly set number of docs so updates are applied evenly across document keys
+		g.SetMaxDoc(cfg.NumDocs)
+	} else if cfg.MaxDocs > 0 {
+		// Continue after the documents written by previous runs, so upserts, patches and deletes can target them
+		g.SetMaxDoc(cfg.MaxDocs)
+	}
+	if cfg.Query.QPS > 0 {
+		// Validation made sure the destination supports queries
+		qd := d.(generator.QueryDestination)
+		load := generator.NewQueryLoad(g, cfg.queryMix(documentSpec), cfg.Query.MaxInFlight)
+		log.Printf("Running %.1f queries per second out of %s", cfg.Query.QPS, load)
+		go func() {
+			// Cancel the queries in progress when stopping
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-doneChan
+				cancel()
+			}()
+			load.Run(ctx, qd, cfg.Query.QPS)
+		}()
+	}
 
-		rcollection := strings.Split(collectionPath, ".")
-		if len(rcollection) != 2 {
-			panic(fmt.Sprintf("rockset collection path should have the format <workspace_name>.<collection_name>"))
-		}
+	// A single rate controller paces every stage, so a controlled rate carries over from one to the next
+	rc := generator.NewRateController(float64(stages[0].rate), cfg.MaxInFlight)
+	var runDone <-chan struct{} = doneChan
+	if opts.control != nil {
+		controlDone := make(chan struct{})
+		go func() {
+			opts.control(rc, doneChan)
+			close(controlDone)
+		}()
+		// The run ends with the control, e.g. after the last phase
+		runDone = either(doneChan, controlDone)
+	}
 
-		d = &generator.Rockset{
-			APIKey:              apiKey,
-			APIServer:           apiServer,
-			CollectionPath:      collectionPath,
-			Client:              client,
-			GeneratorIdentifier: generatorIdentifier,
+	// Validation made sure the destination supports the operations of the workload
+	registration, _ := generator.Lookup(cfg.Destination)
+	for _, s := range stages {
+		w := generator.NewWorkload(g, registration.PatchEncoder, s.ops)
+		if tracker != nil {
+			w.Trace(tracker)
 		}
-	case "elastic":
-		esAuth := mustGetEnvString("ELASTIC_AUTH")
-		esURL := mustGetEnvString("ELASTIC_URL")
-		esIndexName := mustGetEnvString("ELASTIC_INDEX")
-
-		d = &generator.Elastic{
-			Auth:                esAuth,
-			URL:                 esURL,
-			IndexName:           esIndexName,
-			Client:              client,
-			GeneratorIdentifier: generatorIdentifier,
+		queries.follow(s.ops)
+		if opts.control != nil {
+			log.Printf("Sending %s at a controlled rate", w)
+		} else {
+			log.Printf("Sending %s at %d batches per second", w, s.rate)
+			rc.SetRate(float64(s.rate))
 		}
-	case "snowflake":
-		account := mustGetEnvString("SNOWFLAKE_ACCOUNT")
-		user := mustGetEnvString("SNOWFLAKE_USER")
-		password := mustGetEnvString("SNOWFLAKE_PASSWORD")
-		warehouse := mustGetEnvString("SNOWFLAKE_WAREHOUSE")
-		database := mustGetEnvString("SNOWFLAKE_DATABASE")
-		stageS3Bucket := mustGetEnvString("SNOWFLAKE_STAGES3BUCKETNAME")
-		awsRegion := mustGetEnvString("AWS_REGION")
-		d = &generator.Snowflake{
-			Account:             account,
-			User:                user,
-			Password:            password,
-			Warehouse:           warehouse,
-			Database:            database,
-			GeneratorIdentifier: generatorIdentifier,
-			StageS3BucketName:   stageS3Bucket,
-			AWSRegion:           awsRegion,
-			Schema:              "PUBLIC",
+		err := runStage(cfg, d, rc, w, s, runDone, force)
+		if err != nil {
+			rc.Stop()
+			log.Printf("batch generation failed: %v", err)
+			exit(1)
 		}
-		configErr := d.ConfigureDestination()
-		if configErr != nil {
-			log.Fatal("Unable to configure snowflake for sending documents: ", configErr)
+		if isDone(runDone) {
+			break
 		}
-	case "null":
-		d = &generator.Null{}
-	default:
-		log.Fatal("Unsupported destination. Supported options are Rockset, Elastic & Null")
 	}
+	rc.Stop()
 
-	if exportMetrics {
-		go metricListener(promPort)
+	if force.Err() != nil {
+		exit(1)
 	}
+	log.Printf("done")
+	exit(0)
+	return nil
+}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Kill, os.Interrupt, syscall.SIGTERM)
-
-	var doneChan = make(chan struct{}, 1)
-
-	go signalHandler(signalChan, doneChan)
-
-	if trackLatency {
+// runStage sends the batches of w paced by rc until s.limit documents were sent, if positive, doneChan is closed or a
+// batch fails to be generated, which is returned. In-flight batches are drained before returning.
+func runStage(cfg Config, d generator.Destination, rc *generator.RateController, w *generator.Workload, s stage,
+	doneChan <-chan struct{}, force context.Context) error {
+	// Sends use their own context, so they can finish after doneChan is closed, and are only cancelled if draining
+	// times out or force is cancelled
+	sendCtx, cancelSends := context.WithCancel(force)
+	generate := w.NextBatch
+	if s.limit >= 0 {
+		generate = limitGeneration(generate, s.limit)
+	}
+	pipeline := generator.NewBatchPipeline(cfg.GeneratorWorkers, cfg.GeneratorQueueSize, generate)
+	sent := 0
+	var generateErr error
+	for s.limit < 0 || sent < s.limit {
+		// when doneChan is closed, Acquire and Next return immediately
+		if !rc.Acquire(doneChan) {
+			break
+		}
+		batch, err := pipeline.Next(doneChan)
+		if err == generator.ErrPipelineStopped {
+			rc.Release()
+			break
+		}
+		if err != nil {
+			rc.Release()
+			generateErr = err
+			break
+		}
 		go func() {
-			// On average, send a request every 25s
-			pollDuration := replicas * 25
-			// Sleep a random amount to space requests out between each other
-			sleepDuration := rand.Int31n(int32(pollDuration))
-			fmt.Printf("Initial sleep of %ds and polling period of %ds\n", sleepDuration, pollDuration)
-			timer := time.NewTimer(time.Duration(sleepDuration) * time.Second)
-			defer timer.Stop()
-
-			select {
-			case <-doneChan:
-				return
-			case <-timer.C:
+			defer rc.Release()
+			if err := batch.Send(sendCtx, d); err != nil {
+				log.Printf("failed to send %s batch: %v", batch.Op, err)
 			}
+		}()
+		sent = sent + batch.Len()
+	}
+	pipeline.Stop()
+	drain(rc, cfg.DrainTimeout, cancelSends)
+	cancelSends()
+	return generateErr
+}
 
-			fmt.Printf("Sleep done. Now issuing requests to calculate e2e latency.\n")
-			// Initial request before sleeping
-			getE2ELatency(d)
+// limitGeneration stops generate once limit documents were generated. Batches generated past the limit would never be
+// sent but still take ids, so the next stage would start from a different state every run.
+func limitGeneration(generate func() (generator.Batch, error), limit int) func() (generator.Batch, error) {
+	var mu sync.Mutex
+	generated := 0
+	return func() (generator.Batch, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if generated >= limit {
+			return generator.Batch{}, generator.ErrPipelineStopped
+		}
+		batch, err := generate()
+		generated += batch.Len()
+		return batch, err
+	}
+}
 
-			t := time.NewTicker(time.Duration(pollDuration) * time.Second)
-			defer t.Stop()
+// drain waits for the batches in flight to finish, cancelling them if they take longer than timeout
+func drain(rc *generator.RateController, timeout time.Duration, cancel context.CancelFunc) {
+	log.Printf("waiting up to %s for in-flight batches to finish", timeout)
+	if rc.Drain(timeout) {
+		return
+	}
 
-			for {
-				select {
-				case <-doneChan:
-					return
-				case <-t.C:
-					getE2ELatency(d)
-				}
-			}
-		}()
+	log.Printf("in-flight batches did not finish within %s, cancelling them", timeout)
+	cancel()
+	// Cancelled requests return promptly, this only bounds the wait in case a destination ignores cancellation
+	if !rc.Drain(5 * time.Second) {
+		log.Printf("in-flight batches did not finish after being cancelled")
 	}
+}
 
-	// Write function
-	docs_written := 0
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
-	if mode == "add_then_patch" || mode == "add" || mode == "mixed" {
-		if mode == "mixed" {
-			generator.SetMaxDoc(maxDocs)
-		}
-		for numDocs < 0 || docs_written < numDocs {
-			select {
-			// when doneChan is closed, receive immediately returns the zero value
-			case <-doneChan:
-				log.Printf("done")
-				os.Exit(0)
-			case <-t.C:
-				for i := 0; i < wps; i++ {
-					// TODO: move doc generation out of this loop into a go routine that pre-generates them
-					docs, err := generator.GenerateDocs(documentSpec)
-					if err != nil {
-						log.Printf("document generation failed: %v", err)
-						os.Exit(1)
-					}
-					go func(i int) {
-						if err := d.SendDocument(docs); err != nil {
-							log.Printf("failed to send document batch %d of %d (wps): %v", i, wps, err)
-						}
-					}(i)
-					docs_written = docs_written + batchSize
-				}
-				// TODO: this does not guarantee that the writes have finished
-			}
-		}
+// newDestination creates the configured destination, which must have been validated
+func newDestination(cfg Config, client *http.Client, generatorIdentifier string) (generator.Destination, error) {
+	return generator.NewDestination(cfg.Destination, generator.Settings{
+		GeneratorIdentifier: generatorIdentifier,
+		Client:              client,
+		Retry: generator.RetryPolicy{
+			MaxAttempts:    cfg.Retry.MaxAttempts,
+			InitialBackoff: cfg.Retry.InitialBackoff,
+			MaxBackoff:     cfg.Retry.MaxBackoff,
+			MaxElapsed:     cfg.Retry.MaxElapsed,
+		},
+		Options: cfg.Destinations[cfg.Destination],
+	})
+}
+
+func isDone(doneChan <-chan struct{}) bool {
+	select {
+	case <-doneChan:
+		return true
+	default:
+		return false
 	}
+}
 
-	if mode == "add_then_patch" || mode == "patch" {
-		if mode == "patch" {
-			// must explicitly set number of docs so updates are applied evenly across document keys
-			generator.SetMaxDoc(numDocs)
-		}
-		if destination != "rockset" && destination != "elastic" {
-			panic("Patches can only be generated for Rockset or elastic at this time")
+// either returns a channel which is closed once a or b is closed
+func either(a <-chan struct{}, b <-chan struct{}) <-chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
 		}
-		patchChannel := make(chan map[string]interface{}, 1)
-		log.Printf("Sending patches in '%s' mode", patchMode)
-		if patchMode == "replace" {
-			go generator.RandomFieldReplace(destination, patchChannel)
-		} else {
-			go generator.RandomFieldAdd(destination, patchChannel)
-		}
-		for {
-			select {
-			// when doneChan is closed, receive immediately returns the zero value
-			case <-doneChan:
-				log.Printf("done")
-				os.Exit(0)
-			case <-t.C:
-				for i := 0; i < pps; i++ {
-					docs, err := generator.GeneratePatches(batchSize, destination, patchChannel)
-					if err != nil {
-						log.Printf("patch generation failed: %v", err)
-						os.Exit(1)
-					}
-					go func(i int) {
-						if err := d.SendPatch(docs); err != nil {
-							log.Printf("failed to send patch %d of %d: %v", i, pps, err)
-						}
-					}(i)
-					docs_written = docs_written + batchSize
-				}
-			}
+		close(c)
+	}()
+	return c
+}
 
-		}
+// latencyQueries are the latencies pollLatency measures, following the operations of the stage being sent. The e2e
+// latency follows _event_time, which only inserts and upserts set, and patches are measured on _ts instead. Samples
+// longer than maxPlausible are discarded, see generator.MeasureLatency.
+type latencyQueries struct {
+	writes  atomic.Bool
+	patches atomic.Bool
+
+	maxPlausible time.Duration
+}
+
+// follow measures the latencies of the operations in ops
+func (q *latencyQueries) follow(ops []generator.WorkloadOperation) {
+	writes, patches := false, false
+	for _, op := range ops {
+		writes = writes || op.Op == generator.Insert || op.Op == generator.Upsert
+		patches = patches || op.Op.IsPatch()
 	}
+	q.writes.Store(writes)
+	q.patches.Store(patches)
 }
 
-func getE2ELatency(d generator.Destination) {
-	latestTimestamp, err := d.GetLatestTimestamp()
-	now := time.Now()
-	latency := now.Sub(latestTimestamp)
+// pollLatency measures the latencies of queries on schedule, until ctx is cancelled
+func pollLatency(ctx context.Context, d generator.Destination, schedule *pollSchedule, queries *latencyQueries) {
+	fmt.Printf("Initial sleep of %s and polling period of %s\n", schedule.initialDelay, schedule.period)
+	timer := time.NewTimer(schedule.initialDelay)
+	defer timer.Stop()
 
-	if err == nil {
-		fmt.Printf("Latency: %s\n", latency)
-		generator.RecordE2ELatency(float64(latency.Microseconds()))
-	} else {
-		log.Printf("failed to get latest timestamp: %v", err)
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
 	}
-}
 
-func mustGetEnvString(env string) string {
-	v, found := os.LookupEnv(env)
-	if !found {
-		log.Fatalf("env %s must be set!", env)
+	fmt.Printf("Sleep done. Now issuing requests to calculate e2e latency.\n")
+	for {
+		if latency, ok := measureLatency(ctx, d, queries); ok {
+			schedule.observe(latency)
+		}
+		timer.Reset(schedule.next())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
 	}
-	return v
 }
 
-func mustGetEnvInt(env string) int {
-	v, found := os.LookupEnv(env)
-	if !found {
-		log.Fatalf("env %s must be set!", env)
+// measureLatency measures the latencies of queries, returning the e2e latency, or the patch latency if the e2e latency
+// isn't measured, and whether it was
+func measureLatency(ctx context.Context, d generator.Destination, queries *latencyQueries) (time.Duration, bool) {
+	var latency time.Duration
+	measured := false
+	if queries.writes.Load() {
+		latency, measured = getE2ELatency(ctx, d, queries.maxPlausible)
 	}
-	ret, err := strconv.Atoi(v)
-	if err != nil {
-		log.Fatalf("env %s is not integer!", env)
+	// Validation made sure destinations support patch latency if the run patches
+	if pd, ok := d.(generator.PatchLatencyDestination); ok && queries.patches.Load() {
+		patchLatency, patchMeasured := getPatchLatency(ctx, pd, queries.maxPlausible)
+		if !queries.writes.Load() {
+			latency, measured = patchLatency, patchMeasured
+		}
 	}
-	return ret
+	return latency, measured
 }
 
-func getEnvDefaultInt(env string, defaultValue int) int {
-	v, found := os.LookupEnv(env)
-	if !found {
-		return defaultValue
+func getE2ELatency(ctx context.Context, d generator.Destination, maxPlausible time.Duration) (time.Duration, bool) {
+	latestTimestamp, err := d.GetLatestTimestamp(ctx)
+	if err != nil {
+		log.Printf("failed to get latest timestamp: %v", err)
+		return 0, false
 	}
-	ret, err := strconv.Atoi(v)
+	latency, err := generator.MeasureLatency(latestTimestamp, maxPlausible)
 	if err != nil {
-		log.Fatalf("env %s is not integer!", env)
+		log.Printf("discarded latency sample: %v", err)
+		return 0, false
 	}
-	return ret
+
+	fmt.Printf("Latency: %s\n", latency)
+	generator.RecordE2ELatency(float64(latency.Microseconds()))
+	return latency, true
 }
 
-func getEnvDefaultBool(env string, defaultValue bool) bool {
-	v, found := os.LookupEnv(env)
-	if !found {
-		return defaultValue
+func getPatchLatency(ctx context.Context, d generator.PatchLatencyDestination, maxPlausible time.Duration) (time.Duration, bool) {
+	latestTimestamp, err := d.GetLatestPatchTimestamp(ctx)
+	if err != nil {
+		log.Printf("failed to get latest patch timestamp: %v", err)
+		return 0, false
 	}
-
-	ret, err := strconv.ParseBool(v)
+	latency, err := generator.MeasureLatency(latestTimestamp, maxPlausible)
 	if err != nil {
-		log.Fatalf("env %s is not bool!", env)
+		log.Printf("discarded patch latency sample: %v", err)
+		return 0, false
 	}
 
-	return ret
+	fmt.Printf("Patch latency: %s\n", latency)
+	generator.RecordPatchLatency(float64(latency.Microseconds()))
+	return latency, true
 }
 
-func getEnvDefault(env string, defaultValue string) string {
-	v, found := os.LookupEnv(env)
-	if !found {
-		return defaultValue
+// newHTTPClient returns a client keeping enough idle connections around for MAX_IN_FLIGHT concurrent requests
+func newHTTPClient() *http.Client {
+	defaultRoundTripper := http.DefaultTransport
+	defaultTransportPointer, ok := defaultRoundTripper.(*http.Transport)
+	if !ok {
+		panic(fmt.Sprintf("defaultRoundTripper not an *http.Transport"))
 	}
-	return v
+	defaultTransport := defaultTransportPointer
+	defaultTransport.MaxIdleConns = 100
+	defaultTransport.MaxIdleConnsPerHost = 100
+	return &http.Client{Transport: defaultTransport}
 }
 
 // metricListener needs to be launched asynchronously, as ListenAndServe is a blocking call
@@ -363,19 +481,41 @@ func metricListener(promPort int) {
 	}
 }
 
-func signalHandler(signalChan chan os.Signal, doneChan chan struct{}) {
-	done := false
-	for {
-		s := <-signalChan
-		if done {
-			fmt.Printf("\nsecond signal received (%s), exiting\n", s)
-			os.Exit(1)
-		}
-		fmt.Printf("\nsignal received: %s\n", s)
-		if s == syscall.SIGTERM {
-			os.Exit(0)
+// exit logs the final totals and writes the end-of-run report, if one was requested, before exiting with code
+func exit(code int) {
+	r := generator.BuildReport()
+	log.Printf("docs written: %d, writes errored: %d, patches completed: %d, patches errored: %d, deletes completed: %d, deletes errored: %d",
+		r.DocsWritten, r.WritesErrored, r.PatchesCompleted, r.PatchesErrored, r.DeletesCompleted, r.DeletesErrored)
+	if reportPath != "" {
+		if err := generator.WriteReport(reportPath); err != nil {
+			log.Printf("failed to write report: %v", err)
+		} else {
+			log.Printf("report written to %s", reportPath)
 		}
-		done = true
-		close(doneChan)
 	}
+	os.Exit(code)
+}
+
+// handleSignals returns a channel which is closed once a signal to stop is received, and a context which is cancelled
+// by a second one to abandon the batches in flight. The handler doesn't exit itself, so the run drains and exits once,
+// from the main goroutine.
+func handleSignals() (<-chan struct{}, context.Context) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Kill, os.Interrupt, syscall.SIGTERM)
+
+	var doneChan = make(chan struct{}, 1)
+	force, cancel := context.WithCancel(context.Background())
+
+	go signalHandler(signalChan, doneChan, cancel)
+	return doneChan, force
+}
+
+func signalHandler(signalChan chan os.Signal, doneChan chan struct{}, cancel context.CancelFunc) {
+	s := <-signalChan
+	fmt.Printf("\nsignal received: %s, draining in-flight batches\n", s)
+	close(doneChan)
+
+	s = <-signalChan
+	fmt.Printf("\nsecond signal received (%s), cancelling in-flight batches\n", s)
+	cancel()
 }